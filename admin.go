@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// route is an API Gateway resource and method handled by something other than the create installers handler.
+type route struct {
+	method   string
+	resource string
+}
+
+// routes maps the Lambda's additional API Gateway routes to their handlers, every other request creates installers.
+var routes = map[route]func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error){
+	{method: http.MethodDelete, resource: "/admin/teams/{team_name}"}:                    handlePurgeTeam,
+	{method: http.MethodPost, resource: "/admin/teams/{team_name}/enroll-secret/rotate"}: handleRotateEnrollSecret,
+	{method: http.MethodPost, resource: "/batch"}:                                        handleBatch,
+	{method: http.MethodGet, resource: "/capabilities"}:                                  handleCapabilities,
+	{method: http.MethodGet, resource: "/jobs/{job_id}"}:                                 handleGetJob,
+}
+
+// PurgeTeamResponse reports what was deleted for a team.
+type PurgeTeamResponse struct {
+	SchemaVersion      string   `json:"schema_version"`
+	TeamName           string   `json:"team_name"`
+	Artifacts          []string `json:"artifacts"`
+	BuildCacheEntries  int      `json:"build_cache_entries"`
+	IdempotencyRecords int      `json:"idempotency_records"`
+	BuildLocks         int      `json:"build_locks"`
+	Jobs               int      `json:"jobs"`
+}
+
+// authorizeAdmin checks the bearer token of a request to an admin route against ADMIN_API_TOKEN, see envSecret. Admin
+// routes are disabled while ADMIN_API_TOKEN isn't set.
+func authorizeAdmin(ctx context.Context, event events.APIGatewayProxyRequest) error {
+	token, err := envSecret(ctx, "ADMIN_API_TOKEN")
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return fmt.Errorf("%w: admin routes are disabled", ErrUnauthorized)
+	}
+	given, ok := strings.CutPrefix(headerValue(event.Headers, "Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return fmt.Errorf("%w: missing or invalid admin token", ErrUnauthorized)
+	}
+	return nil
+}
+
+// handlePurgeTeam deletes everything the packager stored for a team: its installers and index in the artifact bucket
+// and the default destinations, its global index entry and APT suite, its build cache entries and async job records,
+// and its idempotency and build lock records. The team itself is left on the Fleet server. Artifacts are found with
+// the configured key and name templates, installers uploaded with templates passed in requests aren't found.
+func handlePurgeTeam(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := authorizeAdmin(ctx, event); err != nil {
+		return respondError(err)
+	}
+	teamName := event.PathParameters["team_name"]
+	if strings.TrimSpace(teamName) == "" || !isSafeTeamName(teamName) {
+		return respondError(fmt.Errorf("%w: invalid team name %q", ErrBadRequest, teamName))
+	}
+	// teams of named Fleet instances are stored under the instance's default key template and global index key
+	instance := event.QueryStringParameters["fleet_instance"]
+	verr := &validationError{}
+	validateFleetInstance(verr, CreateInstallersRequest{FleetInstance: instance})
+	if len(verr.Fields) > 0 {
+		return respondError(verr)
+	}
+	log.Printf("purging team %q", teamName)
+
+	response := PurgeTeamResponse{SchemaVersion: currentSchemaVersion, TeamName: teamName, Artifacts: []string{}}
+	stores := []ArtifactStore{artifactStore}
+	for _, destination := range defaultDestinations {
+		stores = append(stores, &s3ArtifactStore{bucket: destination.Bucket, region: destination.Region})
+	}
+	for _, store := range stores {
+		deleted, err := purgeTeamArtifacts(ctx, store, instance, teamName)
+		if err != nil {
+			return respondError(err)
+		}
+		for _, key := range deleted {
+			response.Artifacts = append(response.Artifacts, store.URL(key))
+		}
+	}
+
+	if err := removeTeamFromGlobalIndex(ctx, instance, teamName); err != nil {
+		return respondError(err)
+	}
+	repositories, err := purgeTeamRepositories(ctx, teamName)
+	if err != nil {
+		return respondError(err)
+	}
+	for _, key := range repositories {
+		response.Artifacts = append(response.Artifacts, artifactStore.URL(key))
+	}
+
+	response.BuildCacheEntries, err = purgeTeamBuildCache(ctx, teamName)
+	if err != nil {
+		return respondError(err)
+	}
+	response.Jobs, err = purgeTeamJobs(ctx, teamName)
+	if err != nil {
+		return respondError(err)
+	}
+	if table := os.Getenv("IDEMPOTENCY_TABLE"); table != "" {
+		response.IdempotencyRecords, err = purgeTeamItems(ctx, table, "idempotency_key", teamName)
+		if err != nil {
+			return respondError(err)
+		}
+	}
+	if table := os.Getenv("BUILD_LOCK_TABLE"); table != "" {
+		response.BuildLocks, err = purgeTeamItems(ctx, table, "build_key", teamName)
+		if err != nil {
+			return respondError(err)
+		}
+	}
+	return respondJSON(http.StatusOK, response)
+}
+
+// purgeTeamArtifacts deletes the installers of every package type of a team of a Fleet instance, FLEET_URL if it's
+// empty, from store and returns their keys. With the content layout only the team's pointers are deleted, the content
+// addressed installers may be shared.
+func purgeTeamArtifacts(ctx context.Context, store ArtifactStore, instance string, teamName string) ([]string, error) {
+	// installers go with their sidecars, content addressed sidecars are shared like their installers
+	fileSuffixes := []string{""}
+	if artifactLayout() == artifactLayoutContent {
+		fileSuffixes = []string{".json"}
+	} else {
+		for _, suffix := range sidecarSuffixes {
+			fileSuffixes = append(fileSuffixes, suffix)
+		}
+	}
+	var deleted []string
+	for _, packageType := range supportedPackageTypes {
+		job := buildJob{
+			PackageType:   packageType,
+			TeamName:      teamName,
+			FleetInstance: instance,
+			KeyTemplate:   keyTemplate(CreateInstallersRequest{FleetInstance: instance}),
+			NameTemplate:  nameTemplate(CreateInstallersRequest{}),
+		}
+		for _, fileSuffix := range fileSuffixes {
+			prefix, pattern, err := artifactKeyPattern(job, fileSuffix)
+			if err != nil {
+				return nil, err
+			}
+			keys, err := deleteMatchingObjects(ctx, store, prefix, pattern)
+			if err != nil {
+				return nil, err
+			}
+			deleted = append(deleted, keys...)
+		}
+
+		// build manifests, the team index, download page and cask are written next to the first requested package
+		// type's installers
+		for _, file := range []string{manifestFileName, indexFileName, downloadPageFileName, homebrewCaskFileName} {
+			prefix, pattern, err := keyPattern(job, file)
+			if err != nil {
+				return nil, err
+			}
+			keys, err := deleteMatchingObjects(ctx, store, prefix, pattern)
+			if err != nil {
+				return nil, err
+			}
+			deleted = append(deleted, keys...)
+		}
+	}
+	return deleted, nil
+}
+
+// purgeTeamRepositories deletes the team's suite of the APT repository and its YUM repository and returns the
+// deleted keys.
+func purgeTeamRepositories(ctx context.Context, teamName string) ([]string, error) {
+	var keys []string
+	for _, prefix := range []string{fmt.Sprintf("dists/%s/", aptSuite(teamName)), yumRepositoryPrefix(teamName)} {
+		objects, err := artifactStore.ListObjects(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			keys = append(keys, object.Key)
+		}
+	}
+	if err := artifactStore.DeleteObjects(ctx, keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// deleteMatchingObjects deletes the objects under prefix whose keys match pattern and returns their keys.
+func deleteMatchingObjects(ctx context.Context, store ArtifactStore, prefix string, pattern *regexp.Regexp) ([]string, error) {
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, object := range objects {
+		if pattern.MatchString(object.Key) {
+			keys = append(keys, object.Key)
+		}
+	}
+	if err := store.DeleteObjects(ctx, keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// purgeTeamBuildCache deletes the team's build cache entries and returns how many were deleted.
+func purgeTeamBuildCache(ctx context.Context, teamName string) (int, error) {
+	objects, err := artifactStore.ListObjects(ctx, buildCachePrefix)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for _, object := range objects {
+		buf, err := artifactStore.GetObject(ctx, object.Key)
+		if errors.Is(err, errObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var entry buildCacheEntry
+		if err := json.Unmarshal(buf, &entry); err != nil {
+			log.Printf("skipping unparseable build cache entry %s: %s", object.Key, err)
+			continue
+		}
+		if entry.TeamName == teamName {
+			keys = append(keys, object.Key)
+		}
+	}
+	if err := artifactStore.DeleteObjects(ctx, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// purgeTeamJobs deletes the records of the team's async jobs, which hold its enroll secret, and returns how many were
+// deleted.
+func purgeTeamJobs(ctx context.Context, teamName string) (int, error) {
+	objects, err := artifactStore.ListObjects(ctx, jobsPrefix)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for _, object := range objects {
+		buf, err := artifactStore.GetObject(ctx, object.Key)
+		if errors.Is(err, errObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var job asyncJob
+		if err := json.Unmarshal(buf, &job); err != nil {
+			log.Printf("skipping unparseable job record %s: %s", object.Key, err)
+			continue
+		}
+		if job.TeamName == teamName {
+			keys = append(keys, object.Key)
+		}
+	}
+	if err := artifactStore.DeleteObjects(ctx, keys); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// purgeTeamItems deletes the items of teamName from a DynamoDB table whose partition key is keyAttribute and returns
+// how many were deleted.
+func purgeTeamItems(ctx context.Context, table string, keyAttribute string, teamName string) (int, error) {
+	deleted := 0
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		ProjectionExpression:     aws.String("#key"),
+		FilterExpression:         aws.String("team_name = :team_name"),
+		ExpressionAttributeNames: map[string]string{"#key": keyAttribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":team_name": &types.AttributeValueMemberS{Value: teamName},
+		},
+	}
+	for {
+		out, err := dynamoClient.Scan(ctx, input)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to scan %s: %w", table, err)
+		}
+		for _, item := range out.Items {
+			_, err := dynamoClient.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(table),
+				Key:       map[string]types.AttributeValue{keyAttribute: item[keyAttribute]},
+			})
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete from %s: %w", table, err)
+			}
+			deleted++
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return deleted, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// defaultUpdateURL is Fleet's TUF repository, installers update the agent from it unless TUF_UPDATE_URL is set.
+const defaultUpdateURL = "https://tuf.fleetctl.com"
+
+// defaultOrbitUpdateInterval is how often orbit checks for updates unless a request sets orbit_update_interval.
+const defaultOrbitUpdateInterval = 15 * time.Minute
+
+// minOrbitUpdateInterval and maxOrbitUpdateInterval bound the update intervals a request can ask for, checking more
+// often loads the TUF repository and checking less often leaves hosts behind on fixes.
+const (
+	minOrbitUpdateInterval = time.Minute
+	maxOrbitUpdateInterval = 24 * time.Hour
+)
+
+// agentChannels lists the TUF channels a request can build installers from.
+var agentChannels = []string{"stable", "beta", "edge"}
+
+// hostIdentifiers lists the identifiers hosts can enroll with: the hardware UUID, the default, or a per osquery
+// instance identifier for VDI and cloned machines sharing a UUID.
+var hostIdentifiers = []string{"uuid", "instance"}
+
+// agentVersionPattern matches the agent versions a request can pin. Fleet's TUF repository publishes every release
+// under channels named after its version, e.g. "1.16.0", "1.16" and "1".
+var agentVersionPattern = regexp.MustCompile(`^\d+(\.\d+){0,2}$`)
+
+// requestPackagingOptions returns options with the agent settings a request overrides applied. A pinned version
+// replaces the component's channel, the packaging library fetches the component from the channel of that version.
+func requestPackagingOptions(options packaging.Options, request CreateInstallersRequest) packaging.Options {
+	if request.FleetURL != "" {
+		options.FleetURL = request.FleetURL
+	}
+	if request.UpdateURL != "" {
+		options.UpdateURL = request.UpdateURL
+	}
+	options.DisableUpdates = request.DisableUpdates
+	if request.HostIdentifier != "" {
+		options.HostIdentifier = request.HostIdentifier
+	}
+	options.EnableScripts = request.EnableScripts
+	options.EndUserEmail = request.EndUserEmail
+	options.UseSystemConfiguration = request.UseSystemConfiguration
+	options.Debug = request.Debug
+	if request.FleetDesktop != nil {
+		options.Desktop = *request.FleetDesktop
+	}
+	if interval, err := time.ParseDuration(request.OrbitUpdateInterval); err == nil {
+		options.OrbitUpdateInterval = interval
+	}
+	if request.OrbitChannel != "" {
+		options.OrbitChannel = request.OrbitChannel
+	}
+	if request.OsquerydChannel != "" {
+		options.OsquerydChannel = request.OsquerydChannel
+	}
+	if request.DesktopChannel != "" {
+		options.DesktopChannel = request.DesktopChannel
+	}
+	if request.OrbitVersion != "" {
+		options.OrbitChannel = request.OrbitVersion
+	}
+	if request.OsquerydVersion != "" {
+		options.OsquerydChannel = request.OsquerydVersion
+	}
+	if request.DesktopVersion != "" {
+		options.DesktopChannel = request.DesktopVersion
+	}
+	return options
+}
+
+// requestedOptionFields returns the packaging options a request sets, by their packaging.Options field name.
+func requestedOptionFields(request CreateInstallersRequest) []string {
+	var fields []string
+	for field, requested := range map[string]bool{
+		"FleetURL":               request.FleetURL != "",
+		"UpdateURL":              request.UpdateURL != "",
+		"OrbitChannel":           request.OrbitChannel != "" || request.OrbitVersion != "",
+		"OsquerydChannel":        request.OsquerydChannel != "" || request.OsquerydVersion != "",
+		"DesktopChannel":         request.DesktopChannel != "" || request.DesktopVersion != "",
+		"Desktop":                request.FleetDesktop != nil,
+		"OrbitUpdateInterval":    request.OrbitUpdateInterval != "",
+		"HostIdentifier":         request.HostIdentifier != "",
+		"DisableUpdates":         request.DisableUpdates,
+		"EnableScripts":          request.EnableScripts,
+		"EndUserEmail":           request.EndUserEmail != "",
+		"UseSystemConfiguration": request.UseSystemConfiguration,
+		"Debug":                  request.Debug,
+		"OsqueryFlagfile":        request.OsqueryFlagfile != nil,
+		"FleetCertificate":       request.FleetCertificate != nil,
+	} {
+		if requested {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// writeRequestFiles writes the files a request supplies for its installers to disk and returns options packaging them.
+func writeRequestFiles(ctx context.Context, options packaging.Options, request CreateInstallersRequest) (packaging.Options, error) {
+	if request.OsqueryFlagfile != nil {
+		path, err := writeRequestFile(ctx, request.OsqueryFlagfile, "osquery.flags", nil)
+		if err != nil {
+			return packaging.Options{}, err
+		}
+		options.OsqueryFlagfile = path
+	}
+	if request.FleetCertificate != nil {
+		path, err := writeRequestFile(ctx, request.FleetCertificate, "fleet.pem", checkPEMCertificates)
+		if err != nil {
+			return packaging.Options{}, err
+		}
+		options.FleetCertificate = path
+	}
+	return options, nil
+}
+
+// allowedFleetURLs returns the Fleet server URLs a request can enroll installers to: FLEET_SERVER_URL and the comma
+// separated FLEET_SERVER_URL_ALLOWLIST, e.g. the URLs of staging and regional Fleet instances, and the server URLs of
+// the named Fleet instances.
+func allowedFleetURLs() []string {
+	var urls []string
+	candidates := append([]string{appConfig.FleetServerURL}, strings.Split(os.Getenv("FLEET_SERVER_URL_ALLOWLIST"), ",")...)
+	for _, name := range fleetInstanceNames() {
+		candidates = append(candidates, fleetInstances[name].ServerURL)
+	}
+	for _, u := range candidates {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// allowedUpdateURLs returns the TUF repositories a request can build installers against: TUF_UPDATE_URL and the
+// comma separated TUF_UPDATE_URL_ALLOWLIST, e.g. the URLs of regional mirrors. The packager reads the repository
+// itself, so a request can't point it at any other URL.
+func allowedUpdateURLs() []string {
+	var urls []string
+	candidates := append([]string{appConfig.PackagingDefaults.UpdateURL}, strings.Split(os.Getenv("TUF_UPDATE_URL_ALLOWLIST"), ",")...)
+	for _, u := range candidates {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// validateUpdateURL checks a TUF repository URL is an absolute http or https URL.
+func validateUpdateURL(updateURL string) error {
+	u, err := url.Parse(updateURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid TUF repository URL %q, must be a URL like %s", updateURL, defaultUpdateURL)
+	}
+	return nil
+}
+
+// agentComponent is an agent component's channel and pinned version, as a request or one of its packages asks for.
+type agentComponent struct {
+	name    string
+	channel string
+	version string
+}
+
+// validateAgentComponents checks components' channels and versions, a component follows either a channel or a pinned
+// version. Fields are reported prefixed with prefix.
+func validateAgentComponents(verr *validationError, prefix string, components []agentComponent) {
+	for _, component := range components {
+		if component.channel != "" && !isSupported(agentChannels, component.channel) {
+			verr.add(prefix+component.name+"_channel", "unsupported channel %q, must be one of: %s", component.channel, strings.Join(agentChannels, ", "))
+		}
+		if component.version != "" && !agentVersionPattern.MatchString(component.version) {
+			verr.add(prefix+component.name+"_version", "invalid version %q, must be like 1.16.0", component.version)
+		}
+		if component.channel != "" && component.version != "" {
+			verr.add(prefix+component.name+"_version", "must not be set with %s_channel", component.name)
+		}
+	}
+}
+
+// validateAgentOptions checks the agent settings a request asks for: the Fleet server and TUF repository, agent
+// components, their update interval and the files baked into the installers.
+func validateAgentOptions(verr *validationError, request CreateInstallersRequest) {
+	if request.FleetURL != "" && !isSupported(allowedFleetURLs(), strings.TrimRight(request.FleetURL, "/")) {
+		verr.add("fleet_url", "%q isn't an allowed Fleet server URL, must be one of: %s", request.FleetURL, strings.Join(allowedFleetURLs(), ", "))
+	}
+	if request.UpdateURL != "" {
+		if err := validateUpdateURL(request.UpdateURL); err != nil {
+			verr.add("update_url", "%s", err)
+		} else if !isSupported(allowedUpdateURLs(), strings.TrimRight(request.UpdateURL, "/")) {
+			verr.add("update_url", "%q isn't an allowed TUF repository URL, must be one of: %s", request.UpdateURL, strings.Join(allowedUpdateURLs(), ", "))
+		}
+	}
+	if request.OrbitUpdateInterval != "" {
+		interval, err := time.ParseDuration(request.OrbitUpdateInterval)
+		switch {
+		case err != nil:
+			verr.add("orbit_update_interval", "invalid duration %q, must be like 1h", request.OrbitUpdateInterval)
+		case interval < minOrbitUpdateInterval || interval > maxOrbitUpdateInterval:
+			verr.add("orbit_update_interval", "must be between %s and %s", minOrbitUpdateInterval, maxOrbitUpdateInterval)
+		case request.DisableUpdates:
+			verr.add("orbit_update_interval", "must not be set with disable_updates")
+		}
+	}
+	validateAgentComponents(verr, "", []agentComponent{
+		{"orbit", request.OrbitChannel, request.OrbitVersion},
+		{"osqueryd", request.OsquerydChannel, request.OsquerydVersion},
+		{"desktop", request.DesktopChannel, request.DesktopVersion},
+	})
+	if request.HostIdentifier != "" && !isSupported(hostIdentifiers, request.HostIdentifier) {
+		verr.add("host_identifier", "unsupported host identifier %q, must be one of: %s", request.HostIdentifier, strings.Join(hostIdentifiers, ", "))
+	}
+	if request.UseSystemConfiguration && !isSupported(packageTypes(request.Packages), "pkg") {
+		verr.add("use_system_configuration", "only applies to pkg installers, which aren't requested")
+	}
+	if request.EndUserEmail != "" {
+		if address, err := mail.ParseAddress(request.EndUserEmail); err != nil || address.Address != request.EndUserEmail {
+			verr.add("end_user_email", "invalid email address %q", request.EndUserEmail)
+		}
+	}
+	if request.OsqueryFlagfile != nil {
+		request.OsqueryFlagfile.validate(verr, "osquery_flagfile")
+	}
+	if request.FleetCertificate != nil {
+		request.FleetCertificate.validate(verr, "fleet_certificate")
+	}
+	if request.FleetDesktop != nil && !*request.FleetDesktop && (request.DesktopChannel != "" || request.DesktopVersion != "") {
+		verr.add("fleet_desktop", "must not be false with desktop_channel or desktop_version")
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/fleetdm/fleet/v4/server/service"
+)
+
+// agentOptionsTemplatePattern matches the names of agent options templates, which are object names under
+// AGENT_OPTIONS_TEMPLATES_URI.
+var agentOptionsTemplatePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// agentOptionsTemplatesURI returns the S3 prefix agent options templates are read from, e.g.
+// s3://fleet-config/agent-options, empty when templates aren't configured.
+func agentOptionsTemplatesURI() string {
+	return strings.TrimRight(os.Getenv("AGENT_OPTIONS_TEMPLATES_URI"), "/")
+}
+
+// requestAgentOptionsTemplate returns the template a request's new team is configured with: the requested one, else
+// DEFAULT_AGENT_OPTIONS_TEMPLATE unless the request supplies its own agent options.
+func requestAgentOptionsTemplate(request CreateInstallersRequest) string {
+	if request.AgentOptionsTemplate != "" || len(request.AgentOptions) > 0 {
+		return request.AgentOptionsTemplate
+	}
+	return os.Getenv("DEFAULT_AGENT_OPTIONS_TEMPLATE")
+}
+
+// requestAgentOptions returns the agent options a team created for a request is configured with, nil to leave Fleet's
+// defaults. Templates are read from AGENT_OPTIONS_TEMPLATES_URI as <name>.json. Global and team_id requests never
+// create a team.
+func requestAgentOptions(ctx context.Context, request CreateInstallersRequest) (json.RawMessage, error) {
+	if isGlobalRequest(request) || request.TeamID != 0 {
+		return nil, nil
+	}
+	if len(request.AgentOptions) > 0 {
+		return request.AgentOptions, nil
+	}
+	name := requestAgentOptionsTemplate(request)
+	if name == "" {
+		return nil, nil
+	}
+	if agentOptionsTemplatesURI() == "" {
+		return nil, fmt.Errorf("%w: agent options template %q requested but AGENT_OPTIONS_TEMPLATES_URI isn't set", ErrUnprocessable, name)
+	}
+	uri := agentOptionsTemplatesURI() + "/" + name + ".json"
+	bucket, key, err := parseS3URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := (&s3ArtifactStore{bucket: bucket}).GetObject(ctx, key)
+	if errors.Is(err, errObjectNotFound) {
+		return nil, fmt.Errorf("%w: agent options template %q not found at %s", ErrBadRequest, name, uri)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agent options template %q: %w", name, err)
+	}
+	if err := checkAgentOptions(buf); err != nil {
+		return nil, fmt.Errorf("%w: invalid agent options template %q: %w", ErrUnprocessable, name, err)
+	}
+	return buf, nil
+}
+
+// checkAgentOptions checks agent options are a JSON object, Fleet validates their content when they're applied.
+func checkAgentOptions(options []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(options, &object); err != nil || object == nil {
+		return errors.New("must be a JSON object")
+	}
+	return nil
+}
+
+// applyTeamAgentOptions replaces a team's agent options.
+func applyTeamAgentOptions(ctx context.Context, fleetClient *service.Client, teamID uint, options json.RawMessage) error {
+	return fleetDo(ctx, fleetClient, "apply team agent options", http.MethodPost, fmt.Sprintf("/api/latest/fleet/teams/%d/agent_options", teamID), options)
+}
+
+// validateTeamAgentOptions checks the agent options a request configures its new team with.
+func validateTeamAgentOptions(verr *validationError, request CreateInstallersRequest) {
+	if len(request.AgentOptions) > 0 {
+		if err := checkAgentOptions(request.AgentOptions); err != nil {
+			verr.add("agent_options", "%s", err)
+		}
+	}
+	if request.AgentOptionsTemplate != "" {
+		switch {
+		case len(request.AgentOptions) > 0:
+			verr.add("agent_options_template", "must not be set with agent_options")
+		case !agentOptionsTemplatePattern.MatchString(request.AgentOptionsTemplate):
+			verr.add("agent_options_template", "invalid template name %q, must only contain letters, digits, '.', '_' and '-'", request.AgentOptionsTemplate)
+		case agentOptionsTemplatesURI() == "":
+			verr.add("agent_options_template", "agent options templates aren't configured")
+		}
+	}
+	if (len(request.AgentOptions) > 0 || request.AgentOptionsTemplate != "") && (isGlobalRequest(request) || request.TeamID != 0) {
+		verr.add("agent_options", "only apply to teams the request creates, not with global or team_id")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aptComponent is the only component of the APT repository.
+const aptComponent = "main"
+
+// aptRepositoryEnabled reports whether deb installers are published to an APT repository, set APT_REPOSITORY to
+// enable it. The repository's Release file is signed with GPG_SIGNING_KEY_SECRET, which has to be set as well.
+func aptRepositoryEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("APT_REPOSITORY"))
+	return enabled
+}
+
+// aptSuite returns the suite a team's debs are published in, the escaped team name.
+func aptSuite(teamName string) string {
+	return escapeKeySegment(teamName)
+}
+
+// updateAptRepository publishes the debs a request uploaded in the team's suite of the APT repository rooted at the
+// artifact bucket: dists/<suite>/main/binary-<arch>/Packages lists the deb of each architecture by its installer key,
+// and dists/<suite>/Release with its InRelease and Release.gpg signatures lists the Packages indexes of every
+// architecture. A suite only ever lists the team's latest deb of each architecture, the enroll secret baked into older
+// ones may be gone.
+func updateAptRepository(ctx context.Context, teamName string, jobs []buildJob, results []PackageResult) error {
+	suite := aptSuite(teamName)
+	indexes := map[string][]byte{}
+	var published []string
+	for _, result := range results {
+		if result.Package != "deb" || result.Status != packageStatusSucceeded {
+			continue
+		}
+		// the control fields are read from the uploaded package, results reused from the build cache have no local file
+		buf, err := artifactStore.GetObject(ctx, result.Key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", result.Key, err)
+		}
+		control, err := debControl(buf)
+		if err != nil {
+			return fmt.Errorf("failed to read control file of %s: %w", result.Key, err)
+		}
+		arch := controlField(control, "Architecture")
+		if arch == "" {
+			return fmt.Errorf("control file of %s has no Architecture", result.Key)
+		}
+
+		var packages bytes.Buffer
+		packages.WriteString(strings.TrimRight(control, "\n"))
+		fmt.Fprintf(&packages, "\nFilename: %s\nSize: %d\nMD5sum: %x\nSHA1: %x\nSHA256: %x\n", result.Key, len(buf), md5.Sum(buf), sha1.Sum(buf), sha256.Sum256(buf))
+		var packagesGz bytes.Buffer
+		gz := gzip.NewWriter(&packagesGz)
+		if _, err := gz.Write(packages.Bytes()); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		indexes[fmt.Sprintf("%s/binary-%s/Packages", aptComponent, arch)] = packages.Bytes()
+		indexes[fmt.Sprintf("%s/binary-%s/Packages.gz", aptComponent, arch)] = packagesGz.Bytes()
+		published = append(published, result.Key)
+	}
+	if len(published) == 0 {
+		return nil
+	}
+
+	return withIndexLock(ctx, func() error {
+		// the Release lists the indexes of the architectures this request didn't build as well
+		existing, err := artifactStore.ListObjects(ctx, fmt.Sprintf("dists/%s/%s/", suite, aptComponent))
+		if err != nil {
+			return err
+		}
+		all := map[string][]byte{}
+		for _, object := range existing {
+			path := strings.TrimPrefix(object.Key, fmt.Sprintf("dists/%s/", suite))
+			if _, ok := indexes[path]; ok {
+				continue
+			}
+			index, err := artifactStore.GetObject(ctx, object.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read APT index: %w", err)
+			}
+			all[path] = index
+		}
+		for path, index := range indexes {
+			all[path] = index
+		}
+		release := aptRelease(suite, all)
+		inRelease, err := packageSigner.clearSign(release)
+		if err != nil {
+			return err
+		}
+		releaseGPG, err := packageSigner.detachSign(release)
+		if err != nil {
+			return err
+		}
+
+		// indexes are written before the Release listing them, so clients never see a Release without its indexes
+		for path, index := range indexes {
+			if err := artifactStore.PutObject(ctx, fmt.Sprintf("dists/%s/%s", suite, path), index, "application/octet-stream", jobs[0]); err != nil {
+				return fmt.Errorf("failed to write APT index: %w", err)
+			}
+		}
+		for name, body := range map[string][]byte{"Release": release, "InRelease": inRelease, "Release.gpg": releaseGPG} {
+			if err := artifactStore.PutObject(ctx, fmt.Sprintf("dists/%s/%s", suite, name), body, "text/plain", jobs[0]); err != nil {
+				return fmt.Errorf("failed to write APT %s: %w", name, err)
+			}
+		}
+		log.Printf("published %s to APT suite %s", strings.Join(published, ", "), suite)
+		return nil
+	})
+}
+
+// aptRelease returns the Release file of a suite listing its indexes by path relative to dists/<suite>, e.g.
+// main/binary-amd64/Packages.
+func aptRelease(suite string, indexes map[string][]byte) []byte {
+	paths := make([]string, 0, len(indexes))
+	var archs []string
+	for path := range indexes {
+		paths = append(paths, path)
+		if dir, file := filepath.Split(path); file == "Packages" {
+			archs = append(archs, strings.TrimPrefix(filepath.Base(dir), "binary-"))
+		}
+	}
+	sort.Strings(paths)
+	sort.Strings(archs)
+	var release bytes.Buffer
+	fmt.Fprintf(&release, "Origin: Fleet\nLabel: Fleet\nSuite: %s\nCodename: %s\nDate: %s\nArchitectures: %s\nComponents: %s\nDescription: Fleet osquery installers for %s\n",
+		suite, suite, time.Now().UTC().Format(time.RFC1123Z), strings.Join(archs, " "), aptComponent, suite)
+	release.WriteString("MD5Sum:\n")
+	for _, path := range paths {
+		fmt.Fprintf(&release, " %x %d %s\n", md5.Sum(indexes[path]), len(indexes[path]), path)
+	}
+	release.WriteString("SHA1:\n")
+	for _, path := range paths {
+		fmt.Fprintf(&release, " %x %d %s\n", sha1.Sum(indexes[path]), len(indexes[path]), path)
+	}
+	release.WriteString("SHA256:\n")
+	for _, path := range paths {
+		fmt.Fprintf(&release, " %x %d %s\n", sha256.Sum256(indexes[path]), len(indexes[path]), path)
+	}
+	return release.Bytes()
+}
+
+// debControl returns the control file of a deb package, the "control" file of its control.tar.gz member.
+func debControl(deb []byte) (string, error) {
+	const arMagic = "!<arch>\n"
+	if !bytes.HasPrefix(deb, []byte(arMagic)) {
+		return "", errors.New("not an ar archive")
+	}
+	// ar members have a 60 byte header: name, mtime, uid, gid, mode, size and a terminator, and are 2 byte aligned
+	for offset := len(arMagic); offset+60 <= len(deb); {
+		header := deb[offset : offset+60]
+		name := strings.TrimRight(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.Atoi(strings.TrimSpace(string(header[48:58])))
+		if err != nil || offset+60+size > len(deb) {
+			return "", fmt.Errorf("invalid ar member %q", name)
+		}
+		data := deb[offset+60 : offset+60+size]
+		offset += 60 + size + size%2
+
+		var r io.Reader
+		switch name {
+		case "control.tar":
+			r = bytes.NewReader(data)
+		case "control.tar.gz":
+			gz, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return "", err
+			}
+			r = gz
+		default:
+			if strings.HasPrefix(name, "control.tar") {
+				return "", fmt.Errorf("unsupported control archive %s", name)
+			}
+			continue
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return "", errors.New("control archive has no control file")
+			}
+			if err != nil {
+				return "", err
+			}
+			if strings.TrimPrefix(hdr.Name, "./") == "control" {
+				control, err := io.ReadAll(tr)
+				return string(control), err
+			}
+		}
+	}
+	return "", errors.New("no control archive")
+}
+
+// controlField returns the value of a single line field of a deb control file.
+func controlField(control string, field string) string {
+	scanner := bufio.NewScanner(strings.NewReader(control))
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(scanner.Text(), ":"); ok && strings.EqualFold(name, field) {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	archAmd64 = "amd64"
+	archArm64 = "arm64"
+	// archUniversal is the architecture of pkgs, which carry universal binaries running natively on Intel and Apple
+	// Silicon Macs.
+	archUniversal = "universal"
+)
+
+// packageArchitectures lists the architectures each package type can be built for, the first is the default.
+var packageArchitectures = map[string][]string{
+	"deb": {archAmd64, archArm64},
+	"rpm": {archAmd64, archArm64},
+	"pkg": {archUniversal, archAmd64, archArm64},
+	"msi": {archAmd64},
+}
+
+// archFileNames are the names installers of a package type give an architecture in their file names, where they differ
+// from the architecture's own, e.g. fleet-osquery-1.16.0.aarch64.rpm.
+var archFileNames = map[string]map[string]string{
+	"rpm": {archAmd64: "x86_64", archArm64: "aarch64"},
+}
+
+// supportedArchitectures lists every architecture a request can ask for.
+var supportedArchitectures = []string{archAmd64, archArm64, archUniversal}
+
+// newArchitectureJob returns job building for the architecture requested for it, empty meaning the package type's
+// default. The architecture is passed to the packaging library for Linux packages, which are built per architecture.
+func newArchitectureJob(job buildJob, requested string) buildJob {
+	job.Architecture = packageArchitecture(job.PackageType, requested)
+	if job.PackageType == "deb" || job.PackageType == "rpm" {
+		job.Options.Architecture = job.Architecture
+	}
+	return job
+}
+
+// packageArchitecture returns the architecture an installer of packageType is built for when requested is asked for,
+// empty meaning the package type's default. pkgs are always universal.
+func packageArchitecture(packageType string, requested string) string {
+	architectures := packageArchitectures[packageType]
+	if len(architectures) > 0 && (packageType == "pkg" || requested == "") {
+		return architectures[0]
+	}
+	return requested
+}
+
+// isSupportedArchitecture reports whether installers of packageType can be built for arch.
+func isSupportedArchitecture(packageType string, arch string) bool {
+	return isSupported(packageArchitectures[packageType], arch)
+}
+
+// validateArchitecture checks a request's architecture against every requested package type that doesn't set its
+// own.
+func validateArchitecture(verr *validationError, request CreateInstallersRequest) {
+	arch := request.Architecture
+	if arch == "" {
+		return
+	}
+	if !isSupported(supportedArchitectures, arch) {
+		verr.add("architecture", "unsupported architecture %q, must be one of: %s", arch, strings.Join(supportedArchitectures, ", "))
+		return
+	}
+	for _, spec := range request.Packages {
+		if spec.Architecture == "" && isSupportedPackageType(spec.Type) && !isSupportedArchitecture(spec.Type, arch) {
+			verr.add("architecture", "%s installers can't be built for %q, must be one of: %s", spec.Type, arch, strings.Join(packageArchitectures[spec.Type], ", "))
+		}
+	}
+}
+
+// buildCell is an installer a request builds, a package type for an architecture, with the package's overrides.
+type buildCell struct {
+	PackageType  string
+	Architecture string
+	Spec         packageSpec
+}
+
+// requestCells expands a request's packages and architectures into the installers it builds, in request order. A
+// matrix of architectures skips the architectures a package type can't be built for, and builds a pkg once since pkgs
+// are universal. A package setting its own architecture is only built for that one.
+func requestCells(request CreateInstallersRequest) []buildCell {
+	var cells []buildCell
+	seen := map[buildCell]bool{}
+	for _, spec := range request.Packages {
+		packageType := spec.Type
+		architectures := request.Architectures
+		switch {
+		case spec.Architecture != "":
+			architectures = []string{spec.Architecture}
+		case len(architectures) == 0:
+			architectures = []string{request.Architecture}
+		}
+		for _, arch := range architectures {
+			if spec.Architecture == "" && len(request.Architectures) > 0 && !isSupportedArchitecture(packageType, arch) {
+				continue
+			}
+			cell := buildCell{PackageType: packageType, Architecture: packageArchitecture(packageType, arch), Spec: spec}
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells
+}
+
+// validateArchitectures checks a request's matrix of architectures: every architecture must be supported and listed
+// once, and every requested package type must be buildable for at least one of them unless it sets its own.
+func validateArchitectures(verr *validationError, request CreateInstallersRequest) {
+	if len(request.Architectures) == 0 {
+		return
+	}
+	if request.Architecture != "" {
+		verr.add("architecture", "must not be set with architectures")
+	}
+	seen := map[string]bool{}
+	for i, arch := range request.Architectures {
+		field := fmt.Sprintf("architectures[%d]", i)
+		switch {
+		case !isSupported(supportedArchitectures, arch):
+			verr.add(field, "unsupported architecture %q, must be one of: %s", arch, strings.Join(supportedArchitectures, ", "))
+		case seen[arch]:
+			verr.add(field, "duplicate architecture %q", arch)
+		}
+		seen[arch] = true
+	}
+	for i, spec := range request.Packages {
+		buildable := spec.Architecture != ""
+		for _, arch := range request.Architectures {
+			buildable = buildable || isSupportedArchitecture(spec.Type, arch)
+		}
+		if isSupportedPackageType(spec.Type) && !buildable {
+			verr.add(fmt.Sprintf("packages[%d]", i), "%s installers can't be built for any of the architectures, must be one of: %s", spec.Type, strings.Join(packageArchitectures[spec.Type], ", "))
+		}
+	}
+}
+
+// representativeFileName returns a file name like the one the packaging library builds job's installer as, for
+// rendering keys before anything is built. Linux packages are named after their architecture.
+func representativeFileName(job buildJob) string {
+	if job.PackageType == "deb" || job.PackageType == "rpm" {
+		return fmt.Sprintf("fleet-osquery_%s.%s", job.Architecture, job.PackageType)
+	}
+	return fmt.Sprintf("fleet-osquery.%s", job.PackageType)
+}
+
+// packageLabel names an installer of packageType built for arch in messages, with the architecture unless it's the
+// package type's default.
+func packageLabel(packageType string, arch string) string {
+	if arch == "" || arch == packageArchitecture(packageType, "") {
+		return packageType
+	}
+	return fmt.Sprintf("%s (%s)", packageType, arch)
+}
+
+// requestLabels returns the labels of the installers a request builds.
+func requestLabels(request CreateInstallersRequest) []string {
+	var labels []string
+	for _, cell := range requestCells(request) {
+		labels = append(labels, packageLabel(cell.PackageType, cell.Architecture))
+	}
+	return labels
+}
+
+// isSupported reports whether values contains value.
+func isSupported(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
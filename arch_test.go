@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestCells(t *testing.T) {
+	tests := []struct {
+		name    string
+		request CreateInstallersRequest
+		want    []buildCell
+	}{
+		{
+			name:    "default architectures",
+			request: CreateInstallersRequest{Packages: []packageSpec{{Type: "deb"}, {Type: "pkg"}}},
+			want: []buildCell{
+				{PackageType: "deb", Architecture: archAmd64, Spec: packageSpec{Type: "deb"}},
+				{PackageType: "pkg", Architecture: archUniversal, Spec: packageSpec{Type: "pkg"}},
+			},
+		},
+		{
+			name:    "architecture",
+			request: CreateInstallersRequest{Architecture: archArm64, Packages: []packageSpec{{Type: "rpm"}, {Type: "pkg"}}},
+			want: []buildCell{
+				{PackageType: "rpm", Architecture: archArm64, Spec: packageSpec{Type: "rpm"}},
+				{PackageType: "pkg", Architecture: archUniversal, Spec: packageSpec{Type: "pkg"}},
+			},
+		},
+		{
+			name: "matrix skips unsupported architectures and builds pkgs once",
+			request: CreateInstallersRequest{
+				Architectures: []string{archAmd64, archArm64},
+				Packages:      []packageSpec{{Type: "deb"}, {Type: "msi"}, {Type: "pkg"}},
+			},
+			want: []buildCell{
+				{PackageType: "deb", Architecture: archAmd64, Spec: packageSpec{Type: "deb"}},
+				{PackageType: "deb", Architecture: archArm64, Spec: packageSpec{Type: "deb"}},
+				{PackageType: "msi", Architecture: archAmd64, Spec: packageSpec{Type: "msi"}},
+				{PackageType: "pkg", Architecture: archUniversal, Spec: packageSpec{Type: "pkg"}},
+			},
+		},
+		{
+			name: "package architecture overrides the matrix",
+			request: CreateInstallersRequest{
+				Architectures: []string{archAmd64, archArm64},
+				Packages:      []packageSpec{{Type: "rpm", Architecture: archArm64, OrbitChannel: "edge"}, {Type: "deb"}},
+			},
+			want: []buildCell{
+				{PackageType: "rpm", Architecture: archArm64, Spec: packageSpec{Type: "rpm", Architecture: archArm64, OrbitChannel: "edge"}},
+				{PackageType: "deb", Architecture: archAmd64, Spec: packageSpec{Type: "deb"}},
+				{PackageType: "deb", Architecture: archArm64, Spec: packageSpec{Type: "deb"}},
+			},
+		},
+		{
+			name:    "duplicate packages",
+			request: CreateInstallersRequest{Packages: []packageSpec{{Type: "deb"}, {Type: "deb"}}},
+			want:    []buildCell{{PackageType: "deb", Architecture: archAmd64, Spec: packageSpec{Type: "deb"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestCells(tt.request); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requestCells() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
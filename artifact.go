@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// artifact describes a built installer on local disk.
+type artifact struct {
+	Path   string
+	SHA256 string
+	Size   int64
+}
+
+// inspectArtifact computes the size and hex encoded SHA-256 checksum of the installer at path.
+func inspectArtifact(path string) (artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return artifact{}, fmt.Errorf("failed to open artifact %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return artifact{}, fmt.Errorf("failed to checksum artifact %s: %w", path, err)
+	}
+	return artifact{Path: path, SHA256: hex.EncodeToString(h.Sum(nil)), Size: size}, nil
+}
+
+// checksumSHA256 returns the installer's checksum base64 encoded, the form S3 validates uploads against.
+func (a artifact) checksumSHA256() (string, error) {
+	sum, err := hex.DecodeString(a.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %q: %w", a.SHA256, err)
+	}
+	return base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// multipartChecksumSHA256 returns the checksum S3 reports for the installer uploaded in parts of partSize: the base64
+// encoded SHA-256 of the concatenated part checksums, suffixed with the number of parts.
+func (a artifact) multipartChecksumSHA256(partSize int64) (string, error) {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open artifact %s: %w", a.Path, err)
+	}
+	defer f.Close()
+
+	composite := sha256.New()
+	parts := 0
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(h, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", fmt.Errorf("failed to checksum artifact %s: %w", a.Path, err)
+		}
+		if n == 0 {
+			break
+		}
+		composite.Write(h.Sum(nil))
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(composite.Sum(nil)), parts), nil
+}
+
+// packageIDPattern matches the runs of characters a team name can't contribute to a package manager's package id.
+var packageIDPattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// teamPackageID returns the id of a team's package in a package manager like Chocolatey or Homebrew, base suffixed
+// with the team. Every team's installers enroll with their own secret, so every team gets its own package.
+func teamPackageID(base string, teamName string) string {
+	return base + "-" + strings.Trim(packageIDPattern.ReplaceAllString(strings.ToLower(teamName), "-"), "-")
+}
+
+// buildVersion returns the version of a package built at t in a package manager. Every build is a new version, and
+// package managers like NuGet only take numeric versions, so the build time is split into year, day and time of day.
+func buildVersion(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%d.%d.%d", t.Year(), int(t.Month())*100+t.Day(), t.Hour()*10000+t.Minute()*100+t.Second())
+}
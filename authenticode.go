@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// defaultTimestampURL is the RFC 3161 timestamping service used unless AUTHENTICODE_TIMESTAMP_URL is set.
+const defaultTimestampURL = "http://timestamp.digicert.com"
+
+// msiSigner Authenticode signs MSIs after they're built, it's nil unless AUTHENTICODE_CERT_SECRET is set.
+var msiSigner *authenticodeSigner
+
+// authenticodeSigner signs MSIs with osslsigncode using a PKCS#12 code signing certificate. Signatures are
+// timestamped, so they stay valid after the certificate expires.
+type authenticodeSigner struct {
+	dir          string
+	timestampURL string
+}
+
+// newAuthenticodeSigner returns the signer for the PKCS#12 certificate in the Secrets Manager secret
+// AUTHENTICODE_CERT_SECRET, or nil if it isn't set. The certificate is stored as a binary secret or base64 encoded
+// in a string secret, its password is read from the secret AUTHENTICODE_CERT_PASSWORD_SECRET.
+func newAuthenticodeSigner(ctx context.Context, secrets *secretsmanager.Client) (*authenticodeSigner, error) {
+	secretID := os.Getenv("AUTHENTICODE_CERT_SECRET")
+	if secretID == "" {
+		return nil, nil
+	}
+	cert, err := secretBytes(ctx, secrets, secretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Authenticode certificate: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "authenticode")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cert.p12"), cert, 0o600); err != nil {
+		return nil, err
+	}
+	// the password is passed in a file, it would show up in the process list as an argument
+	var password string
+	if passwordID := os.Getenv("AUTHENTICODE_CERT_PASSWORD_SECRET"); passwordID != "" {
+		password, err = secretString(ctx, secrets, passwordID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Authenticode certificate password: %w", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte(password), 0o600); err != nil {
+		return nil, err
+	}
+
+	timestampURL := os.Getenv("AUTHENTICODE_TIMESTAMP_URL")
+	if timestampURL == "" {
+		timestampURL = defaultTimestampURL
+	}
+	return &authenticodeSigner{dir: dir, timestampURL: timestampURL}, nil
+}
+
+// signPackage Authenticode signs a built MSI in place. Other package types are left alone.
+func (s *authenticodeSigner) signPackage(packageType string, path string) error {
+	if packageType != "msi" {
+		return nil
+	}
+	signed := path + ".signed"
+	cmd := exec.Command("osslsigncode", "sign",
+		"-pkcs12", filepath.Join(s.dir, "cert.p12"),
+		"-readpass", filepath.Join(s.dir, "password"),
+		"-n", "Fleet osquery",
+		"-h", "sha256",
+		"-ts", s.timestampURL,
+		"-in", path,
+		"-out", signed,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(signed)
+		return fmt.Errorf("failed to Authenticode sign msi: osslsigncode: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(signed, path)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// azureArtifactStore stores artifacts in an Azure Blob Storage container, authenticating with the default Azure
+// credential chain (environment, workload identity, managed identity).
+type azureArtifactStore struct {
+	client    *azblob.Client
+	account   string
+	container string
+}
+
+func newAzureArtifactStore(account string, container string) (*azureArtifactStore, error) {
+	if account == "" {
+		return nil, errors.New("AZURE_STORAGE_ACCOUNT must be set to store artifacts in Azure")
+	}
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Azure credentials: %w", err)
+	}
+	client, err := azblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure Blob client: %w", err)
+	}
+	return &azureArtifactStore{client: client, account: account, container: container}, nil
+}
+
+// PutArtifact uploads the installer as a block blob and compares the stored blob's size with the installer's.
+// Encryption is configured on the storage account, S3 KMS keys, storage classes and tags don't apply.
+func (s *azureArtifactStore) PutArtifact(ctx context.Context, key string, built artifact, job buildJob, name string) error {
+	f, err := os.Open(built.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = s.client.UploadFile(ctx, s.container, key, f, &azblob.UploadFileOptions{
+		HTTPHeaders: &blob.HTTPHeaders{
+			BlobContentType:        stringPtr(artifactContentType(job.PackageType)),
+			BlobContentDisposition: stringPtr(contentDisposition(name)),
+		},
+		Metadata: map[string]*string{"sha256": stringPtr(built.SHA256)},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	info, err := s.StatObject(ctx, key)
+	if err != nil {
+		return fmt.Errorf("%w: failed to verify %s: %w", ErrUploadFailed, key, err)
+	}
+	if info == nil || info.Size != built.Size || info.SHA256 != built.SHA256 {
+		return fmt.Errorf("%w: %s doesn't match the uploaded installer", ErrUploadFailed, key)
+	}
+	return nil
+}
+
+func (s *azureArtifactStore) PutObject(ctx context.Context, key string, body []byte, contentType string, job buildJob) error {
+	_, err := s.client.UploadBuffer(ctx, s.container, key, body, &azblob.UploadBufferOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: stringPtr(contentType)},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	return nil
+}
+
+func (s *azureArtifactStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.client.DownloadStream(ctx, s.container, key, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, errObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *azureArtifactStore) StatObject(ctx context.Context, key string) (*objectInfo, error) {
+	props, err := s.client.ServiceClient().NewContainerClient(s.container).NewBlobClient(key).GetProperties(ctx, nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	info := &objectInfo{}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	// metadata names come back capitalized
+	for name, value := range props.Metadata {
+		if strings.EqualFold(name, "sha256") && value != nil {
+			info.SHA256 = *value
+		}
+	}
+	return info, nil
+}
+
+// CopyObject starts a server side copy and waits for it to finish, copies within a storage account usually complete
+// immediately.
+func (s *azureArtifactStore) CopyObject(ctx context.Context, src string, dst string, job buildJob) error {
+	containerClient := s.client.ServiceClient().NewContainerClient(s.container)
+	dstClient := containerClient.NewBlobClient(dst)
+	resp, err := dstClient.StartCopyFromURL(ctx, containerClient.NewBlobClient(src).URL(), nil)
+	if err != nil {
+		return fmt.Errorf("%w: failed to copy %s to %s: %w", ErrUploadFailed, src, dst, err)
+	}
+	status := resp.CopyStatus
+	for status != nil && *status == blob.CopyStatusTypePending {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: copying %s to %s: %w", ErrUploadFailed, src, dst, ctx.Err())
+		case <-time.After(time.Second):
+		}
+		props, err := dstClient.GetProperties(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("%w: failed to check copy of %s to %s: %w", ErrUploadFailed, src, dst, err)
+		}
+		status = props.CopyStatus
+	}
+	if status != nil && *status != blob.CopyStatusTypeSuccess {
+		return fmt.Errorf("%w: copying %s to %s ended with status %s", ErrUploadFailed, src, dst, *status)
+	}
+	return nil
+}
+
+func (s *azureArtifactStore) ListObjects(ctx context.Context, prefix string) ([]objectSummary, error) {
+	var objects []objectSummary
+	pager := s.client.NewListBlobsFlatPager(s.container, &azblob.ListBlobsFlatOptions{Prefix: stringPtr(prefix)})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		if page.Segment == nil {
+			continue
+		}
+		for _, item := range page.Segment.BlobItems {
+			object := objectSummary{}
+			if item.Name != nil {
+				object.Key = *item.Name
+			}
+			if item.Properties != nil && item.Properties.LastModified != nil {
+				object.LastModified = *item.Properties.LastModified
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+func (s *azureArtifactStore) DeleteObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		_, err := s.client.DeleteBlob(ctx, s.container, key, nil)
+		if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *azureArtifactStore) URL(key string) string {
+	return fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", s.account, s.container, key)
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
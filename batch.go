@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxBatchBuilds bounds the builds of a batch request, they run one after the other within a single invocation.
+const maxBatchBuilds = 20
+
+// batchMinRemaining is the time an invocation must have left to start another build of a batch request, builds left
+// over are reported as not started.
+const batchMinRemaining = 3 * time.Minute
+
+// BatchRequest builds installers for several teams in one request, e.g. when onboarding a customer.
+type BatchRequest struct {
+	// Builds are installers requests, each parsed and validated like a request of its own.
+	Builds []json.RawMessage `json:"builds"`
+}
+
+// BatchResponse reports the outcome of every build of a batch request, in request order.
+type BatchResponse struct {
+	SchemaVersion string        `json:"schema_version"`
+	Builds        []BatchResult `json:"builds"`
+}
+
+// BatchResult is the outcome of a build of a batch request: the status code and body it would have got as a request
+// of its own, a CreateInstallersResponse or an ErrorResponse.
+type BatchResult struct {
+	TeamName   string          `json:"team_name"`
+	StatusCode int             `json:"status_code"`
+	Response   json.RawMessage `json:"response"`
+}
+
+// handleBatch builds the installers of every build of a batch request. Builds are validated up front, an invalid one
+// rejects the whole batch before anything is built. They then run one at a time, the packaging library writes
+// installers under names that don't tell teams apart, and later builds reuse the agent downloads of earlier ones. A
+// failing build doesn't stop the others, builds the invocation has no time left for are reported as ErrNotStarted.
+func handleBatch(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, err := negotiateSchemaVersion(event); err != nil {
+		return respondError(err)
+	}
+	var batch BatchRequest
+	decoder := json.NewDecoder(strings.NewReader(event.Body))
+	if strictParsingEnabled(event) {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(&batch); err != nil {
+		return respondError(fmt.Errorf("%w: failed to parse batch request: %w", ErrBadRequest, err))
+	}
+	if len(batch.Builds) == 0 || len(batch.Builds) > maxBatchBuilds {
+		return respondError(fmt.Errorf("%w: builds must contain between 1 and %d builds", ErrBadRequest, maxBatchBuilds))
+	}
+
+	requests := make([]CreateInstallersRequest, len(batch.Builds))
+	verr := &validationError{}
+	teams := map[string]int{}
+	for i, raw := range batch.Builds {
+		prefix := fmt.Sprintf("builds[%d]", i)
+		buildEvent := events.APIGatewayProxyRequest{Body: string(raw), QueryStringParameters: event.QueryStringParameters}
+		request, err := parseEventBody(buildEvent)
+		if err != nil {
+			verr.add(prefix, "%s", err)
+			continue
+		}
+		request, err = applyTeamDefaults(ctx, request)
+		if err != nil {
+			return respondError(err)
+		}
+		request.Packages = expandPackageSpecs(request.Packages)
+		if err := validateRequest(request); err != nil {
+			var fields *validationError
+			if errors.As(err, &fields) {
+				for _, f := range fields.Fields {
+					verr.add(prefix+"."+f.Field, "%s", f.Message)
+				}
+			} else {
+				verr.add(prefix, "%s", err)
+			}
+			continue
+		}
+		team := batchTeamKey(request)
+		if other, ok := teams[team]; ok {
+			verr.add(prefix, "builds the same team as builds[%d]", other)
+		}
+		teams[team] = i
+		requests[i] = request
+	}
+	if len(verr.Fields) > 0 {
+		return respondError(verr)
+	}
+
+	response := BatchResponse{SchemaVersion: currentSchemaVersion, Builds: make([]BatchResult, len(requests))}
+	statusCode := http.StatusOK
+	for i, request := range requests {
+		var result events.APIGatewayProxyResponse
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < batchMinRemaining {
+			result, _ = respondError(fmt.Errorf("%w: the invocation has %s left", ErrNotStarted, time.Until(deadline).Round(time.Second)))
+		} else {
+			var err error
+			result, err = invokeRequest(ctx, request.IdempotencyKey, request)
+			if err != nil {
+				result, _ = respondError(err)
+			}
+		}
+		if result.StatusCode != http.StatusOK {
+			statusCode = http.StatusMultiStatus
+		}
+		teamName := request.TeamName
+		if isGlobalRequest(request) {
+			teamName = globalTeamName
+		}
+		response.Builds[i] = BatchResult{TeamName: teamName, StatusCode: result.StatusCode, Response: json.RawMessage(result.Body)}
+		log.Printf("batch build %d of %d for team %s finished with %d", i+1, len(requests), teamName, result.StatusCode)
+	}
+	return respondJSON(statusCode, response)
+}
+
+// batchTeamKey identifies the team a build of a batch request builds for, so two builds can't race on one team.
+func batchTeamKey(request CreateInstallersRequest) string {
+	switch {
+	case isGlobalRequest(request):
+		return request.FleetInstance + "/" + globalTeamName
+	case request.TeamID != 0:
+		return fmt.Sprintf("%s/#%d", request.FleetInstance, request.TeamID)
+	default:
+		return request.FleetInstance + "/" + request.TeamName
+	}
+}
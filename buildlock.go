@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	buildLockStatusBuilding  = "building"
+	buildLockStatusCompleted = "completed"
+
+	// buildLockTimeout bounds how long a build lock is held, a holder that hasn't finished by then was killed
+	// with its Lambda and the lock can be taken over.
+	buildLockTimeout = 15 * time.Minute
+
+	// buildLockResultTTL is how long a completed build is reused by identical requests.
+	buildLockResultTTL = 10 * time.Minute
+
+	// buildLockPollInterval is how often a waiting request checks whether the lock holder finished.
+	buildLockPollInterval = 5 * time.Second
+)
+
+// buildGroup deduplicates identical builds running concurrently in this process.
+var buildGroup singleflight.Group
+
+// buildLockStore coordinates identical builds across concurrent Lambda invocations through the DynamoDB table
+// named by BUILD_LOCK_TABLE. The table's partition key is the string attribute "build_key", enable TTL on
+// "expires_at" to expire records.
+type buildLockStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// newBuildLockStore returns the configured build lock store, or nil if BUILD_LOCK_TABLE isn't set.
+func newBuildLockStore() *buildLockStore {
+	table := os.Getenv("BUILD_LOCK_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &buildLockStore{client: dynamoClient, table: table}
+}
+
+// buildKey identifies a build by everything that influences its output and where it's uploaded to.
+func buildKey(job buildJob) (string, error) {
+	buf, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// buildOnce builds and uploads a package, sharing the result with identical builds that overlap with it, whether
+// they run in this process or in another invocation. Unless forceRebuild is set, an artifact left by a previous
+// identical build is reused from the build cache instead of building again.
+func buildOnce(ctx context.Context, job buildJob, forceRebuild bool) (PackageResult, error) {
+	key, err := buildKey(job)
+	if err != nil {
+		return PackageResult{}, fmt.Errorf("failed to compute build key: %w", err)
+	}
+	// a forced rebuild must not join an identical build that may be reusing a cached artifact
+	groupKey := key
+	if forceRebuild {
+		groupKey += ":force"
+	}
+	v, err, shared := buildGroup.Do(groupKey, func() (any, error) {
+		if !forceRebuild {
+			cached, err := lookupBuildCache(ctx, key)
+			if err != nil {
+				log.Printf("%s: %s", job.PackageType, err)
+			}
+			if cached != nil {
+				log.Printf("%s: reusing cached artifact %s", job.PackageType, cached.Key)
+				return *cached, nil
+			}
+		}
+		buildFn := func() (PackageResult, error) {
+			result, err := buildAndUpload(job)
+			if err != nil {
+				return PackageResult{}, err
+			}
+			if err := storeBuildCache(ctx, key, job.TeamName, result); err != nil {
+				log.Printf("%s: %s", job.PackageType, err)
+			}
+			return result, nil
+		}
+		locks := newBuildLockStore()
+		if locks == nil {
+			return buildFn()
+		}
+		return locks.build(ctx, key, job.TeamName, forceRebuild, buildFn)
+	})
+	if shared {
+		log.Printf("%s: shared build %s with a concurrent request", job.PackageType, key)
+	}
+	if err != nil {
+		return PackageResult{}, err
+	}
+	return v.(PackageResult), nil
+}
+
+// build runs buildFn while holding the lock for key. If another invocation holds the lock, build waits for it to
+// finish and returns its result instead, or takes over if the holder failed. With force set the lock is taken
+// regardless of its holder or a completed result so the package is always rebuilt. The lock is recorded for teamName
+// so it can be purged with the team.
+func (s *buildLockStore) build(ctx context.Context, key string, teamName string, force bool, buildFn func() (PackageResult, error)) (PackageResult, error) {
+	for {
+		acquired, err := s.acquire(ctx, key, teamName, force)
+		if err != nil {
+			return PackageResult{}, err
+		}
+		if acquired {
+			result, err := buildFn()
+			if err != nil {
+				if releaseErr := s.release(ctx, key); releaseErr != nil {
+					log.Printf("%s", releaseErr)
+				}
+				return PackageResult{}, err
+			}
+			if err := s.complete(ctx, key, result); err != nil {
+				log.Printf("%s", err)
+			}
+			return result, nil
+		}
+
+		result, found, err := s.wait(ctx, key)
+		if err != nil {
+			return PackageResult{}, err
+		}
+		if found {
+			log.Printf("reusing artifacts of concurrent build %s", key)
+			return result, nil
+		}
+		// the lock holder failed and released the lock, try to build ourselves
+	}
+}
+
+// acquire takes the lock for key, it reports false if another invocation holds it or already completed the build.
+// With force set the lock record is overwritten unconditionally.
+func (s *buildLockStore) acquire(ctx context.Context, key string, teamName string, force bool) (bool, error) {
+	now := time.Now()
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"build_key":    &types.AttributeValueMemberS{Value: key},
+			"team_name":    &types.AttributeValueMemberS{Value: teamName},
+			"status":       &types.AttributeValueMemberS{Value: buildLockStatusBuilding},
+			"locked_until": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(buildLockTimeout).Unix(), 10)},
+			"expires_at":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(buildLockTimeout).Unix(), 10)},
+		},
+		// completed builds are reused until their record expires, stale locks of killed invocations are taken over
+		ConditionExpression: aws.String("attribute_not_exists(build_key) OR expires_at < :now OR (#status = :building AND locked_until < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":building": &types.AttributeValueMemberS{Value: buildLockStatusBuilding},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	}
+	if force {
+		input.ConditionExpression = nil
+		input.ExpressionAttributeNames = nil
+		input.ExpressionAttributeValues = nil
+	}
+	_, err := s.client.PutItem(ctx, input)
+	if err == nil {
+		return true, nil
+	}
+	var condErr *types.ConditionalCheckFailedException
+	if errors.As(err, &condErr) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to acquire build lock: %w", err)
+}
+
+// wait polls the lock for key until the holder completes, releases it or its lock expires. found is false if the
+// lock was released or expired without a result.
+func (s *buildLockStore) wait(ctx context.Context, key string) (result PackageResult, found bool, err error) {
+	ticker := time.NewTicker(buildLockPollInterval)
+	defer ticker.Stop()
+	for {
+		out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.table),
+			Key:            s.key(key),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return PackageResult{}, false, fmt.Errorf("failed to get build lock: %w", err)
+		}
+		switch stringAttribute(out.Item, "status") {
+		case "":
+			return PackageResult{}, false, nil
+		case buildLockStatusBuilding:
+			// the holder was killed with its Lambda before finishing, report the lock as released so it's taken over
+			lockedUntil, _ := strconv.ParseInt(numberAttribute(out.Item, "locked_until"), 10, 64)
+			if lockedUntil < time.Now().Unix() {
+				return PackageResult{}, false, nil
+			}
+		case buildLockStatusCompleted:
+			if err := json.Unmarshal([]byte(stringAttribute(out.Item, "result")), &result); err != nil {
+				return PackageResult{}, false, fmt.Errorf("failed to parse build lock result: %w", err)
+			}
+			return result, true, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return PackageResult{}, false, fmt.Errorf("waiting for concurrent build: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// complete records the result of the build holding the lock for key so identical requests can reuse it.
+func (s *buildLockStore) complete(ctx context.Context, key string, result PackageResult) error {
+	buf, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal build result: %w", err)
+	}
+	_, err = s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              s.key(key),
+		UpdateExpression: aws.String("SET #status = :completed, #result = :result, expires_at = :expires_at"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+			"#result": "result",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed":  &types.AttributeValueMemberS{Value: buildLockStatusCompleted},
+			":result":     &types.AttributeValueMemberS{Value: string(buf)},
+			":expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(buildLockResultTTL).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete build lock: %w", err)
+	}
+	return nil
+}
+
+// release deletes the lock for key so a waiting request can build instead.
+func (s *buildLockStore) release(ctx context.Context, key string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.key(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release build lock: %w", err)
+	}
+	return nil
+}
+
+func (s *buildLockStore) key(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"build_key": &types.AttributeValueMemberS{Value: key},
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// buildCacheEntry records a successful build in the artifact store under build-cache/<build key>.json.
+type buildCacheEntry struct {
+	BuildKey  string        `json:"build_key"`
+	TeamName  string        `json:"team_name"`
+	Result    PackageResult `json:"result"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// buildCacheTTL returns how long built artifacts are reused for identical builds, configured with BUILD_CACHE_TTL.
+// Channels like "stable" resolve to newer agent versions over time, so cache entries have to expire.
+// Zero, the default, disables the cache.
+func buildCacheTTL() time.Duration {
+	v := os.Getenv("BUILD_CACHE_TTL")
+	if v == "" {
+		return 0
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid BUILD_CACHE_TTL %q, build cache disabled: %s", v, err)
+		return 0
+	}
+	return ttl
+}
+
+// buildCachePrefix is the key prefix of build cache entries in the artifact store.
+const buildCachePrefix = "build-cache/"
+
+func buildCacheKey(buildKey string) string {
+	return fmt.Sprintf("%s%s.json", buildCachePrefix, buildKey)
+}
+
+// lookupBuildCache returns the cached result of an identical build, or nil if there is none. Entries older than
+// the cache TTL, or whose artifact was deleted or changed since, are ignored.
+func lookupBuildCache(ctx context.Context, buildKey string) (*PackageResult, error) {
+	ttl := buildCacheTTL()
+	if ttl <= 0 {
+		return nil, nil
+	}
+	buf, err := artifactStore.GetObject(ctx, buildCacheKey(buildKey))
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get build cache entry: %w", err)
+	}
+	var entry buildCacheEntry
+	if err := json.Unmarshal(buf, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse build cache entry: %w", err)
+	}
+	if time.Since(entry.CreatedAt) > ttl {
+		return nil, nil
+	}
+
+	// make sure the cached artifact is still the one that was built
+	info, err := artifactStore.StatObject(ctx, entry.Result.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check cached artifact: %w", err)
+	}
+	if info == nil || info.SHA256 != entry.Result.SHA256 {
+		return nil, nil
+	}
+
+	result := entry.Result
+	result.Cached = true
+	return &result, nil
+}
+
+// storeBuildCache records the result of a successful build so identical builds can reuse it.
+func storeBuildCache(ctx context.Context, buildKey string, teamName string, result PackageResult) error {
+	if buildCacheTTL() <= 0 {
+		return nil
+	}
+	buf, err := json.Marshal(buildCacheEntry{BuildKey: buildKey, TeamName: teamName, Result: result, CreatedAt: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal build cache entry: %w", err)
+	}
+	if err := artifactStore.PutObject(ctx, buildCacheKey(buildKey), buf, "application/json", buildJob{}); err != nil {
+		return fmt.Errorf("failed to store build cache entry: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// PackageCapability reports whether the deployment builds a package type, and where.
+type PackageCapability struct {
+	Type      string `json:"type"`
+	Buildable bool   `json:"buildable"`
+	// Backend is the execution backend building the package type, "lambda" for the function itself.
+	Backend       string   `json:"backend"`
+	Architectures []string `json:"architectures"`
+	// MissingTools are the native tools the package type needs that aren't installed.
+	MissingTools []string `json:"missing_tools,omitempty"`
+	// Reason explains why the package type isn't buildable.
+	Reason string `json:"reason,omitempty"`
+}
+
+// CapabilitiesResponse lists the capability of every package type the packager knows.
+type CapabilitiesResponse struct {
+	SchemaVersion string              `json:"schema_version"`
+	PackageTypes  []PackageCapability `json:"package_types"`
+}
+
+// packageCapabilities is the capability of every supported package type, probed at startup by detectPackageTypes.
+var packageCapabilities map[string]PackageCapability
+
+// handleCapabilities reports which package types the deployment can build.
+func handleCapabilities(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	response := CapabilitiesResponse{SchemaVersion: currentSchemaVersion, PackageTypes: []PackageCapability{}}
+	for _, packageType := range supportedPackageTypes {
+		if capability, ok := packageCapabilities[packageType]; ok {
+			response.PackageTypes = append(response.PackageTypes, capability)
+		}
+	}
+	return respondJSON(http.StatusOK, response)
+}
+
+// checkPackageCapabilities rejects requests for package types the packager knows but this deployment can't build,
+// before anything is created or built.
+func checkPackageCapabilities(request CreateInstallersRequest) error {
+	var problems []string
+	for _, spec := range request.Packages {
+		if isSupportedPackageType(spec.Type) {
+			continue
+		}
+		reason := "not built by this deployment"
+		if capability, ok := packageCapabilities[spec.Type]; ok && capability.Reason != "" {
+			reason = capability.Reason
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", spec.Type, reason))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: can't build %s, see GET /capabilities", ErrUnprocessable, strings.Join(problems, "; "))
+	}
+	return nil
+}
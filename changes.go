@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// buildInputs are the inputs an installer is built from: the job, with the options it's packaged with, and the
+// agent components its channels resolve to. Installers built from the same inputs are equivalent.
+type buildInputs struct {
+	Job        buildJob    `json:"job"`
+	Components []component `json:"components"`
+}
+
+// inputsHash fingerprints the inputs of job, see buildInputs. The staging prefix is unique per request, it's left out.
+func inputsHash(ctx context.Context, job buildJob) (string, error) {
+	job.StagingPrefix = ""
+	components, err := resolveComponents(ctx, job.PackageType, job.Options)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(buildInputs{Job: job, Components: components})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// changeDetector finds the installers of a request that don't need building again, because the team's index points
+// at an installer built from the same inputs.
+type changeDetector struct {
+	index *teamIndex
+}
+
+// unchanged returns the inputs hash of job and, if the installer the team's index points at was built from the same
+// inputs and is still stored, its result. Failing to tell means the installer is built.
+func (d *changeDetector) unchanged(ctx context.Context, job buildJob) (string, *PackageResult) {
+	hash, err := inputsHash(ctx, job)
+	if err != nil {
+		log.Printf("%s: failed to resolve build inputs, building: %s", job.PackageType, err)
+		return "", nil
+	}
+	if d.index == nil {
+		d.index = &teamIndex{}
+		key, err := teamIndexKey(job)
+		if err == nil {
+			err = getIndex(ctx, key, d.index)
+		}
+		if err != nil {
+			log.Printf("failed to read the index of team %s, building: %s", job.TeamName, err)
+		}
+	}
+	entry, ok := d.index.Packages[indexEntryName(PackageResult{Package: job.PackageType, Architecture: job.Architecture})]
+	if !ok || entry.InputsHash != hash {
+		return hash, nil
+	}
+	info, err := artifactStore.StatObject(ctx, entry.Key)
+	if err != nil || info == nil || info.SHA256 != entry.SHA256 {
+		return hash, nil
+	}
+	log.Printf("%s: inputs unchanged since build %s, reusing %s", packageLabel(job.PackageType, job.Architecture), entry.BuildID, entry.Key)
+	return hash, &PackageResult{
+		Package:   job.PackageType,
+		Status:    packageStatusSucceeded,
+		Key:       entry.Key,
+		URL:       entry.URL,
+		SHA256:    entry.SHA256,
+		Size:      entry.Size,
+		Cached:    true,
+		Unchanged: true,
+	}
+}
+
+// unchangedSummary describes how many of a request's installers were reused unchanged, for logs.
+func unchangedSummary(results []PackageResult) string {
+	unchanged := 0
+	for _, result := range results {
+		if result.Unchanged {
+			unchanged++
+		}
+	}
+	return fmt.Sprintf("%d of %d installers unchanged", unchanged, len(results))
+}
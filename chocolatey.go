@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/go-resty/resty/v2"
+)
+
+// defaultChocolateyPackageID is the id Chocolatey packages are named after unless CHOCOLATEY_PACKAGE_ID is set,
+// suffixed with the team.
+const defaultChocolateyPackageID = "fleet-osquery"
+
+// chocolateyPushTimeout bounds a push to the Chocolatey feed, packages embed the MSI.
+const chocolateyPushTimeout = 5 * time.Minute
+
+// chocolateyFeed pushes Chocolatey packages to CHOCOLATEY_FEED_URL, it's nil unless that's set.
+var chocolateyFeed *nugetFeed
+
+// nugetFeed is a NuGet v2 feed packages are pushed to, e.g. a ProGet, Nexus or Artifactory Chocolatey repository.
+type nugetFeed struct {
+	url    string
+	apiKey string
+	client *resty.Client
+}
+
+// chocolateyEnabled reports whether MSIs are wrapped into Chocolatey packages, set ARTIFACT_CHOCOLATEY to enable it.
+func chocolateyEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ARTIFACT_CHOCOLATEY"))
+	return enabled
+}
+
+// chocolateyInstallScript installs the MSI embedded in the package's tools directory.
+var chocolateyInstallScript = template.Must(template.New("chocolateyInstall.ps1").Parse(`$ErrorActionPreference = 'Stop'
+$toolsDir = Split-Path -Parent $MyInvocation.MyCommand.Definition
+
+Install-ChocolateyInstallPackage -PackageName '{{.ID}}' -FileType 'msi' -SilentArgs '/quiet /norestart' -File (Join-Path $toolsDir '{{.File}}') -ValidExitCodes @(0, 3010, 1641)
+`))
+
+// chocolateyUninstallScript uninstalls the MSI by its product name.
+var chocolateyUninstallScript = template.Must(template.New("chocolateyUninstall.ps1").Parse(`$ErrorActionPreference = 'Stop'
+
+[array]$keys = Get-UninstallRegistryKey -SoftwareName 'Fleet osquery'
+foreach ($key in $keys) {
+  Uninstall-ChocolateyPackage -PackageName '{{.ID}}' -FileType 'msi' -SilentArgs "$($key.PSChildName) /quiet /norestart" -ValidExitCodes @(0, 3010, 1605, 1614, 1641)
+}
+`))
+
+type nuspec struct {
+	XMLName  xml.Name       `xml:"package"`
+	XMLNS    string         `xml:"xmlns,attr"`
+	Metadata nuspecMetadata `xml:"metadata"`
+}
+
+type nuspecMetadata struct {
+	ID          string `xml:"id"`
+	Version     string `xml:"version"`
+	Title       string `xml:"title"`
+	Authors     string `xml:"authors"`
+	ProjectURL  string `xml:"projectUrl"`
+	Tags        string `xml:"tags"`
+	Summary     string `xml:"summary"`
+	Description string `xml:"description"`
+}
+
+// chocolateyPackageID returns the id of a team's Chocolatey package, CHOCOLATEY_PACKAGE_ID suffixed with the team.
+func chocolateyPackageID(teamName string) string {
+	id := os.Getenv("CHOCOLATEY_PACKAGE_ID")
+	if id == "" {
+		id = defaultChocolateyPackageID
+	}
+	return teamPackageID(id, teamName)
+}
+
+// generateChocolateyPackage wraps an MSI named name into a Chocolatey .nupkg embedding the MSI, with install and
+// uninstall scripts running it silently.
+func generateChocolateyPackage(built artifact, job buildJob, name string, builtAt time.Time) ([]byte, error) {
+	id := chocolateyPackageID(job.TeamName)
+	spec, err := xml.MarshalIndent(nuspec{
+		XMLNS: "http://schemas.microsoft.com/packaging/2015/06/nuspec.xsd",
+		Metadata: nuspecMetadata{
+			ID:          id,
+			Version:     buildVersion(builtAt),
+			Title:       fmt.Sprintf("Fleet osquery (%s)", job.TeamName),
+			Authors:     "Fleet Device Management",
+			ProjectURL:  "https://fleetdm.com",
+			Tags:        "fleet osquery orbit",
+			Summary:     "Fleet's osquery agent",
+			Description: fmt.Sprintf("Fleet's osquery agent, enrolling to %s as team %s.", job.Options.FleetURL, job.TeamName),
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal nuspec: %w", err)
+	}
+	data := struct{ ID, File string }{ID: id, File: name}
+	var install, uninstall bytes.Buffer
+	if err := chocolateyInstallScript.Execute(&install, data); err != nil {
+		return nil, err
+	}
+	if err := chocolateyUninstallScript.Execute(&uninstall, data); err != nil {
+		return nil, err
+	}
+	msi, err := os.ReadFile(built.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	// a nupkg is an OPC package: a zip with the nuspec, content types and relationships
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"[Content_Types].xml", []byte(`<?xml version="1.0" encoding="utf-8"?><Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml" /><Default Extension="nuspec" ContentType="application/octet" /><Default Extension="ps1" ContentType="application/octet" /><Default Extension="msi" ContentType="application/octet" /></Types>`)},
+		{"_rels/.rels", []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?><Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Type="http://schemas.microsoft.com/packaging/2010/07/manifest" Target="/%s.nuspec" Id="R0" /></Relationships>`, id))},
+		{id + ".nuspec", append([]byte(xml.Header), spec...)},
+		{"tools/chocolateyInstall.ps1", install.Bytes()},
+		{"tools/chocolateyUninstall.ps1", uninstall.Bytes()},
+		{"tools/" + filepath.Base(name), msi},
+	} {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// newNugetFeed returns the feed at CHOCOLATEY_FEED_URL, the URL packages are pushed to, e.g.
+// https://push.chocolatey.org/api/v2/package, or nil if it isn't set. The feed's API key is read from the Secrets
+// Manager secret CHOCOLATEY_API_KEY_SECRET.
+func newNugetFeed(ctx context.Context, secrets *secretsmanager.Client) (*nugetFeed, error) {
+	url := os.Getenv("CHOCOLATEY_FEED_URL")
+	if url == "" {
+		return nil, nil
+	}
+	feed := &nugetFeed{url: url, client: resty.New().SetTimeout(chocolateyPushTimeout)}
+	if secretID := os.Getenv("CHOCOLATEY_API_KEY_SECRET"); secretID != "" {
+		apiKey, err := secretString(ctx, secrets, secretID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Chocolatey API key: %w", err)
+		}
+		feed.apiKey = apiKey
+	}
+	return feed, nil
+}
+
+// publishChocolateyPackages pushes the Chocolatey packages uploaded next to a request's MSIs to the feed, reading them
+// back from the artifact store so staged packages are pushed once they're published.
+func publishChocolateyPackages(ctx context.Context, results []PackageResult) error {
+	for _, result := range results {
+		if result.Status != packageStatusSucceeded {
+			continue
+		}
+		for _, sidecar := range result.Sidecars {
+			if sidecar.Kind != sidecarChocolatey {
+				continue
+			}
+			nupkg, err := artifactStore.GetObject(ctx, sidecar.Key)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", sidecar.Key, err)
+			}
+			if err := chocolateyFeed.push(ctx, filepath.Base(sidecar.Key), nupkg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// push pushes a package to the feed. A version the feed already has, e.g. a package reused from the build cache, is
+// left alone.
+func (f *nugetFeed) push(ctx context.Context, name string, nupkg []byte) error {
+	resp, err := f.client.R().
+		SetContext(ctx).
+		SetHeader("X-NuGet-ApiKey", f.apiKey).
+		SetFileReader("package", name, bytes.NewReader(nupkg)).
+		Put(f.url)
+	if err != nil {
+		return fmt.Errorf("failed to push %s to Chocolatey feed: %w", name, err)
+	}
+	switch {
+	case resp.StatusCode() == http.StatusConflict:
+		log.Printf("Chocolatey feed already has %s", name)
+	case resp.IsError():
+		return fmt.Errorf("failed to push %s to Chocolatey feed: %s: %s", name, resp.Status(), strings.TrimSpace(resp.String()))
+	default:
+		log.Printf("pushed %s to Chocolatey feed", name)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild/types"
+)
+
+// codeBuildBackend runs async jobs as builds of a CodeBuild project running the packager image.
+type codeBuildBackend struct {
+	client  *codebuild.Client
+	project string
+}
+
+// newCodeBuildBackend returns a backend starting builds of the CodeBuild project OFFLOAD_CODEBUILD_PROJECT, or nil
+// if it isn't set.
+func newCodeBuildBackend(client *codebuild.Client) *codeBuildBackend {
+	project := os.Getenv("OFFLOAD_CODEBUILD_PROJECT")
+	if project == "" {
+		return nil
+	}
+	return &codeBuildBackend{client: client, project: project}
+}
+
+func (b *codeBuildBackend) name() string {
+	return "codebuild"
+}
+
+func (b *codeBuildBackend) start(ctx context.Context, jobID string) (string, error) {
+	out, err := b.client.StartBuild(ctx, &codebuild.StartBuildInput{
+		ProjectName: aws.String(b.project),
+		EnvironmentVariablesOverride: []types.EnvironmentVariable{
+			{Name: aws.String(jobIDEnv), Value: aws.String(jobID), Type: types.EnvironmentVariableTypePlaintext},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if out.Build == nil {
+		return "", fmt.Errorf("CodeBuild project %s started no build", b.project)
+	}
+	return aws.ToString(out.Build.Id), nil
+}
+
+func (b *codeBuildBackend) failed(ctx context.Context, job *asyncJob) (bool, string, error) {
+	runID := job.RunID
+	out, err := b.client.BatchGetBuilds(ctx, &codebuild.BatchGetBuildsInput{Ids: []string{runID}})
+	if err != nil {
+		return false, "", err
+	}
+	if len(out.Builds) == 0 {
+		return true, fmt.Sprintf("CodeBuild build %s not found", runID), nil
+	}
+	switch status := out.Builds[0].BuildStatus; status {
+	case types.StatusTypeFailed, types.StatusTypeFault, types.StatusTypeTimedOut, types.StatusTypeStopped:
+		return true, fmt.Sprintf("CodeBuild build %s ended with %s", runID, status), nil
+	case types.StatusTypeSucceeded:
+		// the build records the job's response before it ends, handleGetJob reads the record again to tell whether
+		// it failed to
+		return true, fmt.Sprintf("CodeBuild build %s ended without recording the job's response", runID), nil
+	}
+	return false, "", nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// artifactDestination is an additional S3 bucket installers are replicated to, e.g. a regional bucket serving
+// downloads close to the hosts.
+type artifactDestination struct {
+	Bucket string `json:"bucket"`
+	// Region is the bucket's region, empty for the Lambda's own region.
+	Region string `json:"region,omitempty"`
+}
+
+// DestinationResult reports the upload of an installer to one of the request's additional destinations.
+type DestinationResult struct {
+	Bucket    string `json:"bucket"`
+	Region    string `json:"region,omitempty"`
+	Status    string `json:"status"`
+	Key       string `json:"key,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+}
+
+// defaultDestinations are the destinations of requests that don't list their own, set in main from
+// ARTIFACT_DESTINATIONS.
+var defaultDestinations []artifactDestination
+
+// parseArtifactDestinations parses a comma separated list of "bucket" or "bucket@region" entries.
+func parseArtifactDestinations(s string) ([]artifactDestination, error) {
+	var destinations []artifactDestination
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		bucket, region, _ := strings.Cut(entry, "@")
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid destination %q, must be bucket or bucket@region", entry)
+		}
+		destinations = append(destinations, artifactDestination{Bucket: bucket, Region: region})
+	}
+	return destinations, nil
+}
+
+// artifactDestinations returns the additional destinations of a request: the request's destinations, else
+// ARTIFACT_DESTINATIONS.
+func artifactDestinations(installersRequest CreateInstallersRequest) []artifactDestination {
+	if len(installersRequest.Destinations) > 0 {
+		return installersRequest.Destinations
+	}
+	return defaultDestinations
+}
+
+// uploadDestinations uploads a built installer to each of the job's additional destinations concurrently. A failed
+// destination doesn't fail the others, every destination's outcome is reported in its DestinationResult.
+func uploadDestinations(built artifact, job buildJob) []DestinationResult {
+	if len(job.Destinations) == 0 {
+		return nil
+	}
+	results := make([]DestinationResult, len(job.Destinations))
+	wg := sync.WaitGroup{}
+	for i, destination := range job.Destinations {
+		i, destination := i, destination
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store := &s3ArtifactStore{bucket: destination.Bucket, region: destination.Region}
+			result := DestinationResult{Bucket: destination.Bucket, Region: destination.Region}
+			key, err := uploadWithRetries(store, built, job)
+			if err != nil {
+				log.Printf("%s: destination %s: %s", job.PackageType, destination.Bucket, err)
+				class := classifyError(err)
+				result.Status = packageStatusFailed
+				result.Error = err.Error()
+				result.Code = class.code
+				result.Retryable = class.retryable
+			} else {
+				result.Status = packageStatusSucceeded
+				result.Key = key
+				result.URL = store.URL(key)
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// validateDestinations checks a request's destinations, they're only supported with the S3 artifact store.
+func validateDestinations(verr *validationError, destinations []artifactDestination) {
+	if len(destinations) == 0 {
+		return
+	}
+	if backend := os.Getenv("ARTIFACT_STORE"); backend != "" && backend != artifactStoreS3 {
+		verr.add("destinations", "are only supported with the %s artifact store", artifactStoreS3)
+		return
+	}
+	seen := map[string]bool{}
+	for i, destination := range destinations {
+		field := fmt.Sprintf("destinations[%d].bucket", i)
+		switch {
+		case strings.TrimSpace(destination.Bucket) == "":
+			verr.add(field, "must not be empty")
+		case destination.Bucket == appConfig.ArtifactBucket:
+			verr.add(field, "must not be the artifact bucket %q", destination.Bucket)
+		case seen[destination.Bucket]:
+			verr.add(field, "duplicate bucket %q", destination.Bucket)
+		}
+		seen[destination.Bucket] = true
+	}
+}
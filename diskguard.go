@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// buildDiskEstimates is roughly the /tmp space building an installer of each package type takes at its peak: the
+// downloaded agent components, the staged package root and the installer.
+var buildDiskEstimates = map[string]int64{
+	"deb": 150 << 20,
+	"rpm": 150 << 20,
+	"pkg": 250 << 20,
+	"msi": 300 << 20,
+}
+
+// buildDiskDir is where installers are built, the Lambda function's ephemeral storage.
+const buildDiskDir = "/tmp"
+
+// requestDiskEstimate returns the /tmp space building cells is estimated to take, concurrency at a time: the sum of
+// the largest estimates.
+func requestDiskEstimate(cells []buildCell, concurrency int) int64 {
+	estimates := make([]int64, 0, len(cells))
+	for _, cell := range cells {
+		estimates = append(estimates, buildDiskEstimates[cell.PackageType])
+	}
+	sort.Slice(estimates, func(i, j int) bool { return estimates[i] > estimates[j] })
+	var estimate int64
+	for i := 0; i < concurrency && i < len(estimates); i++ {
+		estimate += estimates[i]
+	}
+	return estimate
+}
+
+// availableDisk returns the free space of the file system holding dir.
+func availableDisk(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// planBuildConcurrency returns how many of cells to build at once: up to buildConcurrency, fewer if that many builds
+// are estimated to need more /tmp space than is free. It fails a request whose largest installer alone doesn't fit,
+// before anything is built, rather than letting the build run out of space halfway through with confusing errors.
+// The estimate, the free space and the concurrency are published as metrics. Set DISK_GUARD=false to build
+// regardless of the free space.
+func planBuildConcurrency(cells []buildCell) (int, error) {
+	concurrency, err := buildConcurrency()
+	if err != nil {
+		return 0, err
+	}
+	if concurrency > len(cells) {
+		concurrency = len(cells)
+	}
+	if os.Getenv("DISK_GUARD") == "false" || len(cells) == 0 {
+		return concurrency, nil
+	}
+	available, err := availableDisk(buildDiskDir)
+	if err != nil {
+		log.Printf("failed to check the free space of %s: %s", buildDiskDir, err)
+		return concurrency, nil
+	}
+	planned := concurrency
+	for planned > 1 && requestDiskEstimate(cells, planned) > available {
+		planned--
+	}
+	required := requestDiskEstimate(cells, planned)
+	insufficient := 0.0
+	if required > available {
+		insufficient = 1
+	}
+	emitMetrics(
+		metric{Name: "EphemeralStorageRequired", Unit: "Bytes", Value: float64(required)},
+		metric{Name: "EphemeralStorageAvailable", Unit: "Bytes", Value: float64(available)},
+		metric{Name: "InsufficientEphemeralStorage", Unit: "Count", Value: insufficient},
+		metric{Name: "BuildConcurrency", Unit: "Count", Value: float64(planned)},
+	)
+	if required > available {
+		return 0, fmt.Errorf("%w: building a single installer needs about %d MiB of %s, %d MiB are free: raise the function's ephemeral storage, or build it on an execution backend",
+			ErrInsufficientStorage, required>>20, buildDiskDir, available>>20)
+	}
+	if planned < concurrency {
+		log.Printf("building %d installers %d at a time, %d MiB of %s are free", len(cells), planned, available>>20, buildDiskDir)
+	}
+	return planned, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/cloudfront/sign"
+)
+
+// defaultDownloadURLTTL is how long signed download URLs are valid, override with CLOUDFRONT_URL_TTL or
+// PRESIGNED_URL_TTL.
+const defaultDownloadURLTTL = 24 * time.Hour
+
+// maxPresignedURLTTL is the longest an S3 presigned URL can be valid.
+const maxPresignedURLTTL = 7 * 24 * time.Hour
+
+// downloadSigner signs the download URLs of uploaded installers, it's nil unless CLOUDFRONT_DOMAIN is set.
+var downloadSigner *cloudFrontSigner
+
+// cloudFrontSigner signs URLs of installers served through a CloudFront distribution in front of the artifact
+// bucket, so downloads go through the CDN's custom domain and WAF instead of hitting the bucket directly.
+type cloudFrontSigner struct {
+	domain string
+	signer *sign.URLSigner
+	ttl    time.Duration
+}
+
+// newCloudFrontSigner returns the signer for the distribution CLOUDFRONT_DOMAIN, or nil if it isn't set. URLs are
+// signed with the key pair CLOUDFRONT_KEY_PAIR_ID, whose PEM encoded private key is read from the Secrets Manager
+// secret CLOUDFRONT_PRIVATE_KEY_SECRET.
+func newCloudFrontSigner(ctx context.Context, secrets *secretsmanager.Client) (*cloudFrontSigner, error) {
+	domain := os.Getenv("CLOUDFRONT_DOMAIN")
+	if domain == "" {
+		return nil, nil
+	}
+	keyPairID := os.Getenv("CLOUDFRONT_KEY_PAIR_ID")
+	secretID := os.Getenv("CLOUDFRONT_PRIVATE_KEY_SECRET")
+	if keyPairID == "" || secretID == "" {
+		return nil, errors.New("CLOUDFRONT_KEY_PAIR_ID and CLOUDFRONT_PRIVATE_KEY_SECRET must be set to sign CloudFront URLs")
+	}
+	ttl := defaultDownloadURLTTL
+	if v := os.Getenv("CLOUDFRONT_URL_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid CLOUDFRONT_URL_TTL %q, must be a positive duration", v)
+		}
+		ttl = d
+	}
+
+	out, err := secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretID)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CloudFront private key: %w", err)
+	}
+	privateKey, err := sign.LoadPEMPrivKey(strings.NewReader(aws.ToString(out.SecretString)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CloudFront private key: %w", err)
+	}
+	return &cloudFrontSigner{domain: domain, signer: sign.NewURLSigner(keyPairID, privateKey), ttl: ttl}, nil
+}
+
+// sign returns the signed URL of an object key on the distribution and when it expires.
+func (s *cloudFrontSigner) sign(key string) (string, time.Time, error) {
+	// keys can contain percent-encoded team names, escape them so CloudFront requests the literal key
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	expires := time.Now().Add(s.ttl)
+	signed, err := s.signer.Sign(fmt.Sprintf("https://%s/%s", s.domain, strings.Join(segments, "/")), expires)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expires, nil
+}
+
+// signDownloadURLs sets the download URL of every successful result. Results are signed when responding rather than
+// when built, so results reused from the build cache get fresh URLs too.
+func signDownloadURLs(results []PackageResult) {
+	if downloadSigner == nil {
+		return
+	}
+	for i := range results {
+		if results[i].Status != packageStatusSucceeded {
+			continue
+		}
+		signed, expires, err := downloadSigner.sign(results[i].Key)
+		if err != nil {
+			log.Printf("%s: failed to sign download URL: %s", results[i].Package, err)
+			continue
+		}
+		results[i].DownloadURL = signed
+		results[i].DownloadURLExpiresAt = &expires
+	}
+}
+
+// presignedURLTTL returns how long S3 presigned URLs are valid, PRESIGNED_URL_TTL or defaultDownloadURLTTL.
+func presignedURLTTL() (time.Duration, error) {
+	v := os.Getenv("PRESIGNED_URL_TTL")
+	if v == "" {
+		return defaultDownloadURLTTL, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > maxPresignedURLTTL {
+		return 0, fmt.Errorf("invalid PRESIGNED_URL_TTL %q, must be a positive duration of at most %s", v, maxPresignedURLTTL)
+	}
+	return d, nil
+}
+
+// downloadLink returns a URL a browser can download key from and when it expires: a signed CloudFront URL when
+// CLOUDFRONT_DOMAIN is set, else an S3 presigned URL. Other artifact stores can't hand out download links.
+func downloadLink(ctx context.Context, key string) (string, time.Time, error) {
+	if downloadSigner != nil {
+		return downloadSigner.sign(key)
+	}
+	store, ok := artifactStore.(*s3ArtifactStore)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("download links require CLOUDFRONT_DOMAIN or the %s artifact store", artifactStoreS3)
+	}
+	ttl, err := presignedURLTTL()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(ttl)
+	presigned, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(ttl), func(o *s3.PresignOptions) {
+		o.ClientOptions = append(o.ClientOptions, store.clientOptions()...)
+	})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to presign %s: %w", key, err)
+	}
+	return presigned.URL, expires, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/mail"
+	"os"
+	"path"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// maxNotificationEmails is the most recipients SES accepts for a single email.
+const maxNotificationEmails = 50
+
+var sesClient *sesv2.Client
+
+// emailSubjectTemplate, emailTextTemplate and emailHTMLTemplate render the completion email of a request.
+var (
+	emailSubjectTemplate = template.Must(template.New("subject").Parse(
+		`{{if .Failed}}Fleet installers for {{.TeamName}} failed{{else}}Fleet installers for {{.TeamName}} are ready{{end}}`))
+
+	emailTextTemplate = template.Must(template.New("text").Parse(`The installers for {{.TeamName}} were built.
+{{if .DownloadPage}}
+Download page: {{.DownloadPage}}
+{{end}}{{range .Installers}}
+{{.Package}}: {{if .Error}}failed: {{.Error}}{{else}}{{.File}}
+  SHA-256: {{.SHA256}}{{if .URL}}
+  Download: {{.URL}}{{if not .ExpiresAt.IsZero}} (expires {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}){{end}}{{end}}{{end}}
+{{end}}`))
+
+	emailHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(`<p>The installers for {{.TeamName}} were built.</p>
+{{if .DownloadPage}}<p><a href="{{.DownloadPage}}">Open the download page</a></p>
+{{end}}<table>
+{{range .Installers}}<tr><td>{{.Package}}</td><td>{{if .Error}}failed: {{.Error}}{{else}}{{.File}}<br><code>{{.SHA256}}</code>{{end}}</td><td>{{if .URL}}<a href="{{.URL}}">Download</a>{{if not .ExpiresAt.IsZero}}<br>expires {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}{{end}}{{end}}</td></tr>
+{{end}}</table>
+`))
+)
+
+// completionEmail holds the values completion emails are rendered with.
+type completionEmail struct {
+	TeamName     string
+	DownloadPage string
+	Failed       bool
+	Installers   []emailInstaller
+}
+
+// emailInstaller is a package listed in a completion email.
+type emailInstaller struct {
+	Package   string
+	File      string
+	SHA256    string
+	URL       string
+	ExpiresAt time.Time
+	Error     string
+}
+
+// validateNotificationEmails checks the request's notification_emails. Emails are sent from SES_FROM_ADDRESS, they
+// can't be requested unless it's set.
+func validateNotificationEmails(verr *validationError, emails []string) {
+	if len(emails) == 0 {
+		return
+	}
+	if os.Getenv("SES_FROM_ADDRESS") == "" {
+		verr.add("notification_emails", "email notifications are disabled, SES_FROM_ADDRESS isn't set")
+		return
+	}
+	if len(emails) > maxNotificationEmails {
+		verr.add("notification_emails", "must contain at most %d addresses", maxNotificationEmails)
+	}
+	for i, email := range emails {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			verr.add(fmt.Sprintf("notification_emails[%d]", i), "invalid email address %q", email)
+		}
+	}
+}
+
+// sendCompletionEmail emails the outcome of a request to its notification_emails: every installer's file name,
+// checksum and download link, or why it failed. Installers are linked with their signed download URL, else with a
+// link from downloadLink, and listed without a link when neither is available.
+func sendCompletionEmail(ctx context.Context, emails []string, response CreateInstallersResponse) error {
+	if len(emails) == 0 {
+		return nil
+	}
+	email := completionEmail{TeamName: response.TeamName, DownloadPage: response.DownloadPage}
+	for _, result := range response.Results {
+		installer := emailInstaller{Package: packageLabel(result.Package, result.Architecture)}
+		if result.Status != packageStatusSucceeded {
+			email.Failed = true
+			installer.Error = result.Error
+			email.Installers = append(email.Installers, installer)
+			continue
+		}
+		installer.File = path.Base(result.Key)
+		installer.SHA256 = result.SHA256
+		if result.DownloadURL != "" {
+			installer.URL = result.DownloadURL
+			installer.ExpiresAt = aws.ToTime(result.DownloadURLExpiresAt).UTC()
+		} else if link, expires, err := downloadLink(ctx, result.Key); err == nil {
+			installer.URL = link
+			installer.ExpiresAt = expires.UTC()
+		} else {
+			log.Printf("%s: no download link for the completion email: %s", result.Package, err)
+		}
+		email.Installers = append(email.Installers, installer)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := emailSubjectTemplate.Execute(&subject, email); err != nil {
+		return fmt.Errorf("failed to render completion email: %w", err)
+	}
+	if err := emailTextTemplate.Execute(&text, email); err != nil {
+		return fmt.Errorf("failed to render completion email: %w", err)
+	}
+	if err := emailHTMLTemplate.Execute(&html, email); err != nil {
+		return fmt.Errorf("failed to render completion email: %w", err)
+	}
+	_, err := sesClient.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(os.Getenv("SES_FROM_ADDRESS")),
+		Destination:      &types.Destination{ToAddresses: emails},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(subject.String()), Charset: aws.String("UTF-8")},
+				Body: &types.Body{
+					Text: &types.Content{Data: aws.String(text.String()), Charset: aws.String("UTF-8")},
+					Html: &types.Content{Data: aws.String(html.String()), Charset: aws.String("UTF-8")},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send completion email: %w", err)
+	}
+	log.Printf("emailed the installers of %s to %d recipients", response.TeamName, len(emails))
+	return nil
+}
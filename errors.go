@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Sentinel errors classifying why a request failed. Wrap them with %w so respondError can map the failure
+// to an HTTP status code and a stable, machine-readable error code.
+var (
+	// ErrBadRequest means the request is malformed or invalid, retrying it unchanged fails again.
+	ErrBadRequest = errors.New("bad request")
+	// ErrUnauthorized means the request lacks valid credentials for an admin route.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrNotFound means the resource a route addresses, e.g. an async job, doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrUnsupportedVersion means the caller asked for a response schema version the packager can't render.
+	ErrUnsupportedVersion = errors.New("unsupported schema version")
+	// ErrIdempotencyKeyReused means an idempotency key was sent again with a different request body.
+	ErrIdempotencyKeyReused = errors.New("idempotency key reused")
+	// ErrRequestInProgress means a request with the same idempotency key is still being processed.
+	ErrRequestInProgress = errors.New("request in progress")
+	// ErrUnprocessable means the request is well-formed but the Fleet server refused it, e.g. a conflicting team name.
+	ErrUnprocessable = errors.New("unprocessable request")
+	// ErrFleetUnavailable means the Fleet server could not be reached or responded with a 5xx status code.
+	ErrFleetUnavailable = errors.New("fleet server unavailable")
+	// ErrFleetUnauthorized means the Fleet server rejected the packager's API token, retrying fails until it's fixed.
+	ErrFleetUnauthorized = errors.New("fleet server unauthorized")
+	// ErrBuildFailed means one of the requested installers could not be packaged.
+	ErrBuildFailed = errors.New("build failed")
+	// ErrInsufficientStorage means the installers requested need more ephemeral storage than the function has free.
+	ErrInsufficientStorage = errors.New("insufficient storage")
+	// ErrUploadFailed means a built installer could not be uploaded to the artifact bucket.
+	ErrUploadFailed = errors.New("upload failed")
+	// ErrPublishAborted means an installer was staged but not published because another package of the request failed.
+	ErrPublishAborted = errors.New("publish aborted")
+	// ErrNotStarted means a build of a batch request wasn't started because the invocation was running out of time.
+	ErrNotStarted = errors.New("not started")
+)
+
+// errorClass describes how a class of errors is reported to the caller.
+type errorClass struct {
+	err        error
+	statusCode int
+	code       string
+	retryable  bool
+}
+
+// errorClasses maps the sentinel errors to HTTP status codes and stable error codes. The codes are part of the
+// API contract, don't rename them. Errors matching none of the classes are reported as internalErrorClass.
+var errorClasses = []errorClass{
+	{err: ErrBadRequest, statusCode: http.StatusBadRequest, code: "bad_request"},
+	{err: ErrUnauthorized, statusCode: http.StatusUnauthorized, code: "unauthorized"},
+	{err: ErrNotFound, statusCode: http.StatusNotFound, code: "not_found"},
+	{err: ErrUnsupportedVersion, statusCode: http.StatusNotAcceptable, code: "unsupported_version"},
+	{err: ErrRequestInProgress, statusCode: http.StatusConflict, code: "request_in_progress", retryable: true},
+	{err: ErrIdempotencyKeyReused, statusCode: http.StatusUnprocessableEntity, code: "idempotency_key_reused"},
+	{err: ErrUnprocessable, statusCode: http.StatusUnprocessableEntity, code: "unprocessable"},
+	{err: ErrFleetUnavailable, statusCode: http.StatusBadGateway, code: "fleet_unavailable", retryable: true},
+	{err: ErrFleetUnauthorized, statusCode: http.StatusBadGateway, code: "fleet_unauthorized"},
+	{err: ErrUploadFailed, statusCode: http.StatusBadGateway, code: "upload_failed", retryable: true},
+	{err: ErrPublishAborted, statusCode: http.StatusFailedDependency, code: "publish_aborted", retryable: true},
+	{err: ErrNotStarted, statusCode: http.StatusServiceUnavailable, code: "not_started", retryable: true},
+	{err: ErrInsufficientStorage, statusCode: http.StatusInsufficientStorage, code: "insufficient_storage"},
+	{err: ErrBuildFailed, statusCode: http.StatusInternalServerError, code: "build_failed", retryable: true},
+}
+
+var internalErrorClass = errorClass{statusCode: http.StatusInternalServerError, code: "internal_error"}
+
+// classifyError returns the first errorClass whose sentinel error is in err's chain.
+func classifyError(err error) errorClass {
+	for _, class := range errorClasses {
+		if errors.Is(err, class.err) {
+			return class
+		}
+	}
+	return internalErrorClass
+}
+
+// fleetStatusError returns the sentinel error matching a failed Fleet API response status code.
+// Server side failures and rate limiting are worth retrying, a rejected token needs the packager's configuration
+// fixed, anything else means Fleet rejected what we asked for.
+func fleetStatusError(statusCode int) error {
+	if statusCode == http.StatusUnauthorized {
+		return ErrFleetUnauthorized
+	}
+	if statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests {
+		return ErrFleetUnavailable
+	}
+	return ErrUnprocessable
+}
+
+// unknownFieldsError is returned by parseEventBody in strict mode when the request contains unrecognized fields.
+type unknownFieldsError struct {
+	Fields []string
+}
+
+func (e *unknownFieldsError) Error() string {
+	return fmt.Sprintf("unknown request fields: %s", strings.Join(e.Fields, ", "))
+}
+
+func (e *unknownFieldsError) Is(target error) bool {
+	return target == ErrBadRequest
+}
+
+// The 'respondError' function takes an error as input, classifies it and returns an API Gateway proxy response
+// with the matching status code and a JSON body holding the error message, its stable error code and whether
+// the request can be retried as is. Field level details from validation errors are included in the body.
+//
+// The error is logged rather than returned to the Lambda runtime, otherwise API Gateway would replace the
+// response with a generic 502.
+func respondError(err error) (events.APIGatewayProxyResponse, error) {
+	class := classifyError(err)
+	log.Printf("request failed with %d %s: %s", class.statusCode, class.code, err)
+
+	respBody := ErrorResponse{
+		SchemaVersion: currentSchemaVersion,
+		Error:         err.Error(),
+		Code:          class.code,
+		Retryable:     class.retryable,
+	}
+	var validationErr *validationError
+	if errors.As(err, &validationErr) {
+		respBody.Fields = validationErr.Fields
+	}
+	var unknownErr *unknownFieldsError
+	if errors.As(err, &unknownErr) {
+		respBody.UnknownFields = unknownErr.Fields
+	}
+
+	response, marshalErr := respondJSON(class.statusCode, respBody)
+	if marshalErr != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "{\"error\":\"failed to marshal err response\",\"code\":\"internal_error\"}"}, nil
+	}
+	return response, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+// fargateBackend runs async jobs as ECS tasks on Fargate, running the packager image. Unlike Lambda, tasks have no
+// time limit and up to 200 GiB of ephemeral storage, e.g. for msi and pkg builds with native tooling.
+type fargateBackend struct {
+	client         *ecs.Client
+	cluster        string
+	taskDefinition string
+	container      string
+	network        *types.NetworkConfiguration
+}
+
+// newFargateBackend returns a backend running the task definition FARGATE_TASK_DEFINITION on the cluster
+// FARGATE_CLUSTER, in the comma separated FARGATE_SUBNETS and FARGATE_SECURITY_GROUPS, or nil if
+// FARGATE_TASK_DEFINITION isn't set. FARGATE_CONTAINER names the packager's container, "packager" by default, and
+// FARGATE_ASSIGN_PUBLIC_IP gives tasks a public IP, for subnets without a NAT gateway.
+func newFargateBackend(client *ecs.Client) (*fargateBackend, error) {
+	taskDefinition := os.Getenv("FARGATE_TASK_DEFINITION")
+	if taskDefinition == "" {
+		return nil, nil
+	}
+	subnets := splitList(os.Getenv("FARGATE_SUBNETS"))
+	if len(subnets) == 0 {
+		return nil, errors.New("FARGATE_SUBNETS must be set with FARGATE_TASK_DEFINITION")
+	}
+	container := os.Getenv("FARGATE_CONTAINER")
+	if container == "" {
+		container = "packager"
+	}
+	assignPublicIP := types.AssignPublicIpDisabled
+	if public, _ := strconv.ParseBool(os.Getenv("FARGATE_ASSIGN_PUBLIC_IP")); public {
+		assignPublicIP = types.AssignPublicIpEnabled
+	}
+	return &fargateBackend{
+		client:         client,
+		cluster:        os.Getenv("FARGATE_CLUSTER"),
+		taskDefinition: taskDefinition,
+		container:      container,
+		network: &types.NetworkConfiguration{AwsvpcConfiguration: &types.AwsVpcConfiguration{
+			Subnets:        subnets,
+			SecurityGroups: splitList(os.Getenv("FARGATE_SECURITY_GROUPS")),
+			AssignPublicIp: assignPublicIP,
+		}},
+	}, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (b *fargateBackend) name() string {
+	return "fargate"
+}
+
+func (b *fargateBackend) start(ctx context.Context, jobID string) (string, error) {
+	out, err := b.client.RunTask(ctx, &ecs.RunTaskInput{
+		Cluster:              aws.String(b.cluster),
+		TaskDefinition:       aws.String(b.taskDefinition),
+		LaunchType:           types.LaunchTypeFargate,
+		Count:                aws.Int32(1),
+		NetworkConfiguration: b.network,
+		Overrides: &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{{
+			Name:        aws.String(b.container),
+			Environment: []types.KeyValuePair{{Name: aws.String(jobIDEnv), Value: aws.String(jobID)}},
+		}}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.Failures) > 0 {
+		return "", fmt.Errorf("failed to run task %s: %s", b.taskDefinition, aws.ToString(out.Failures[0].Reason))
+	}
+	if len(out.Tasks) == 0 {
+		return "", fmt.Errorf("task %s wasn't started", b.taskDefinition)
+	}
+	return aws.ToString(out.Tasks[0].TaskArn), nil
+}
+
+func (b *fargateBackend) failed(ctx context.Context, job *asyncJob) (bool, string, error) {
+	runID := job.RunID
+	out, err := b.client.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: aws.String(b.cluster), Tasks: []string{runID}})
+	if err != nil {
+		return false, "", err
+	}
+	if len(out.Tasks) == 0 {
+		return true, fmt.Sprintf("task %s not found", runID), nil
+	}
+	task := out.Tasks[0]
+	if aws.ToString(task.LastStatus) != "STOPPED" {
+		return false, "", nil
+	}
+	// the task records the job's response before it stops, handleGetJob reads the record again to tell whether it
+	// failed to
+	reason := fmt.Sprintf("task %s stopped without recording the job's response: %s", runID, aws.ToString(task.StoppedReason))
+	for _, container := range task.Containers {
+		if aws.ToString(container.Name) == b.container && container.ExitCode != nil && *container.ExitCode != 0 {
+			reason = fmt.Sprintf("task %s stopped, its container exited with %d: %s", runID, *container.ExitCode, aws.ToString(task.StoppedReason))
+		}
+	}
+	return true, reason, nil
+}
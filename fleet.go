@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/fleetdm/fleet/v4/server/service"
+)
+
+// globalTeamName is the name global installers, enrolling to no team, are keyed and indexed under.
+const globalTeamName = "_global"
+
+// isGlobalRequest reports whether a request builds global installers, asking for them or naming no team.
+func isGlobalRequest(installersRequest CreateInstallersRequest) bool {
+	return installersRequest.Global || (installersRequest.TeamName == "" && installersRequest.TeamID == 0)
+}
+
+// newFleetClient returns a client of the Fleet server at FLEET_URL, authenticated with fleetToken, or of the Fleet
+// instance ctx names, see withFleetInstance. The server's certificate is verified with FLEET_ROOT_CA if set, by the
+// mutual TLS proxy if there is one, see fleetAPIURL.
+func newFleetClient(ctx context.Context) (*service.Client, error) {
+	var fleetClient *service.Client
+	var err error
+	instance, named := contextFleetInstance(ctx)
+	switch {
+	case named:
+		fleetClient, err = service.NewClient(instance.URL, appConfig.FleetInsecureSkipVerify, appConfig.FleetRootCA, "")
+	case fleetMTLSProxyURL != "":
+		fleetClient, err = service.NewClient(fleetAPIURL(), false, "", "")
+	default:
+		fleetClient, err = service.NewClient(appConfig.FleetURL, appConfig.FleetInsecureSkipVerify, appConfig.FleetRootCA, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fleet server client: %w", err)
+	}
+	token, err := fleetToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fleetClient.SetToken(token)
+	return fleetClient, nil
+}
+
+// fleetRootCAPath is where the FLEET_ROOT_CA_SECRET bundle is written for the Fleet client, which reads it from a file.
+const fleetRootCAPath = "/tmp/fleet-root-ca.pem"
+
+// fleetRootCAFromSecret writes the CA bundle in the secret FLEET_ROOT_CA_SECRET, see envSecret, to disk and returns its
+// path, or FLEET_ROOT_CA if the secret isn't set.
+func fleetRootCAFromSecret(ctx context.Context) (string, error) {
+	if os.Getenv("FLEET_ROOT_CA_SECRET") == "" {
+		return appConfig.FleetRootCA, nil
+	}
+	bundle, err := envSecret(ctx, "FLEET_ROOT_CA")
+	if err != nil {
+		return "", err
+	}
+	if err := checkPEMCertificates([]byte(bundle)); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(fleetRootCAPath, []byte(bundle), 0644); err != nil {
+		return "", err
+	}
+	return fleetRootCAPath, nil
+}
+
+// statusCoder is implemented by the errors the Fleet client returns for unexpected response status codes.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// fleetClientError turns an error of a Fleet client call into a classified error, or nil if the call succeeded.
+// action describes the call for the error message, e.g. "create team". Errors without a response status code mean
+// the Fleet server couldn't be reached.
+func fleetClientError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var notFound service.NotFoundErr
+	var conflict service.ConflictErr
+	var status statusCoder
+	var statusCode int
+	switch {
+	case errors.As(err, &notFound):
+		statusCode = http.StatusNotFound
+	case errors.As(err, &conflict):
+		statusCode = http.StatusConflict
+	case errors.Is(err, service.ErrUnauthenticated):
+		statusCode = http.StatusUnauthorized
+	case errors.Is(err, service.ErrMissingLicense):
+		statusCode = http.StatusPaymentRequired
+	case errors.As(err, &status):
+		statusCode = status.StatusCode()
+	default:
+		return fmt.Errorf("%w: failed to %s: %w", ErrFleetUnavailable, action, err)
+	}
+	return fmt.Errorf("%w: failed to %s: %w", fleetStatusError(statusCode), action, err)
+}
+
+// defaultFleetRetryPolicy is used unless overridden with the FLEET_MAX_ATTEMPTS, FLEET_RETRY_BASE_DELAY and
+// FLEET_RETRY_MAX_DELAY env vars.
+var defaultFleetRetryPolicy = retryPolicy{MaxAttempts: 4, BaseDelay: 500 * time.Millisecond, MaxDelay: 10 * time.Second}
+
+// fleetRetryPolicy is the retry policy of Fleet API calls, set in main.
+var fleetRetryPolicy = defaultFleetRetryPolicy
+
+// fleetTimeouts bound Fleet API calls, so a hung Fleet server fails the request instead of using up the Lambda
+// function's duration.
+type fleetTimeouts struct {
+	// Call bounds every attempt of a call.
+	Call time.Duration
+	// Deadline bounds a call including its retries.
+	Deadline time.Duration
+}
+
+// defaultFleetTimeouts is used unless overridden with the FLEET_TIMEOUT and FLEET_DEADLINE env vars.
+var defaultFleetTimeouts = fleetTimeouts{Call: 30 * time.Second, Deadline: 2 * time.Minute}
+
+// fleetCallTimeouts are the timeouts of Fleet API calls, set in main.
+var fleetCallTimeouts = defaultFleetTimeouts
+
+func fleetTimeoutsFromEnv() (fleetTimeouts, error) {
+	timeouts := defaultFleetTimeouts
+	for name, d := range map[string]*time.Duration{
+		"FLEET_TIMEOUT":  &timeouts.Call,
+		"FLEET_DEADLINE": &timeouts.Deadline,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return fleetTimeouts{}, fmt.Errorf("invalid %s %q, must be a positive duration", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return timeouts, nil
+}
+
+// fleetCall runs a Fleet API call, retrying it with fleetRetryPolicy while the Fleet server is unavailable, e.g.
+// answers with a 502 or 503 during a deploy. Attempts and retries are bounded by fleetCallTimeouts and by ctx, the
+// Lambda function's deadline. A rejected token is refreshed with fleetTokenRefresher, if set, and the call run again,
+// except for named Fleet instances, which only have an API token.
+// action describes the call for the error message.
+func fleetCall(ctx context.Context, fleetClient *service.Client, action string, call func() error) error {
+	_, err := fleetCallResult(ctx, fleetClient, action, func() (struct{}, error) {
+		return struct{}{}, call()
+	})
+	return err
+}
+
+// fleetCallResult is fleetCall for calls returning a result.
+func fleetCallResult[T any](ctx context.Context, fleetClient *service.Client, action string, call func() (T, error)) (T, error) {
+	result, err := fleetCallAttempts(ctx, action, call)
+	if _, named := contextFleetInstance(ctx); errors.Is(err, ErrFleetUnauthorized) && fleetTokenRefresher != nil && !named {
+		log.Printf("fleet rejected the API token, logging in for a new one: %s", err)
+		if err := fleetTokenRefresher.refresh(ctx, fleetClient); err != nil {
+			return result, fmt.Errorf("%w: failed to refresh the Fleet API token: %w", ErrFleetUnauthorized, err)
+		}
+		return fleetCallAttempts(ctx, action, call)
+	}
+	return result, err
+}
+
+// fleetCallAttempts runs a Fleet API call with fleetRetryPolicy and fleetCallTimeouts.
+func fleetCallAttempts[T any](ctx context.Context, action string, call func() (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, fleetCallTimeouts.Deadline)
+	defer cancel()
+	var result T
+	err := fleetRetryPolicy.do(ctx, action, isFleetUnavailable, func() error {
+		r, err := callWithTimeout(ctx, fleetCallTimeouts.Call, call)
+		if err != nil {
+			return fleetClientError(action, err)
+		}
+		result = r
+		return nil
+	})
+	return result, err
+}
+
+// callWithTimeout runs call, giving up on it after timeout or once ctx is done. The Fleet client's calls can't be
+// cancelled, one given up on finishes in the background and its result is dropped.
+func callWithTimeout[T any](ctx context.Context, timeout time.Duration, call func() (T, error)) (T, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type outcome struct {
+		result T
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := call()
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		var zero T
+		return zero, fmt.Errorf("gave up waiting for the Fleet server: %w", ctx.Err())
+	}
+}
+
+// isFleetUnavailable reports whether a Fleet API call failed because the Fleet server couldn't serve it.
+func isFleetUnavailable(err error) bool {
+	return errors.Is(err, ErrFleetUnavailable)
+}
+
+// fleetStatusCodeError is an unexpected response status code of a Fleet API endpoint called with fleetDo.
+type fleetStatusCodeError struct {
+	statusCode int
+	body       string
+}
+
+func (e *fleetStatusCodeError) Error() string {
+	return fmt.Sprintf("unexpected api response status code: %d: %s", e.statusCode, e.body)
+}
+
+func (e *fleetStatusCodeError) StatusCode() int {
+	return e.statusCode
+}
+
+// fleetDo calls a Fleet API endpoint the Fleet client has no method for, authenticated like the client's calls. A
+// Retry-After header of a failed response delays the retry.
+func fleetDo(ctx context.Context, fleetClient *service.Client, action string, verb string, path string, params any) error {
+	return fleetCall(ctx, fleetClient, action, func() error {
+		resp, err := fleetClient.AuthenticatedDo(verb, path, "", params)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err = &fleetStatusCodeError{statusCode: resp.StatusCode, body: string(bytes.TrimSpace(body))}
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return &retryAfterError{err: err, delay: delay}
+		}
+		return err
+	})
+}
+
+// checkFleetServer fails fast, before anything is built, when the Fleet server is unreachable or rejects the API
+// token. The version endpoint is read since it requires authentication, unlike the health check.
+func checkFleetServer(ctx context.Context, fleetClient *service.Client) error {
+	return fleetDo(ctx, fleetClient, "check fleet server", http.MethodGet, "/api/latest/fleet/version", nil)
+}
+
+// errTeamExists is returned by createTeam when the Fleet server already has a team with the name.
+var errTeamExists = errors.New("team already exists")
+
+// createTeam creates a team on the Fleet server. The returned team includes its generated enroll secrets.
+func createTeam(ctx context.Context, fleetClient *service.Client, name string) (fleet.Team, error) {
+	team, err := fleetCallResult(ctx, fleetClient, "create team", func() (*fleet.Team, error) {
+		return fleetClient.CreateTeam(fleet.TeamPayload{Name: &name})
+	})
+	var conflict service.ConflictErr
+	if errors.As(err, &conflict) {
+		return fleet.Team{}, fmt.Errorf("%w: %s", errTeamExists, name)
+	}
+	if err != nil {
+		return fleet.Team{}, err
+	}
+	return *team, nil
+}
+
+// resolveTeam returns the team a request builds installers for, with its enroll secrets, and whether the request
+// created it. The team is created unless the request names it by ID, or asks to use an existing team and one with its
+// name exists. A team that turns out to exist when it's created is used as is. Global requests get no team, with ID 0
+// and the global enroll secrets.
+func resolveTeam(ctx context.Context, fleetClient *service.Client, installersRequest CreateInstallersRequest) (fleet.Team, bool, error) {
+	if installersRequest.Global {
+		secrets, err := globalEnrollSecrets(ctx, fleetClient)
+		if err != nil {
+			return fleet.Team{}, false, err
+		}
+		return fleet.Team{Name: globalTeamName, Secrets: secrets}, false, nil
+	}
+	if installersRequest.TeamID != 0 {
+		secrets, err := teamEnrollSecrets(ctx, fleetClient, installersRequest.TeamID)
+		if err != nil {
+			return fleet.Team{}, false, err
+		}
+		return fleet.Team{ID: installersRequest.TeamID, Name: installersRequest.TeamName, Secrets: secrets}, false, nil
+	}
+	if installersRequest.UseExistingTeam {
+		existing, err := existingTeam(ctx, fleetClient, installersRequest.TeamName)
+		if err != nil {
+			return fleet.Team{}, false, err
+		}
+		if existing != nil {
+			return *existing, false, nil
+		}
+	}
+	team, err := createTeam(ctx, fleetClient, installersRequest.TeamName)
+	if errors.Is(err, errTeamExists) {
+		// the team was created by an earlier attempt or another caller, retried requests build for it
+		existing, err := existingTeam(ctx, fleetClient, installersRequest.TeamName)
+		if err != nil {
+			return fleet.Team{}, false, err
+		}
+		if existing == nil {
+			return fleet.Team{}, false, fmt.Errorf("%w: team %s exists but can't be found", ErrUnprocessable, installersRequest.TeamName)
+		}
+		return *existing, false, nil
+	}
+	return team, err == nil, err
+}
+
+// existingTeam returns the team with a name and its enroll secrets, or nil if no such team exists.
+func existingTeam(ctx context.Context, fleetClient *service.Client, name string) (*fleet.Team, error) {
+	existing, err := findTeam(ctx, fleetClient, name)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	existing.Secrets, err = teamEnrollSecrets(ctx, fleetClient, existing.ID)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("using existing team %s (%d)", existing.Name, existing.ID)
+	return existing, nil
+}
+
+// getTeam returns the team with an ID.
+func getTeam(ctx context.Context, fleetClient *service.Client, teamID uint) (fleet.Team, error) {
+	team, err := fleetCallResult(ctx, fleetClient, "get team", func() (*fleet.Team, error) {
+		return fleetClient.GetTeam(teamID)
+	})
+	if err != nil {
+		return fleet.Team{}, err
+	}
+	return *team, nil
+}
+
+// teamNameByID returns the name of the team a request names by ID. A request naming the team both ways must name the
+// same team.
+func teamNameByID(ctx context.Context, fleetClient *service.Client, installersRequest CreateInstallersRequest) (string, error) {
+	team, err := getTeam(ctx, fleetClient, installersRequest.TeamID)
+	if err != nil {
+		return "", err
+	}
+	if installersRequest.TeamName != "" && installersRequest.TeamName != team.Name {
+		return "", fmt.Errorf("%w: team %d is named %q, not %q", ErrUnprocessable, team.ID, team.Name, installersRequest.TeamName)
+	}
+	if !isSafeTeamName(team.Name) {
+		return "", fmt.Errorf("%w: team %d's name %q can't be used in object keys", ErrUnprocessable, team.ID, team.Name)
+	}
+	return team.Name, nil
+}
+
+// teamEnrollSecrets returns a team's enroll secrets.
+func teamEnrollSecrets(ctx context.Context, fleetClient *service.Client, teamID uint) ([]*fleet.EnrollSecret, error) {
+	team, err := fleetCallResult(ctx, fleetClient, "get team enroll secrets", func() (*fleet.Team, error) {
+		return fleetClient.GetTeam(teamID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return team.Secrets, nil
+}
+
+// globalEnrollSecrets returns the global enroll secrets, which enroll hosts to no team.
+func globalEnrollSecrets(ctx context.Context, fleetClient *service.Client) ([]*fleet.EnrollSecret, error) {
+	spec, err := fleetCallResult(ctx, fleetClient, "get global enroll secrets", func() (*fleet.EnrollSecretSpec, error) {
+		return fleetClient.GetEnrollSecretSpec()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spec.Secrets, nil
+}
+
+// addTeamEnrollSecret adds secret to a team's enroll secrets, or to the global ones for no team. The enroll secret
+// spec replaces every secret the team had, so the secrets it already has are sent along and hosts enrolled with them
+// keep working.
+func addTeamEnrollSecret(ctx context.Context, fleetClient *service.Client, team fleet.Team, secret string) error {
+	spec := fleet.EnrollSecretSpec{}
+	for _, existing := range team.Secrets {
+		if existing.Secret == secret {
+			return nil
+		}
+		spec.Secrets = append(spec.Secrets, &fleet.EnrollSecret{Secret: existing.Secret})
+	}
+	spec.Secrets = append(spec.Secrets, &fleet.EnrollSecret{Secret: secret})
+	if team.ID == 0 {
+		return fleetCall(ctx, fleetClient, "add global enroll secret", func() error {
+			return fleetClient.ApplyEnrollSecretSpec(&spec, fleet.ApplySpecOptions{})
+		})
+	}
+	return setTeamEnrollSecrets(ctx, fleetClient, team.ID, spec)
+}
+
+// setTeamEnrollSecrets replaces a team's enroll secrets with spec's.
+func setTeamEnrollSecrets(ctx context.Context, fleetClient *service.Client, teamID uint, spec fleet.EnrollSecretSpec) error {
+	return fleetDo(ctx, fleetClient, "set team enroll secrets", http.MethodPatch, fmt.Sprintf("/api/latest/fleet/teams/%d/secrets", teamID), spec)
+}
+
+// deleteTeam deletes a team from the Fleet server.
+func deleteTeam(ctx context.Context, fleetClient *service.Client, teamID uint) error {
+	return fleetCall(ctx, fleetClient, "delete team", func() error {
+		return fleetClient.DeleteTeam(teamID)
+	})
+}
+
+// rollbackTeam handles a team a request created but built no installer for, which would be left empty: it's deleted
+// with FLEET_DELETE_EMPTY_TEAMS, and reported either way.
+func rollbackTeam(ctx context.Context, fleetClient *service.Client, team fleet.Team) *EmptyTeam {
+	empty := &EmptyTeam{ID: team.ID, Name: team.Name}
+	if enabled, _ := strconv.ParseBool(os.Getenv("FLEET_DELETE_EMPTY_TEAMS")); !enabled {
+		log.Printf("every build failed, left empty team %s (%d) behind", team.Name, team.ID)
+		return empty
+	}
+	if err := deleteTeam(ctx, fleetClient, team.ID); err != nil {
+		log.Printf("every build failed, failed to delete team %s (%d): %s", team.Name, team.ID, err)
+		return empty
+	}
+	log.Printf("every build failed, deleted team %s (%d)", team.Name, team.ID)
+	empty.Deleted = true
+	return empty
+}
+
+// findTeam looks up a team by its exact name, it returns nil if no such team exists.
+func findTeam(ctx context.Context, fleetClient *service.Client, name string) (*fleet.Team, error) {
+	teams, err := fleetCallResult(ctx, fleetClient, "list teams", func() ([]fleet.Team, error) {
+		return fleetClient.ListTeams(url.Values{"query": {name}}.Encode())
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the query parameter matches partial names, only an exact match is the team we're looking for
+	for _, team := range teams {
+		if team.Name == name {
+			team := team
+			return &team, nil
+		}
+	}
+	return nil, nil
+}
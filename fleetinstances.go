@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// fleetInstance is a named Fleet server requests can build installers for instead of FLEET_URL, e.g. the server of
+// another region.
+type fleetInstance struct {
+	// URL is the Fleet server the packager creates teams on, like FLEET_URL.
+	URL string `json:"url"`
+	// ServerURL is the Fleet server URL installers enroll to, like FLEET_SERVER_URL. It defaults to URL.
+	ServerURL string `json:"server_url"`
+	// TokenSecret references the secret holding the instance's API token, a Secrets Manager secret or an SSM
+	// parameter, see ssmParameterName.
+	TokenSecret string `json:"token_secret"`
+}
+
+// fleetInstancePattern matches the names of Fleet instances.
+var fleetInstancePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// fleetInstances are the named Fleet instances, set in main. Requests not naming one use FLEET_URL.
+var fleetInstances map[string]fleetInstance
+
+// loadFleetInstances reads the Fleet instances from the SSM parameter FLEET_INSTANCES_PARAMETER, a JSON object mapping
+// instance names to instances, e.g. {"eu": {"url": "https://fleet.eu.example.com", "token_secret": "ssm:/fleet/eu"}}.
+// It returns nil if the parameter isn't set.
+func loadFleetInstances(ctx context.Context, parameters *ssm.Client) (map[string]fleetInstance, error) {
+	name := os.Getenv("FLEET_INSTANCES_PARAMETER")
+	if name == "" {
+		return nil, nil
+	}
+	out, err := parameters.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parameter %s: %w", name, err)
+	}
+	if out.Parameter == nil {
+		return nil, fmt.Errorf("parameter %s has no value", name)
+	}
+	var instances map[string]fleetInstance
+	if err := json.Unmarshal([]byte(aws.ToString(out.Parameter.Value)), &instances); err != nil {
+		return nil, fmt.Errorf("parameter %s must be a JSON object of Fleet instances: %w", name, err)
+	}
+	for instanceName, instance := range instances {
+		if !fleetInstancePattern.MatchString(instanceName) {
+			return nil, fmt.Errorf("invalid Fleet instance name %q, must only contain lowercase letters, digits and '-'", instanceName)
+		}
+		for field, value := range map[string]string{"url": instance.URL, "server_url": instance.ServerURL} {
+			if value == "" && field == "server_url" {
+				continue
+			}
+			if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return nil, fmt.Errorf("Fleet instance %s: invalid %s %q, must be like https://fleet.example.com", instanceName, field, value)
+			}
+		}
+		if instance.TokenSecret == "" {
+			return nil, fmt.Errorf("Fleet instance %s: token_secret must be set", instanceName)
+		}
+		if instance.ServerURL == "" {
+			instance.ServerURL = instance.URL
+			instances[instanceName] = instance
+		}
+	}
+	return instances, nil
+}
+
+// fleetInstanceNames returns the names of the Fleet instances, sorted.
+func fleetInstanceNames() []string {
+	names := make([]string, 0, len(fleetInstances))
+	for name := range fleetInstances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fleetInstanceKey is the context key of the Fleet instance a request builds installers for.
+type fleetInstanceKey struct{}
+
+// withFleetInstance returns ctx for calls to the Fleet instance name, FLEET_URL if it's empty.
+func withFleetInstance(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, fleetInstanceKey{}, name)
+}
+
+// contextFleetInstance returns the Fleet instance ctx calls and whether it's a named one rather than FLEET_URL.
+func contextFleetInstance(ctx context.Context) (fleetInstance, bool) {
+	name, _ := ctx.Value(fleetInstanceKey{}).(string)
+	instance, ok := fleetInstances[name]
+	return instance, ok
+}
+
+// validateFleetInstance checks the Fleet instance a request names exists.
+func validateFleetInstance(verr *validationError, request CreateInstallersRequest) {
+	if request.FleetInstance == "" {
+		return
+	}
+	if _, ok := fleetInstances[request.FleetInstance]; !ok {
+		if len(fleetInstances) == 0 {
+			verr.add("fleet_instance", "no Fleet instances are configured")
+			return
+		}
+		verr.add("fleet_instance", "unknown Fleet instance %q, must be one of: %s", request.FleetInstance, strings.Join(fleetInstanceNames(), ", "))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/fleetdm/fleet/v4/server/service"
+)
+
+// fleetCredentials are the email and password of the Fleet user the packager logs in as when its API token is
+// rejected.
+type fleetCredentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// fleetLogin mints fresh Fleet API tokens by logging in with the credentials in a Secrets Manager secret. Tokens are
+// cached across warm invocations.
+type fleetLogin struct {
+	secrets  *secretsmanager.Client
+	secretID string
+
+	mu    sync.Mutex
+	token string
+}
+
+// fleetTokenRefresher refreshes rejected Fleet API tokens, nil if FLEET_LOGIN_SECRET isn't set.
+var fleetTokenRefresher *fleetLogin
+
+// newFleetLogin returns a fleetLogin reading the credentials from the Secrets Manager secret FLEET_LOGIN_SECRET, a JSON
+// object like {"email": "packager@example.com", "password": "..."}, or nil if it isn't set.
+func newFleetLogin(secrets *secretsmanager.Client) *fleetLogin {
+	secretID := os.Getenv("FLEET_LOGIN_SECRET")
+	if secretID == "" {
+		return nil
+	}
+	return &fleetLogin{secrets: secrets, secretID: secretID}
+}
+
+// fleetToken returns the token Fleet API calls are authenticated with: the last one minted, else
+// FLEET_API_ONLY_USER_TOKEN, see envSecret. Calls to a named Fleet instance use its token secret.
+func fleetToken(ctx context.Context) (string, error) {
+	if instance, named := contextFleetInstance(ctx); named {
+		return secretValues.get(ctx, instance.TokenSecret)
+	}
+	if l := fleetTokenRefresher; l != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.token != "" {
+			return l.token, nil
+		}
+	}
+	return envSecret(ctx, "FLEET_API_ONLY_USER_TOKEN")
+}
+
+// refresh logs in for a new token and authenticates fleetClient with it. The secret is read on every login, so a
+// rotated password is picked up without a cold start.
+func (l *fleetLogin) refresh(ctx context.Context, fleetClient *service.Client) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	value, err := secretString(ctx, l.secrets, l.secretID)
+	if err != nil {
+		return fmt.Errorf("failed to get Fleet login credentials: %w", err)
+	}
+	var credentials fleetCredentials
+	if err := json.Unmarshal([]byte(value), &credentials); err != nil || credentials.Email == "" || credentials.Password == "" {
+		return errors.New("FLEET_LOGIN_SECRET must be a JSON object with an email and a password")
+	}
+	token, err := fleetCallAttempts(ctx, "log in", func() (string, error) {
+		return fleetClient.Login(credentials.Email, credentials.Password)
+	})
+	if err != nil {
+		return err
+	}
+	l.token = token
+	fleetClient.SetToken(token)
+	log.Printf("logged in to Fleet as %s for a new API token", credentials.Email)
+	return nil
+}
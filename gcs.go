@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// gcsArtifactStore stores artifacts in a Google Cloud Storage bucket, authenticating with application default
+// credentials.
+type gcsArtifactStore struct {
+	client *storage.Client
+	bucket string
+}
+
+func newGCSArtifactStore(ctx context.Context, bucket string) (*gcsArtifactStore, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+	return &gcsArtifactStore{client: client, bucket: bucket}, nil
+}
+
+// PutArtifact uploads the installer with its CRC32C checksum, GCS rejects the upload if the received payload doesn't
+// match it. The job's KMS key is used as the Cloud KMS key name, S3 storage classes and tags don't apply.
+func (s *gcsArtifactStore) PutArtifact(ctx context.Context, key string, built artifact, job buildJob, name string) error {
+	f, err := os.Open(built.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	crc := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(crc, f); err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", built.Path, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w := s.client.Bucket(s.bucket).Object(key).NewWriter(ctx)
+	w.ContentType = artifactContentType(job.PackageType)
+	w.ContentDisposition = contentDisposition(name)
+	w.Metadata = map[string]string{"sha256": built.SHA256}
+	w.KMSKeyName = job.KMSKeyID
+	w.CRC32C = crc.Sum32()
+	w.SendCRC32C = true
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	if size := w.Attrs().Size; size != built.Size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrUploadFailed, key, size, built.Size)
+	}
+	return nil
+}
+
+func (s *gcsArtifactStore) PutObject(ctx context.Context, key string, body []byte, contentType string, job buildJob) error {
+	w := s.client.Bucket(s.bucket).Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.KMSKeyName = job.KMSKeyID
+	if _, err := w.Write(body); err != nil {
+		w.Close()
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	return nil
+}
+
+func (s *gcsArtifactStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.client.Bucket(s.bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, errObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s *gcsArtifactStore) StatObject(ctx context.Context, key string) (*objectInfo, error) {
+	attrs, err := s.client.Bucket(s.bucket).Object(key).Attrs(ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	return &objectInfo{Size: attrs.Size, SHA256: attrs.Metadata["sha256"]}, nil
+}
+
+func (s *gcsArtifactStore) CopyObject(ctx context.Context, src string, dst string, job buildJob) error {
+	bucket := s.client.Bucket(s.bucket)
+	copier := bucket.Object(dst).CopierFrom(bucket.Object(src))
+	copier.KMSKeyName = job.KMSKeyID
+	if _, err := copier.Run(ctx); err != nil {
+		return fmt.Errorf("%w: failed to copy %s to %s: %w", ErrUploadFailed, src, dst, err)
+	}
+	return nil
+}
+
+func (s *gcsArtifactStore) ListObjects(ctx context.Context, prefix string) ([]objectSummary, error) {
+	var objects []objectSummary
+	it := s.client.Bucket(s.bucket).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		objects = append(objects, objectSummary{Key: attrs.Name, LastModified: attrs.Updated})
+	}
+}
+
+func (s *gcsArtifactStore) DeleteObjects(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		err := s.client.Bucket(s.bucket).Object(key).Delete(ctx)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func (s *gcsArtifactStore) URL(key string) string {
+	return fmt.Sprintf("gs://%s/%s", s.bucket, key)
+}
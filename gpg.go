@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// packageSigner GPG signs deb and rpm packages after they're built and the metadata of the APT and YUM repositories,
+// it's nil unless GPG_SIGNING_KEY_SECRET is set.
+var packageSigner *gpgSigner
+
+// gpgSigner signs packages with debsigs and rpmsign using a private key imported into its own GnuPG home.
+type gpgSigner struct {
+	home        string
+	fingerprint string
+}
+
+// newGPGSigner returns the signer for the ASCII armored private key in the Secrets Manager secret
+// GPG_SIGNING_KEY_SECRET, or nil if it isn't set. A passphrase protected key's passphrase is read from the secret
+// GPG_SIGNING_KEY_PASSPHRASE_SECRET.
+func newGPGSigner(ctx context.Context, secrets *secretsmanager.Client) (*gpgSigner, error) {
+	secretID := os.Getenv("GPG_SIGNING_KEY_SECRET")
+	if secretID == "" {
+		return nil, nil
+	}
+	privateKey, err := secretString(ctx, secrets, secretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GPG signing key: %w", err)
+	}
+	home, err := os.MkdirTemp("", "gnupg")
+	if err != nil {
+		return nil, err
+	}
+	// the signing tools run gpg themselves, configure it to never prompt
+	conf := "batch\npinentry-mode loopback\n"
+	if passphraseID := os.Getenv("GPG_SIGNING_KEY_PASSPHRASE_SECRET"); passphraseID != "" {
+		passphrase, err := secretString(ctx, secrets, passphraseID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get GPG signing key passphrase: %w", err)
+		}
+		passphraseFile := filepath.Join(home, "passphrase")
+		if err := os.WriteFile(passphraseFile, []byte(passphrase), 0o600); err != nil {
+			return nil, err
+		}
+		conf += fmt.Sprintf("passphrase-file %s\n", passphraseFile)
+	}
+	if err := os.WriteFile(filepath.Join(home, "gpg.conf"), []byte(conf), 0o600); err != nil {
+		return nil, err
+	}
+
+	s := &gpgSigner{home: home}
+	if _, err := s.run(strings.NewReader(privateKey), "gpg", "--import"); err != nil {
+		return nil, fmt.Errorf("failed to import GPG signing key: %w", err)
+	}
+	out, err := s.run(nil, "gpg", "--with-colons", "--list-secret-keys")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list GPG signing keys: %w", err)
+	}
+	// the first fpr record follows the first secret key
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Split(line, ":"); len(fields) > 9 && fields[0] == "fpr" {
+			s.fingerprint = fields[9]
+			break
+		}
+	}
+	if s.fingerprint == "" {
+		return nil, errors.New("GPG_SIGNING_KEY_SECRET doesn't contain a private key")
+	}
+	return s, nil
+}
+
+// signPackage signs a built package in place: debs get a debsigs origin signature, rpms an rpmsign header signature.
+// Other package types are left alone.
+func (s *gpgSigner) signPackage(packageType string, path string) error {
+	var err error
+	switch packageType {
+	case "deb":
+		_, err = s.run(nil, "debsigs", "--sign=origin", "--default-key="+s.fingerprint, path)
+	case "rpm":
+		_, err = s.run(nil, "rpmsign", "--addsign", "--define", "_gpg_name "+s.fingerprint, "--define", "_gpg_path "+s.home, path)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to GPG sign %s: %w", packageType, err)
+	}
+	return nil
+}
+
+// clearSign returns message clear signed, e.g. an APT repository's InRelease.
+func (s *gpgSigner) clearSign(message []byte) ([]byte, error) {
+	out, err := s.run(strings.NewReader(string(message)), "gpg", "--local-user", s.fingerprint, "--digest-algo", "SHA256", "--clearsign")
+	if err != nil {
+		return nil, fmt.Errorf("failed to clear sign: %w", err)
+	}
+	return []byte(out), nil
+}
+
+// detachSign returns the ASCII armored detached signature of message, e.g. an APT repository's Release.gpg.
+func (s *gpgSigner) detachSign(message []byte) ([]byte, error) {
+	out, err := s.run(strings.NewReader(string(message)), "gpg", "--local-user", s.fingerprint, "--digest-algo", "SHA256", "--armor", "--detach-sign")
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return []byte(out), nil
+}
+
+// run runs a command with the signer's GnuPG home and returns its output.
+func (s *gpgSigner) run(stdin *strings.Reader, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+s.home)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// secretString returns the value of a Secrets Manager secret, or of an SSM parameter, see ssmParameterName.
+func secretString(ctx context.Context, secrets *secretsmanager.Client, secretID string) (string, error) {
+	if _, ok := ssmParameterName(secretID); ok && secretValues != nil {
+		return secretValues.read(ctx, secretID)
+	}
+	out, err := secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretID)})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.SecretString), nil
+}
+
+// secretBytes returns the value of a binary Secrets Manager secret, or of a string secret holding base64 encoded
+// binary data, e.g. a PKCS#12 certificate. SSM parameters hold base64 encoded binary data.
+func secretBytes(ctx context.Context, secrets *secretsmanager.Client, secretID string) ([]byte, error) {
+	var value string
+	if _, ok := ssmParameterName(secretID); ok && secretValues != nil {
+		var err error
+		if value, err = secretValues.read(ctx, secretID); err != nil {
+			return nil, err
+		}
+	} else {
+		out, err := secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretID)})
+		if err != nil {
+			return nil, err
+		}
+		if out.SecretBinary != nil {
+			return out.SecretBinary, nil
+		}
+		value = aws.ToString(out.SecretString)
+	}
+	buf, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret: %w", err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/go-resty/resty/v2"
+)
+
+// homebrewCaskFileName is the file name casks are uploaded as, rendered into the key template like an installer's
+// file name.
+const homebrewCaskFileName = "cask.rb"
+
+// defaultHomebrewCaskToken is the token casks are named after unless HOMEBREW_CASK_TOKEN is set, suffixed with the
+// team.
+const defaultHomebrewCaskToken = "fleet-osquery"
+
+// defaultGitHubAPIURL is the API taps are pushed through unless HOMEBREW_TAP_API_URL is set, e.g. for GitHub
+// Enterprise Server.
+const defaultGitHubAPIURL = "https://api.github.com"
+
+// homebrewTapTimeout bounds a request to the tap's API.
+const homebrewTapTimeout = 30 * time.Second
+
+// homebrewTap pushes casks to HOMEBREW_TAP_REPO, it's nil unless that's set.
+var homebrewTap *gitHubTap
+
+// gitHubTap is a Homebrew tap in a GitHub repository, casks are committed to its Casks directory through the
+// contents API.
+type gitHubTap struct {
+	repo   string
+	branch string
+	client *resty.Client
+}
+
+// homebrewCaskTemplate renders a team's cask. Values are quoted with rubyString.
+var homebrewCaskTemplate = template.Must(template.New("cask").Funcs(template.FuncMap{"ruby": rubyString}).Parse(`cask {{ruby .Token}} do
+  version {{ruby .Version}}
+  sha256 {{ruby .SHA256}}
+
+  url {{ruby .URL}}
+  name {{ruby .Name}}
+  desc "Fleet's osquery agent"
+  homepage "https://fleetdm.com"
+
+  pkg {{ruby .File}}
+
+  uninstall launchctl: {{ruby .Identifier}},
+            pkgutil:   {{ruby .PkgID}}
+end
+`))
+
+// homebrewCask holds the values casks are rendered with.
+type homebrewCask struct {
+	Token      string
+	Version    string
+	SHA256     string
+	URL        string
+	Name       string
+	File       string
+	Identifier string
+	PkgID      string
+}
+
+// homebrewCaskEnabled reports whether casks are generated for pkgs, set HOMEBREW_CASK to enable them.
+func homebrewCaskEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("HOMEBREW_CASK"))
+	return enabled
+}
+
+// homebrewCaskToken returns the token of a team's cask, HOMEBREW_CASK_TOKEN suffixed with the team.
+func homebrewCaskToken(teamName string) string {
+	token := os.Getenv("HOMEBREW_CASK_TOKEN")
+	if token == "" {
+		token = defaultHomebrewCaskToken
+	}
+	return teamPackageID(token, teamName)
+}
+
+// homebrewCaskKey returns the key of the cask of job's team, rendered from the key template with the cask's file
+// name.
+func homebrewCaskKey(job buildJob) (string, error) {
+	return objectKey(job.KeyTemplate, newObjectKeyData(job, homebrewCaskFileName, time.Now()))
+}
+
+// writeHomebrewCask renders the cask of the pkg a request uploaded, uploads it next to the installers and pushes it to
+// the tap if one is configured. The cask downloads the pkg from HOMEBREW_DOWNLOAD_BASE_URL, a public URL the artifact
+// bucket is served from, or else from a link of downloadLink, which expires. Nothing is written when no pkg was
+// uploaded.
+func writeHomebrewCask(ctx context.Context, teamName string, jobs []buildJob, results []PackageResult) error {
+	var pkg *PackageResult
+	var job buildJob
+	for i := range results {
+		if results[i].Package == "pkg" && results[i].Status == packageStatusSucceeded {
+			pkg, job = &results[i], jobs[i]
+		}
+	}
+	if pkg == nil {
+		return nil
+	}
+	link := os.Getenv("HOMEBREW_DOWNLOAD_BASE_URL")
+	if link != "" {
+		link = strings.TrimRight(link, "/") + "/" + pkg.Key
+	} else {
+		var err error
+		link, _, err = downloadLink(ctx, pkg.Key)
+		if err != nil {
+			return fmt.Errorf("failed to link pkg in the cask: %w", err)
+		}
+	}
+	token := homebrewCaskToken(teamName)
+	var buf bytes.Buffer
+	err := homebrewCaskTemplate.Execute(&buf, homebrewCask{
+		Token:      token,
+		Version:    buildVersion(time.Now()),
+		SHA256:     pkg.SHA256,
+		URL:        link,
+		Name:       fmt.Sprintf("Fleet osquery (%s)", teamName),
+		File:       path.Base(pkg.Key),
+		Identifier: job.Options.Identifier,
+		PkgID:      job.Options.Identifier + ".base.pkg",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render cask: %w", err)
+	}
+
+	key, err := homebrewCaskKey(jobs[0])
+	if err != nil {
+		return err
+	}
+	if err := artifactStore.PutObject(ctx, key, buf.Bytes(), "text/x-ruby", jobs[0]); err != nil {
+		return fmt.Errorf("failed to write cask: %w", err)
+	}
+	log.Printf("wrote cask %s", key)
+	if homebrewTap != nil {
+		return homebrewTap.push(ctx, token, buf.Bytes())
+	}
+	return nil
+}
+
+// rubyString returns s as a double quoted Ruby string literal, escaping interpolation.
+func rubyString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `#`, `\#`, "\n", `\n`).Replace(s) + `"`
+}
+
+// newGitHubTap returns the tap in the GitHub repository HOMEBREW_TAP_REPO, e.g. example/homebrew-fleet, or nil if it
+// isn't set. Casks are committed to HOMEBREW_TAP_BRANCH, the repository's default branch if it isn't set, with the
+// token in the Secrets Manager secret HOMEBREW_TAP_TOKEN_SECRET.
+func newGitHubTap(ctx context.Context, secrets *secretsmanager.Client) (*gitHubTap, error) {
+	repo := os.Getenv("HOMEBREW_TAP_REPO")
+	if repo == "" {
+		return nil, nil
+	}
+	if owner, name, ok := strings.Cut(repo, "/"); !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid HOMEBREW_TAP_REPO %q, must be owner/repo", repo)
+	}
+	secretID := os.Getenv("HOMEBREW_TAP_TOKEN_SECRET")
+	if secretID == "" {
+		return nil, fmt.Errorf("HOMEBREW_TAP_TOKEN_SECRET must be set to push to %s", repo)
+	}
+	token, err := secretString(ctx, secrets, secretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Homebrew tap token: %w", err)
+	}
+	apiURL := os.Getenv("HOMEBREW_TAP_API_URL")
+	if apiURL == "" {
+		apiURL = defaultGitHubAPIURL
+	}
+	client := resty.New().
+		SetBaseURL(strings.TrimRight(apiURL, "/")).
+		SetAuthToken(token).
+		SetHeader("Accept", "application/vnd.github+json").
+		SetTimeout(homebrewTapTimeout)
+	return &gitHubTap{repo: repo, branch: os.Getenv("HOMEBREW_TAP_BRANCH"), client: client}, nil
+}
+
+// push commits a cask to Casks/<token>.rb, replacing the previous revision.
+func (t *gitHubTap) push(ctx context.Context, token string, cask []byte) error {
+	file := fmt.Sprintf("/repos/%s/contents/Casks/%s.rb", t.repo, token)
+	// replacing a file takes the blob SHA of the revision being replaced
+	var current struct {
+		SHA string `json:"sha"`
+	}
+	req := t.client.R().SetContext(ctx).SetResult(&current)
+	if t.branch != "" {
+		req.SetQueryParam("ref", t.branch)
+	}
+	resp, err := req.Get(file)
+	if err != nil {
+		return fmt.Errorf("failed to read cask from tap %s: %w", t.repo, err)
+	}
+	if resp.IsError() && resp.StatusCode() != http.StatusNotFound {
+		return fmt.Errorf("failed to read cask from tap %s: %s", t.repo, resp.Status())
+	}
+
+	body := map[string]string{
+		"message": fmt.Sprintf("Update %s", token),
+		"content": base64.StdEncoding.EncodeToString(cask),
+	}
+	if current.SHA != "" {
+		body["sha"] = current.SHA
+	}
+	if t.branch != "" {
+		body["branch"] = t.branch
+	}
+	resp, err = t.client.R().SetContext(ctx).SetBody(body).Put(file)
+	if err != nil {
+		return fmt.Errorf("failed to push cask to tap %s: %w", t.repo, err)
+	}
+	if resp.IsError() {
+		return fmt.Errorf("failed to push cask to tap %s: %s: %s", t.repo, resp.Status(), strings.TrimSpace(resp.String()))
+	}
+	log.Printf("pushed cask %s to tap %s", token, t.repo)
+	return nil
+}
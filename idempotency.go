@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var dynamoClient *dynamodb.Client
+
+const (
+	idempotencyStatusInProgress = "in_progress"
+	idempotencyStatusCompleted  = "completed"
+
+	// idempotencyLockTimeout bounds how long an in progress record blocks retries. It matches the maximum Lambda
+	// duration, an invocation that is still running after that was killed and its key can be taken over.
+	idempotencyLockTimeout = 15 * time.Minute
+
+	// defaultIdempotencyTTL is how long completed responses are replayed for, override with IDEMPOTENCY_TTL.
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+// idempotencyStore records requests by idempotency key in the DynamoDB table named by IDEMPOTENCY_TABLE.
+// The table's partition key is the string attribute "idempotency_key", enable TTL on "expires_at" to expire records.
+type idempotencyStore struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+}
+
+// idempotencyRecord is a previously seen request.
+type idempotencyRecord struct {
+	Status      string
+	RequestHash string
+	StatusCode  int
+	Body        string
+}
+
+// newIdempotencyStore returns the configured idempotency store, or nil if IDEMPOTENCY_TABLE isn't set.
+func newIdempotencyStore() (*idempotencyStore, error) {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return nil, nil
+	}
+	ttl := defaultIdempotencyTTL
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_TTL %q: %w", v, err)
+		}
+		ttl = d
+	}
+	return &idempotencyStore{client: dynamoClient, table: table, ttl: ttl}, nil
+}
+
+// idempotencyKey returns the key of a request, the Idempotency-Key header takes precedence over the request field.
+func idempotencyKey(event events.APIGatewayProxyRequest, installersRequest CreateInstallersRequest) string {
+	if key := headerValue(event.Headers, "Idempotency-Key"); key != "" {
+		return key
+	}
+	return installersRequest.IdempotencyKey
+}
+
+// requestHash fingerprints a request so a reused idempotency key with a different payload can be detected.
+func requestHash(installersRequest CreateInstallersRequest) (string, error) {
+	installersRequest.IdempotencyKey = ""
+	buf, err := json.Marshal(installersRequest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// begin claims key for a new request of teamName. It returns nil if the key was claimed, and the existing record if
+// the key was already used, in which case the caller must not process the request again.
+func (s *idempotencyStore) begin(ctx context.Context, key string, hash string, teamName string) (*idempotencyRecord, error) {
+	for {
+		now := time.Now()
+		_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.table),
+			Item: map[string]types.AttributeValue{
+				"idempotency_key": &types.AttributeValueMemberS{Value: key},
+				"status":          &types.AttributeValueMemberS{Value: idempotencyStatusInProgress},
+				"request_hash":    &types.AttributeValueMemberS{Value: hash},
+				"team_name":       &types.AttributeValueMemberS{Value: teamName},
+				"locked_until":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(idempotencyLockTimeout).Unix(), 10)},
+				"expires_at":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(s.ttl).Unix(), 10)},
+			},
+			// take over in progress records whose invocation died without releasing them
+			ConditionExpression: aws.String("attribute_not_exists(idempotency_key) OR (#status = :in_progress AND locked_until < :now)"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":in_progress": &types.AttributeValueMemberS{Value: idempotencyStatusInProgress},
+				":now":         &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			},
+		})
+		if err == nil {
+			return nil, nil
+		}
+		var condErr *types.ConditionalCheckFailedException
+		if !errors.As(err, &condErr) {
+			return nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+		}
+
+		out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(s.table),
+			Key:            s.key(key),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get idempotency record: %w", err)
+		}
+		if len(out.Item) == 0 {
+			// the record was released or expired since the claim failed, retry the claim
+			continue
+		}
+		record := &idempotencyRecord{
+			Status:      stringAttribute(out.Item, "status"),
+			RequestHash: stringAttribute(out.Item, "request_hash"),
+			Body:        stringAttribute(out.Item, "body"),
+		}
+		record.StatusCode, _ = strconv.Atoi(numberAttribute(out.Item, "status_code"))
+		return record, nil
+	}
+}
+
+// complete stores the response of a claimed request so it's replayed for duplicates of the key.
+func (s *idempotencyStore) complete(ctx context.Context, key string, response events.APIGatewayProxyResponse) error {
+	_, err := s.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(s.table),
+		Key:              s.key(key),
+		UpdateExpression: aws.String("SET #status = :completed, status_code = :status_code, body = :body"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":completed":   &types.AttributeValueMemberS{Value: idempotencyStatusCompleted},
+			":status_code": &types.AttributeValueMemberN{Value: strconv.Itoa(response.StatusCode)},
+			":body":        &types.AttributeValueMemberS{Value: response.Body},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete idempotency record: %w", err)
+	}
+	return nil
+}
+
+// release deletes a claimed key so the request can be retried.
+func (s *idempotencyStore) release(ctx context.Context, key string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key:       s.key(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *idempotencyStore) key(key string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"idempotency_key": &types.AttributeValueMemberS{Value: key},
+	}
+}
+
+// runOnce runs a request with run, at most once per idempotency key if key is set and IDEMPOTENCY_TABLE is
+// configured. Dry runs are never recorded.
+func runOnce(ctx context.Context, key string, installersRequest CreateInstallersRequest, run func() (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	if key != "" && !installersRequest.DryRun {
+		store, err := newIdempotencyStore()
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		if store != nil {
+			return invokeIdempotent(ctx, store, key, installersRequest, run)
+		}
+	}
+	return run()
+}
+
+// invokeIdempotent runs a request with run at most once per idempotency key. Duplicates of a completed request get
+// the original response, duplicates of a request that is still running or that used a different payload are
+// rejected. Requests failing with a 5xx release their key so a retry runs again.
+func invokeIdempotent(ctx context.Context, store *idempotencyStore, key string, installersRequest CreateInstallersRequest, run func() (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	hash, err := requestHash(installersRequest)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to hash request: %w", err)
+	}
+	existing, err := store.begin(ctx, key, hash, installersRequest.TeamName)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if existing != nil {
+		switch {
+		case existing.RequestHash != hash:
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("%w: idempotency key %q was used for a different request", ErrIdempotencyKeyReused, key)
+		case existing.Status != idempotencyStatusCompleted:
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("%w: a request with idempotency key %q is still in progress", ErrRequestInProgress, key)
+		}
+		log.Printf("replaying response for idempotency key %q", key)
+		response, err := respondJSON(existing.StatusCode, json.RawMessage(existing.Body))
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		response.Headers["Idempotent-Replayed"] = "true"
+		return response, nil
+	}
+
+	response, err := run()
+	if err != nil {
+		response, _ = respondError(err)
+	}
+	if response.StatusCode >= http.StatusInternalServerError {
+		// server side failures may succeed when retried, don't pin them to the key
+		if err := store.release(ctx, key); err != nil {
+			log.Printf("%s", err)
+		}
+		return response, nil
+	}
+	if err := store.complete(ctx, key, response); err != nil {
+		log.Printf("%s", err)
+	}
+	return response, nil
+}
+
+func stringAttribute(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func numberAttribute(item map[string]types.AttributeValue, name string) string {
+	if v, ok := item[name].(*types.AttributeValueMemberN); ok {
+		return v.Value
+	}
+	return ""
+}
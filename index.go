@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// indexFileName is the file name team indexes are uploaded as, rendered into the key template like an
+	// installer's file name.
+	indexFileName = "index.json"
+
+	// globalIndexKey is the key of the index of every team's latest installers.
+	globalIndexKey = "index.json"
+
+	// indexLockKey is the build lock table key serializing index updates across invocations.
+	indexLockKey = "index"
+
+	// indexLockPollInterval is how often an index update waits for another invocation's update to finish.
+	indexLockPollInterval = 250 * time.Millisecond
+)
+
+// indexMu serializes index updates within this process.
+var indexMu sync.Mutex
+
+// indexEntry is the latest installer of a package type and architecture.
+type indexEntry struct {
+	Architecture string    `json:"architecture,omitempty"`
+	File         string    `json:"file"`
+	Key          string    `json:"key"`
+	URL          string    `json:"url"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	BuildID      string    `json:"build_id"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	// InputsHash fingerprints the inputs the installer was built from, see inputsHash.
+	InputsHash string `json:"inputs_hash,omitempty"`
+}
+
+// teamIndex points at the latest installer of each package type and architecture built for a team, see
+// indexEntryName.
+type teamIndex struct {
+	SchemaVersion string                `json:"schema_version"`
+	TeamName      string                `json:"team_name"`
+	Packages      map[string]indexEntry `json:"packages"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+}
+
+// globalIndex points at the latest installers of every team, keyed by globalIndexTeamKey.
+type globalIndex struct {
+	SchemaVersion string                     `json:"schema_version"`
+	Teams         map[string]globalIndexTeam `json:"teams"`
+	UpdatedAt     time.Time                  `json:"updated_at"`
+}
+
+// globalIndexTeam is a team's entry in the global index.
+type globalIndexTeam struct {
+	// TeamName is the team's name, entries written before it was recorded are keyed by it.
+	TeamName string `json:"team_name,omitempty"`
+	// Index is the URL of the team's index.
+	Index    string                `json:"index"`
+	Packages map[string]indexEntry `json:"packages"`
+	// FleetInstance is the Fleet instance the team is on, empty for FLEET_URL.
+	FleetInstance string `json:"fleet_instance,omitempty"`
+}
+
+// globalIndexTeamKey returns the key of a team's entry in the global index: the team name for FLEET_URL, and the
+// instance and team name otherwise, e.g. "eu/workstations", so teams of the same name on different instances don't
+// share an entry.
+func globalIndexTeamKey(instance string, teamName string) string {
+	if instance == "" {
+		return teamName
+	}
+	return instance + "/" + teamName
+}
+
+// teamName returns the name of the team of the global index entry at key.
+func (t globalIndexTeam) teamName(key string) string {
+	if t.TeamName != "" {
+		return t.TeamName
+	}
+	return key
+}
+
+// indexEntryName returns the name a result is indexed under: the package type for its default architecture, e.g.
+// "deb", and the package type and architecture otherwise, e.g. "deb-arm64".
+func indexEntryName(result PackageResult) string {
+	if packageLabel(result.Package, result.Architecture) == result.Package {
+		return result.Package
+	}
+	return result.Package + "-" + result.Architecture
+}
+
+// teamIndexKey returns the key of the index of job's team, rendered from the key template with the index's file name.
+func teamIndexKey(job buildJob) (string, error) {
+	return objectKey(job.KeyTemplate, newObjectKeyData(job, indexFileName, time.Now()))
+}
+
+// updateIndexes points the team index and the global index at the installers a request published. Both are updated
+// together while holding the index lock, so concurrent requests don't overwrite each other's entries, and an entry is
+// only replaced by a newer build. Entries are dated by when their request started, so a build that finishes after a
+// newer one doesn't replace it.
+func updateIndexes(ctx context.Context, teamName string, jobs []buildJob, results []PackageResult, startedAt time.Time) error {
+	now := time.Now().UTC()
+	entries := map[string]indexEntry{}
+	for _, result := range results {
+		if result.Status != packageStatusSucceeded {
+			continue
+		}
+		entries[indexEntryName(result)] = indexEntry{
+			Architecture: result.Architecture,
+			File:         path.Base(result.Key),
+			Key:          result.Key,
+			URL:          result.URL,
+			SHA256:       result.SHA256,
+			Size:         result.Size,
+			BuildID:      jobs[0].BuildID,
+			UpdatedAt:    startedAt.UTC(),
+			InputsHash:   result.InputsHash,
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	key, err := teamIndexKey(jobs[0])
+	if err != nil {
+		return err
+	}
+
+	return withIndexLock(ctx, func() error {
+		team := teamIndex{Packages: map[string]indexEntry{}}
+		if err := getIndex(ctx, key, &team); err != nil {
+			return err
+		}
+		global := globalIndex{Teams: map[string]globalIndexTeam{}}
+		if err := getIndex(ctx, globalIndexKey, &global); err != nil {
+			return err
+		}
+
+		team.SchemaVersion = currentSchemaVersion
+		team.TeamName = teamName
+		team.UpdatedAt = now
+		if team.Packages == nil {
+			team.Packages = map[string]indexEntry{}
+		}
+		mergeIndexEntries(team.Packages, entries)
+
+		global.SchemaVersion = currentSchemaVersion
+		global.UpdatedAt = now
+		if global.Teams == nil {
+			global.Teams = map[string]globalIndexTeam{}
+		}
+		globalKey := globalIndexTeamKey(jobs[0].FleetInstance, teamName)
+		globalTeam := global.Teams[globalKey]
+		globalTeam.TeamName = teamName
+		globalTeam.Index = artifactURL(key)
+		globalTeam.FleetInstance = jobs[0].FleetInstance
+		if globalTeam.Packages == nil {
+			globalTeam.Packages = map[string]indexEntry{}
+		}
+		mergeIndexEntries(globalTeam.Packages, entries)
+		global.Teams[globalKey] = globalTeam
+
+		// the global index is written last, it never points at a team index entry that wasn't written
+		if err := putIndex(ctx, key, team, jobs[0]); err != nil {
+			return err
+		}
+		if err := putIndex(ctx, globalIndexKey, global, jobs[0]); err != nil {
+			return err
+		}
+		log.Printf("updated indexes %s and %s", key, globalIndexKey)
+		return nil
+	})
+}
+
+// removeTeamFromGlobalIndex drops a purged team of a Fleet instance, FLEET_URL if it's empty, from the global index.
+func removeTeamFromGlobalIndex(ctx context.Context, instance string, teamName string) error {
+	return withIndexLock(ctx, func() error {
+		global := globalIndex{}
+		if err := getIndex(ctx, globalIndexKey, &global); err != nil {
+			return err
+		}
+		key := globalIndexTeamKey(instance, teamName)
+		if _, ok := global.Teams[key]; !ok {
+			return nil
+		}
+		delete(global.Teams, key)
+		global.UpdatedAt = time.Now().UTC()
+		return putIndex(ctx, globalIndexKey, global, buildJob{TeamName: teamName})
+	})
+}
+
+// mergeIndexEntries copies entries into packages, keeping existing entries that are newer.
+func mergeIndexEntries(packages map[string]indexEntry, entries map[string]indexEntry) {
+	for packageType, entry := range entries {
+		if existing, ok := packages[packageType]; ok && existing.UpdatedAt.After(entry.UpdatedAt) {
+			continue
+		}
+		packages[packageType] = entry
+	}
+}
+
+// getIndex reads the index at key into index, leaving it untouched if the index doesn't exist yet.
+func getIndex(ctx context.Context, key string, index any) error {
+	buf, err := artifactStore.GetObject(ctx, key)
+	if err != nil {
+		if errors.Is(err, errObjectNotFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to read index %s: %w", key, err)
+	}
+	if err := json.Unmarshal(buf, index); err != nil {
+		return fmt.Errorf("failed to parse index %s: %w", key, err)
+	}
+	return nil
+}
+
+// putIndex writes index to key.
+func putIndex(ctx context.Context, key string, index any, job buildJob) error {
+	buf, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal index %s: %w", key, err)
+	}
+	if err := artifactStore.PutObject(ctx, key, buf, "application/json", job); err != nil {
+		return fmt.Errorf("failed to write index %s: %w", key, err)
+	}
+	return nil
+}
+
+// withIndexLock runs fn while holding the index lock. Updates within this process are serialized with indexMu,
+// across invocations with a record in the build lock table when BUILD_LOCK_TABLE is set. The record doesn't belong to a
+// team, so purging a team never releases it.
+func withIndexLock(ctx context.Context, fn func() error) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	locks := newBuildLockStore()
+	if locks == nil {
+		return fn()
+	}
+	ticker := time.NewTicker(indexLockPollInterval)
+	defer ticker.Stop()
+	for {
+		acquired, err := locks.acquire(ctx, indexLockKey, "", false)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for index lock: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	defer func() {
+		if err := locks.release(ctx, indexLockKey); err != nil {
+			log.Printf("%s", err)
+		}
+	}()
+	return fn()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// intunewinEnabled reports whether MSIs are wrapped into .intunewin packages for Microsoft Intune, set
+// ARTIFACT_INTUNEWIN to enable it.
+func intunewinEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ARTIFACT_INTUNEWIN"))
+	return enabled
+}
+
+// intunewinDetection is the Detection.xml of a .intunewin package, which Intune reads the content's encryption keys
+// and the MSI's detection properties from.
+type intunewinDetection struct {
+	XMLName                xml.Name            `xml:"ApplicationInfo"`
+	ToolVersion            string              `xml:"ToolVersion,attr"`
+	Name                   string              `xml:"Name"`
+	UnencryptedContentSize int                 `xml:"UnencryptedContentSize"`
+	FileName               string              `xml:"FileName"`
+	SetupFile              string              `xml:"SetupFile"`
+	EncryptionInfo         intunewinEncryption `xml:"EncryptionInfo"`
+	MsiInfo                intunewinMsiInfo    `xml:"MsiInfo"`
+}
+
+type intunewinEncryption struct {
+	EncryptionKey        string `xml:"EncryptionKey"`
+	MacKey               string `xml:"MacKey"`
+	InitializationVector string `xml:"InitializationVector"`
+	Mac                  string `xml:"Mac"`
+	ProfileIdentifier    string `xml:"ProfileIdentifier"`
+	FileDigest           string `xml:"FileDigest"`
+	FileDigestAlgorithm  string `xml:"FileDigestAlgorithm"`
+}
+
+// intunewinMsiInfo are the MSI properties Intune prefills the app's MSI detection rule from.
+type intunewinMsiInfo struct {
+	MsiPublisher                  string `xml:"MsiPublisher"`
+	MsiProductCode                string `xml:"MsiProductCode"`
+	MsiProductVersion             string `xml:"MsiProductVersion"`
+	MsiPackageCode                string `xml:"MsiPackageCode"`
+	MsiUpgradeCode                string `xml:"MsiUpgradeCode"`
+	MsiExecutionContext           string `xml:"MsiExecutionContext"`
+	MsiRequiresLogon              bool   `xml:"MsiRequiresLogon"`
+	MsiRequiresReboot             bool   `xml:"MsiRequiresReboot"`
+	MsiIsMachineInstall           bool   `xml:"MsiIsMachineInstall"`
+	MsiIsUserInstall              bool   `xml:"MsiIsUserInstall"`
+	MsiIncludesServices           bool   `xml:"MsiIncludesServices"`
+	MsiIncludesODBCDataSource     bool   `xml:"MsiIncludesODBCDataSource"`
+	MsiContainsSystemRegistryKeys bool   `xml:"MsiContainsSystemRegistryKeys"`
+	MsiContainsSystemFolders      bool   `xml:"MsiContainsSystemFolders"`
+}
+
+// generateIntunewin wraps an MSI named name into a .intunewin package, the format of IntuneWinAppUtil: the MSI is
+// zipped, encrypted with AES-256-CBC and authenticated with HMAC-SHA256, then zipped again with a Detection.xml
+// holding the keys and the MSI's detection properties.
+func generateIntunewin(built artifact, name string) ([]byte, error) {
+	msiInfo, err := readMsiInfo(built.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MSI properties: %w", err)
+	}
+
+	var content bytes.Buffer
+	zw := zip.NewWriter(&content)
+	w, err := zw.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(built.Path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// the encrypted file is the HMAC of the IV and ciphertext, the IV and the ciphertext
+	key, macKey, iv := make([]byte, 32), make([]byte, 32), make([]byte, aes.BlockSize)
+	for _, b := range [][]byte{key, macKey, iv} {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	zipped := content.Bytes()
+	digest := sha256.Sum256(zipped)
+	padding := aes.BlockSize - len(zipped)%aes.BlockSize
+	plaintext := append(append([]byte{}, zipped...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(iv)
+	mac.Write(ciphertext)
+	sum := mac.Sum(nil)
+	encrypted := append(append(append([]byte{}, sum...), iv...), ciphertext...)
+
+	detection, err := xml.MarshalIndent(intunewinDetection{
+		ToolVersion:            "1.8.4.0",
+		Name:                   name,
+		UnencryptedContentSize: len(zipped),
+		FileName:               "IntunePackage.intunewin",
+		SetupFile:              name,
+		EncryptionInfo: intunewinEncryption{
+			EncryptionKey:        base64.StdEncoding.EncodeToString(key),
+			MacKey:               base64.StdEncoding.EncodeToString(macKey),
+			InitializationVector: base64.StdEncoding.EncodeToString(iv),
+			Mac:                  base64.StdEncoding.EncodeToString(sum),
+			ProfileIdentifier:    "ProfileVersion1",
+			FileDigest:           base64.StdEncoding.EncodeToString(digest[:]),
+			FileDigestAlgorithm:  "SHA256",
+		},
+		MsiInfo: msiInfo,
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal Detection.xml: %w", err)
+	}
+
+	var out bytes.Buffer
+	zw = zip.NewWriter(&out)
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"IntuneWinPackage/Contents/IntunePackage.intunewin", encrypted},
+		{"IntuneWinPackage/Metadata/Detection.xml", append([]byte(xml.Header), detection...)},
+	} {
+		// the encrypted content doesn't compress, IntuneWinAppUtil stores both files
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Store})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(file.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// readMsiInfo reads an MSI's detection properties with msiinfo: the Property table, the package code from the
+// summary information, and whether it installs services.
+func readMsiInfo(path string) (intunewinMsiInfo, error) {
+	properties, err := exec.Command("msiinfo", "export", path, "Property").Output()
+	if err != nil {
+		return intunewinMsiInfo{}, fmt.Errorf("msiinfo export: %w", err)
+	}
+	// exported tables are tab separated, after two header lines and the table name
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(properties))
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(strings.TrimRight(scanner.Text(), "\r"), "\t"); ok {
+			values[name] = value
+		}
+	}
+	info := intunewinMsiInfo{
+		MsiPublisher:        values["Manufacturer"],
+		MsiProductCode:      values["ProductCode"],
+		MsiProductVersion:   values["ProductVersion"],
+		MsiUpgradeCode:      values["UpgradeCode"],
+		MsiExecutionContext: "System",
+		MsiIsMachineInstall: values["ALLUSERS"] == "1",
+		MsiIsUserInstall:    values["ALLUSERS"] != "1",
+	}
+	if info.MsiProductCode == "" {
+		return intunewinMsiInfo{}, fmt.Errorf("%s has no ProductCode", path)
+	}
+
+	suminfo, err := exec.Command("msiinfo", "suminfo", path).Output()
+	if err != nil {
+		return intunewinMsiInfo{}, fmt.Errorf("msiinfo suminfo: %w", err)
+	}
+	scanner = bufio.NewScanner(bytes.NewReader(suminfo))
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(scanner.Text(), ":"); ok && strings.HasPrefix(name, "Revision number") {
+			info.MsiPackageCode = strings.TrimSpace(value)
+		}
+	}
+	tables, err := exec.Command("msiinfo", "tables", path).Output()
+	if err != nil {
+		return intunewinMsiInfo{}, fmt.Errorf("msiinfo tables: %w", err)
+	}
+	for _, table := range strings.Fields(string(tables)) {
+		switch table {
+		case "ServiceInstall":
+			info.MsiIncludesServices = true
+		case "ODBCDataSource":
+			info.MsiIncludesODBCDataSource = true
+		}
+	}
+	return info, nil
+}
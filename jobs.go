@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	jobStatusQueued    = "queued"
+	jobStatusRunning   = "running"
+	jobStatusSucceeded = "succeeded"
+	jobStatusFailed    = "failed"
+
+	// jobsPrefix is the key prefix of async job records in the artifact store.
+	jobsPrefix = "jobs/"
+
+	// defaultOffloadMinPackages is how many installers a request builds before it's offloaded, unless
+	// OFFLOAD_MIN_PACKAGES is set.
+	defaultOffloadMinPackages = 8
+
+	// jobIDEnv is the env var execution backends start the packager with, naming the job it runs, see runAsyncJob.
+	jobIDEnv = "PACKAGER_JOB_ID"
+
+	// lambdaBackend is the name of the Lambda function itself as an execution backend.
+	lambdaBackend = "lambda"
+)
+
+// asyncJob is a request built outside of the Lambda function by an executionBackend, recorded under
+// jobs/<id>.json in the artifact store. The record carries the request, with its enroll secret, for the builder.
+type asyncJob struct {
+	ID       string                  `json:"id"`
+	Status   string                  `json:"status"`
+	Builder  string                  `json:"builder"`
+	RunID    string                  `json:"run_id"`
+	TeamName string                  `json:"team_name"`
+	Request  CreateInstallersRequest `json:"request"`
+	// IdempotencyKey is the key the job was offloaded under, from the Idempotency-Key header or the request. The
+	// job's build is claimed under it suffixed with "/run", see runAsyncJob.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// StatusCode and Response are the response the request got once it completed.
+	StatusCode  int             `json:"status_code,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	SubmittedAt time.Time       `json:"submitted_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// JobResponse reports an async job, without its request.
+type JobResponse struct {
+	SchemaVersion string          `json:"schema_version"`
+	ID            string          `json:"id"`
+	Status        string          `json:"status"`
+	Builder       string          `json:"builder"`
+	RunID         string          `json:"run_id"`
+	TeamName      string          `json:"team_name"`
+	StatusCode    int             `json:"status_code,omitempty"`
+	Response      json.RawMessage `json:"response,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	SubmittedAt   time.Time       `json:"submitted_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// executionBackend runs async jobs on compute without Lambda's time and disk limits. It runs the packager image with
+// PACKAGER_JOB_ID set, see runAsyncJob.
+type executionBackend interface {
+	// name identifies the backend in job records and config, e.g. "codebuild".
+	name() string
+	// start starts running the job and returns the builder's ID of the run.
+	start(ctx context.Context, jobID string) (string, error)
+	// failed reports whether the run of a job ended without completing it, e.g. it was stopped or timed out, and why.
+	failed(ctx context.Context, job *asyncJob) (bool, string, error)
+}
+
+// executionBackends are the configured execution backends by name, set in main.
+var executionBackends = map[string]executionBackend{}
+
+// offloadBackend builds the requests too large for the Lambda function, nil if none is configured, see
+// loadExecutionBackends.
+var offloadBackend executionBackend
+
+// packageBackends maps the package types built by another backend than the Lambda function to the backend's name,
+// see loadExecutionBackends.
+var packageBackends map[string]string
+
+// loadExecutionBackends registers backends and reads which of them builds what: OFFLOAD_BACKEND names the backend
+// requests too large for the Lambda function are offloaded to, the only backend if unset. PACKAGE_BACKENDS maps
+// package types to the backend that builds them, e.g. "msi=fargate,pkg=fargate", the others are built by the Lambda
+// function.
+func loadExecutionBackends(backends ...executionBackend) error {
+	for _, backend := range backends {
+		executionBackends[backend.name()] = backend
+	}
+	switch name := os.Getenv("OFFLOAD_BACKEND"); {
+	case name != "":
+		backend, ok := executionBackends[name]
+		if !ok {
+			return fmt.Errorf("OFFLOAD_BACKEND %q isn't a configured execution backend", name)
+		}
+		offloadBackend = backend
+	case len(executionBackends) == 1:
+		for _, backend := range executionBackends {
+			offloadBackend = backend
+		}
+	}
+	packageBackends = map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("PACKAGE_BACKENDS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		packageType, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		switch {
+		case !ok:
+			return fmt.Errorf("invalid PACKAGE_BACKENDS entry %q, must be like msi=fargate", pair)
+		case !isSupported(supportedPackageTypes, packageType):
+			return fmt.Errorf("PACKAGE_BACKENDS: unsupported package type %q", packageType)
+		case name == lambdaBackend:
+			continue
+		case executionBackends[name] == nil:
+			return fmt.Errorf("PACKAGE_BACKENDS: %q isn't a configured execution backend", name)
+		}
+		packageBackends[packageType] = name
+	}
+	return nil
+}
+
+// offloadMinPackages returns how many installers a request builds before it's offloaded to offloadBuilder,
+// OFFLOAD_MIN_PACKAGES or defaultOffloadMinPackages.
+func offloadMinPackages() (int, error) {
+	v := os.Getenv("OFFLOAD_MIN_PACKAGES")
+	if v == "" {
+		return defaultOffloadMinPackages, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid OFFLOAD_MIN_PACKAGES %q, must be a positive number", v)
+	}
+	return n, nil
+}
+
+// shouldOffload reports whether a request builds too many installers to build within the Lambda function.
+func shouldOffload(installersRequest CreateInstallersRequest) bool {
+	if offloadBackend == nil || installersRequest.DryRun || os.Getenv(jobIDEnv) != "" {
+		return false
+	}
+	threshold, _ := offloadMinPackages()
+	return len(requestCells(installersRequest)) >= threshold
+}
+
+// jobKey returns the artifact store key of the record of job id.
+func jobKey(id string) string {
+	return jobsPrefix + id + ".json"
+}
+
+func getJob(ctx context.Context, id string) (*asyncJob, error) {
+	buf, err := artifactStore.GetObject(ctx, jobKey(id))
+	if errors.Is(err, errObjectNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job %s: %w", id, err)
+	}
+	var job asyncJob
+	if err := json.Unmarshal(buf, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse job %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// putJob stores the record of job, encrypted with the KMS key of the job's request like its installers since it
+// carries the enroll secret.
+func putJob(ctx context.Context, job *asyncJob) error {
+	job.UpdatedAt = time.Now().UTC()
+	buf, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal job %s: %w", job.ID, err)
+	}
+	if err := artifactStore.PutObject(ctx, jobKey(job.ID), buf, "application/json", buildJob{TeamName: job.TeamName, KMSKeyID: kmsKeyID(job.Request)}); err != nil {
+		return fmt.Errorf("failed to store job %s: %w", job.ID, err)
+	}
+	return nil
+}
+
+// splitByBackend splits a request by the backend building its package types, see packageBackends. It returns the
+// request for the Lambda function's package types, nil if there are none, and one per other backend. Requests are
+// never split while running a job. The parts keep the request's idempotency key, dispatch claims each remote part
+// under its own key.
+func splitByBackend(installersRequest CreateInstallersRequest) (*CreateInstallersRequest, map[string]CreateInstallersRequest) {
+	if len(packageBackends) == 0 || installersRequest.DryRun || os.Getenv(jobIDEnv) != "" {
+		return &installersRequest, nil
+	}
+	packages := map[string][]packageSpec{}
+	for _, spec := range installersRequest.Packages {
+		backend, ok := packageBackends[spec.Type]
+		if !ok {
+			backend = lambdaBackend
+		}
+		packages[backend] = append(packages[backend], spec)
+	}
+	var local *CreateInstallersRequest
+	remote := map[string]CreateInstallersRequest{}
+	for backend, specs := range packages {
+		part := installersRequest
+		part.Packages = specs
+		if backend == lambdaBackend {
+			local = &part
+			continue
+		}
+		remote[backend] = part
+	}
+	return local, remote
+}
+
+// offload records a request as an async job and starts it on backend. The job's ID is the invocation's build ID,
+// suffixed with the backend's name when a request is split across backends. key is the idempotency key the job is
+// offloaded under, if any.
+func offload(ctx context.Context, installersRequest CreateInstallersRequest, backend executionBackend, id string, key string) (*asyncJob, error) {
+	now := time.Now().UTC()
+	job := &asyncJob{
+		ID:             id,
+		Status:         jobStatusQueued,
+		Builder:        backend.name(),
+		TeamName:       installersRequest.TeamName,
+		Request:        installersRequest,
+		IdempotencyKey: key,
+		SubmittedAt:    now,
+	}
+	if err := putJob(ctx, job); err != nil {
+		return nil, err
+	}
+	runID, err := backend.start(ctx, job.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start job %s on %s: %w", job.ID, job.Builder, err)
+	}
+	job.RunID = runID
+	if err := putJob(ctx, job); err != nil {
+		return nil, err
+	}
+	log.Printf("offloaded the %d installers of team %s to %s as job %s, run %s", len(requestCells(installersRequest)), job.TeamName, job.Builder, job.ID, runID)
+	return job, nil
+}
+
+// respondJob responds with a 202 and a job, whose status is polled at /jobs/{job_id}.
+func respondJob(job *asyncJob, err error) (events.APIGatewayProxyResponse, error) {
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	response, err := respondJSON(http.StatusAccepted, job.response())
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, err
+	}
+	response.Headers["Location"] = "/jobs/" + job.ID
+	return response, nil
+}
+
+// dispatch runs a request on the backends building it: all of it on offloadBackend if it's too large for the Lambda
+// function, else every package type on its backend, see splitByBackend. Requests built by a single other backend are
+// answered with its job, the jobs of a split request are started first and reported in the Lambda function's
+// response. key is the request's idempotency key, which the caller already claimed. The remote parts of a split
+// request are also claimed under the key suffixed with their backend's name, so retrying a request whose Lambda
+// function part failed reports their first jobs instead of starting them again.
+func dispatch(ctx context.Context, key string, installersRequest CreateInstallersRequest, invoke func(CreateInstallersRequest) (events.APIGatewayProxyResponse, error)) (events.APIGatewayProxyResponse, error) {
+	if shouldOffload(installersRequest) {
+		return respondJob(offload(ctx, installersRequest, offloadBackend, buildID(ctx), key))
+	}
+	local, remote := splitByBackend(installersRequest)
+	if local == nil && len(remote) == 1 {
+		for name, part := range remote {
+			return respondJob(offload(ctx, part, executionBackends[name], buildID(ctx), key))
+		}
+	}
+	names := make([]string, 0, len(remote))
+	for name := range remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var jobs []JobResponse
+	for _, name := range names {
+		name, part := name, remote[name]
+		partKey := ""
+		if key != "" {
+			partKey = key + "/" + name
+		}
+		response, err := runOnce(ctx, partKey, part, func() (events.APIGatewayProxyResponse, error) {
+			return respondJob(offload(ctx, part, executionBackends[name], buildID(ctx)+"-"+name, partKey))
+		})
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+		if response.StatusCode != http.StatusAccepted {
+			return response, nil
+		}
+		var job JobResponse
+		if err := json.Unmarshal([]byte(response.Body), &job); err != nil {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to parse job of the %s part: %w", name, err)
+		}
+		jobs = append(jobs, job)
+	}
+	if local == nil {
+		return respondJSON(http.StatusAccepted, CreateInstallersResponse{SchemaVersion: currentSchemaVersion, TeamName: installersRequest.TeamName, Results: []PackageResult{}, Jobs: jobs})
+	}
+	local.offloadedJobs = jobs
+	return invoke(*local)
+}
+
+func (j *asyncJob) response() JobResponse {
+	return JobResponse{
+		SchemaVersion: currentSchemaVersion,
+		ID:            j.ID,
+		Status:        j.Status,
+		Builder:       j.Builder,
+		RunID:         j.RunID,
+		TeamName:      j.TeamName,
+		StatusCode:    j.StatusCode,
+		Response:      j.Response,
+		Error:         j.Error,
+		SubmittedAt:   j.SubmittedAt,
+		UpdatedAt:     j.UpdatedAt,
+	}
+}
+
+// handleGetJob reports an async job. A job whose run ended without completing it is marked failed.
+// The run may record its response between reading the job and asking its backend, so the record is read again before
+// marking it failed. Backends only report runs that ended or timed out, so the second read is final.
+func handleGetJob(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	id := event.PathParameters["job_id"]
+	job, err := getJob(ctx, id)
+	if err != nil {
+		return respondError(err)
+	}
+	if job == nil {
+		return respondError(fmt.Errorf("%w: job %q not found", ErrNotFound, id))
+	}
+	if backend, ok := executionBackends[job.Builder]; ok && (job.Status == jobStatusQueued || job.Status == jobStatusRunning) && job.RunID != "" {
+		failed, reason, err := backend.failed(ctx, job)
+		if err != nil {
+			log.Printf("failed to check run %s of job %s: %s", job.RunID, job.ID, err)
+		} else if failed {
+			current, err := getJob(ctx, id)
+			if err != nil {
+				return respondError(err)
+			}
+			if current != nil {
+				job = current
+			}
+			if job.Status == jobStatusQueued || job.Status == jobStatusRunning {
+				job.Status, job.Error = jobStatusFailed, reason
+				if err := putJob(ctx, job); err != nil {
+					log.Printf("%s", err)
+				}
+			}
+		}
+	}
+	return respondJSON(http.StatusOK, job.response())
+}
+
+// runAsyncJob builds the request of job id on a remote builder and records its response. It returns the process's
+// exit code, non-zero if the job couldn't be run.
+func runAsyncJob(ctx context.Context, id string) int {
+	job, err := getJob(ctx, id)
+	if err == nil && job == nil {
+		err = fmt.Errorf("job %s not found", id)
+	}
+	if err != nil {
+		log.Printf("%s", err)
+		return 1
+	}
+	if job.Status != jobStatusQueued {
+		// e.g. a redelivered message of a job another worker took
+		log.Printf("job %s is already %s, not running it again", job.ID, job.Status)
+		return 0
+	}
+	job.Status = jobStatusRunning
+	if err := putJob(ctx, job); err != nil {
+		log.Printf("%s", err)
+	}
+	// the job is built here whatever its size or package types, it's claimed apart from the offload that answered
+	// the request under the same key
+	key := ""
+	if job.IdempotencyKey != "" {
+		key = job.IdempotencyKey + "/run"
+	}
+	response, err := runOnce(ctx, key, job.Request, func() (events.APIGatewayProxyResponse, error) {
+		return invoke(ctx, job.Request)
+	})
+	if err != nil {
+		response, _ = respondError(err)
+	}
+	job.StatusCode = response.StatusCode
+	job.Response = json.RawMessage(response.Body)
+	job.Status = jobStatusSucceeded
+	if response.StatusCode >= http.StatusBadRequest {
+		job.Status = jobStatusFailed
+	}
+	if err := putJob(ctx, job); err != nil {
+		log.Printf("%s", err)
+		return 1
+	}
+	log.Printf("job %s %s with %d", job.ID, job.Status, job.StatusCode)
+	return 0
+}
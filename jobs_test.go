@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitByBackend(t *testing.T) {
+	t.Setenv(jobIDEnv, "")
+	backends := map[string]string{"pkg": "macos", "msi": "windows"}
+	specs := func(types ...string) []packageSpec {
+		var specs []packageSpec
+		for _, packageType := range types {
+			specs = append(specs, packageSpec{Type: packageType})
+		}
+		return specs
+	}
+	tests := []struct {
+		name       string
+		backends   map[string]string
+		request    CreateInstallersRequest
+		wantLocal  *CreateInstallersRequest
+		wantRemote map[string]CreateInstallersRequest
+	}{
+		{
+			name:      "no backends",
+			request:   CreateInstallersRequest{TeamName: "workstations", Packages: specs("deb", "pkg")},
+			wantLocal: &CreateInstallersRequest{TeamName: "workstations", Packages: specs("deb", "pkg")},
+		},
+		{
+			name:      "dry run",
+			backends:  backends,
+			request:   CreateInstallersRequest{TeamName: "workstations", Packages: specs("deb", "pkg"), DryRun: true},
+			wantLocal: &CreateInstallersRequest{TeamName: "workstations", Packages: specs("deb", "pkg"), DryRun: true},
+		},
+		{
+			name:      "split",
+			backends:  backends,
+			request:   CreateInstallersRequest{TeamName: "workstations", IdempotencyKey: "key", Packages: specs("deb", "pkg", "rpm", "msi")},
+			wantLocal: &CreateInstallersRequest{TeamName: "workstations", IdempotencyKey: "key", Packages: specs("deb", "rpm")},
+			wantRemote: map[string]CreateInstallersRequest{
+				"macos":   {TeamName: "workstations", IdempotencyKey: "key", Packages: specs("pkg")},
+				"windows": {TeamName: "workstations", IdempotencyKey: "key", Packages: specs("msi")},
+			},
+		},
+		{
+			name:     "remote only",
+			backends: backends,
+			request:  CreateInstallersRequest{TeamName: "workstations", Packages: specs("pkg")},
+			wantRemote: map[string]CreateInstallersRequest{
+				"macos": {TeamName: "workstations", Packages: specs("pkg")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := packageBackends
+			packageBackends = tt.backends
+			defer func() { packageBackends = saved }()
+
+			local, remote := splitByBackend(tt.request)
+			if !reflect.DeepEqual(local, tt.wantLocal) {
+				t.Errorf("splitByBackend() local = %+v, want %+v", local, tt.wantLocal)
+			}
+			if len(remote) == 0 && len(tt.wantRemote) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(remote, tt.wantRemote) {
+				t.Errorf("splitByBackend() remote = %+v, want %+v", remote, tt.wantRemote)
+			}
+		})
+	}
+}
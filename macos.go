@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const (
+	// defaultMacOSJobTimeout is how long a macOS job may stay queued or running before it's reported failed, unless
+	// MACOS_JOB_TIMEOUT is set.
+	defaultMacOSJobTimeout = 2 * time.Hour
+
+	// macOSVisibilityTimeout is how long a job's message stays hidden from other workers, extended every
+	// macOSHeartbeatInterval while the job runs.
+	macOSVisibilityTimeout = 5 * time.Minute
+	macOSHeartbeatInterval = 2 * time.Minute
+)
+
+// macOSJobMessage is the message sent to macOS workers, naming the job to run.
+type macOSJobMessage struct {
+	JobID string `json:"job_id"`
+}
+
+// macOSBackend delegates async jobs to macOS workers, e.g. EC2 Mac instances or self-hosted runners, through the SQS
+// queue MACOS_BUILD_QUEUE_URL. pkgs built on macOS are packaged, signed and notarized with Apple's own tools, which
+// don't run on Linux. Workers run the packager with MACOS_WORKER=true, see runMacOSWorker.
+type macOSBackend struct {
+	client   *sqs.Client
+	queueURL string
+	timeout  time.Duration
+}
+
+// newMacOSBackend returns a backend sending jobs to MACOS_BUILD_QUEUE_URL, or nil if it isn't set.
+func newMacOSBackend(client *sqs.Client) (*macOSBackend, error) {
+	queueURL := os.Getenv("MACOS_BUILD_QUEUE_URL")
+	if queueURL == "" {
+		return nil, nil
+	}
+	timeout := defaultMacOSJobTimeout
+	if v := os.Getenv("MACOS_JOB_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid MACOS_JOB_TIMEOUT %q, must be a positive duration", v)
+		}
+		timeout = d
+	}
+	return &macOSBackend{client: client, queueURL: queueURL, timeout: timeout}, nil
+}
+
+func (b *macOSBackend) name() string {
+	return "macos"
+}
+
+func (b *macOSBackend) start(ctx context.Context, jobID string) (string, error) {
+	body, err := json.Marshal(macOSJobMessage{JobID: jobID})
+	if err != nil {
+		return "", err
+	}
+	out, err := b.client.SendMessage(ctx, &sqs.SendMessageInput{QueueUrl: aws.String(b.queueURL), MessageBody: aws.String(string(body))})
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.MessageId), nil
+}
+
+// failed reports jobs that didn't complete within the job timeout, SQS doesn't know whether a worker is running them.
+func (b *macOSBackend) failed(ctx context.Context, job *asyncJob) (bool, string, error) {
+	if time.Since(job.SubmittedAt) < b.timeout {
+		return false, "", nil
+	}
+	return true, fmt.Sprintf("no macOS worker completed the job within %s", b.timeout), nil
+}
+
+// runMacOSWorker runs the jobs sent to the macOS build queue, one at a time, until ctx is done. A job's message is
+// deleted once the job ran, a worker dying mid-job leaves it to be redelivered, and its job is then reported failed
+// by the backend's timeout rather than run twice.
+func runMacOSWorker(ctx context.Context, backend *macOSBackend) {
+	log.Printf("macOS worker polling %s", backend.queueURL)
+	for ctx.Err() == nil {
+		out, err := backend.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(backend.queueURL),
+			MaxNumberOfMessages: 1,
+			WaitTimeSeconds:     20,
+			VisibilityTimeout:   int32(macOSVisibilityTimeout.Seconds()),
+		})
+		if err != nil {
+			log.Printf("failed to receive from %s: %s", backend.queueURL, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, message := range out.Messages {
+			var m macOSJobMessage
+			if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &m); err != nil || m.JobID == "" {
+				log.Printf("dropping invalid message %s", aws.ToString(message.MessageId))
+			} else {
+				stop := backend.heartbeat(ctx, message.ReceiptHandle)
+				runAsyncJob(ctx, m.JobID)
+				stop()
+			}
+			if _, err := backend.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{QueueUrl: aws.String(backend.queueURL), ReceiptHandle: message.ReceiptHandle}); err != nil {
+				log.Printf("failed to delete message %s: %s", aws.ToString(message.MessageId), err)
+			}
+		}
+	}
+}
+
+// heartbeat keeps a message hidden from other workers while its job runs, until the returned function is called.
+func (b *macOSBackend) heartbeat(ctx context.Context, receiptHandle *string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(macOSHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, err := b.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(b.queueURL),
+					ReceiptHandle:     receiptHandle,
+					VisibilityTimeout: int32(macOSVisibilityTimeout.Seconds()),
+				})
+				if err != nil && ctx.Err() == nil {
+					log.Printf("failed to extend the visibility of a job message: %s", err)
+				}
+			}
+		}
+	}()
+	return cancel
+}
@@ -2,32 +2,161 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/codebuild"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
-	"github.com/fleetdm/fleet/v4/server/fleet"
-	"github.com/fleetdm/fleet/v4/server/service"
-	"github.com/go-resty/resty/v2"
 )
 
 var s3Client *s3.Client
 
 type CreateInstallersRequest struct {
-	TeamName     string   `json:"team_name"`
-	EnrollSecret string   `json:"enroll_secret"`
-	Packages     []string `json:"packages"`
+	TeamName string `json:"team_name"`
+	// Global builds installers enrolling to no team with the global enroll secret, as does omitting TeamName and
+	// TeamID.
+	Global bool `json:"global"`
+	// TeamID builds for the existing team with this ID instead of looking the team up by name or creating it.
+	TeamID       uint          `json:"team_id"`
+	EnrollSecret string        `json:"enroll_secret"`
+	Packages     []packageSpec `json:"packages"`
+	DryRun       bool          `json:"dry_run"`
+	// secretRotation is reported with the installers rebuilt after rotating the team's enroll secret, it's never read
+	// from requests.
+	secretRotation *SecretRotation `json:"-"`
+	// offloadedJobs are the jobs building the request's package types on other execution backends, see dispatch.
+	offloadedJobs []JobResponse `json:"-"`
+	// UseExistingTeam builds for the team named TeamName if it exists, with its current enroll secret, instead of
+	// creating it.
+	UseExistingTeam bool `json:"use_existing_team"`
+	// AgentOptions configures the agent options of a team the request creates, instead of Fleet's defaults.
+	AgentOptions json.RawMessage `json:"agent_options"`
+	// AgentOptionsTemplate configures a team the request creates with a named template of agent options, see
+	// requestAgentOptions.
+	AgentOptionsTemplate string `json:"agent_options_template"`
+	// IdempotencyKey deduplicates retried requests, the Idempotency-Key header takes precedence.
+	IdempotencyKey string `json:"idempotency_key"`
+	// KeyTemplate overrides the ARTIFACT_KEY_TEMPLATE object key template.
+	KeyTemplate string `json:"key_template"`
+	// ArtifactName overrides the ARTIFACT_NAME_TEMPLATE artifact file name template.
+	ArtifactName string `json:"artifact_name"`
+	// KMSKeyID overrides the ARTIFACT_KMS_KEY_ID key used to encrypt the uploaded artifacts.
+	KMSKeyID string `json:"kms_key_id"`
+	// StorageClass overrides the ARTIFACT_STORAGE_CLASS storage class of the uploaded artifacts.
+	StorageClass string `json:"storage_class"`
+	// ForceRebuild skips the build cache and always builds the installers.
+	ForceRebuild bool `json:"force_rebuild"`
+	// SkipUnchanged reuses the team's indexed installers that were built from the same inputs, see changeDetector.
+	SkipUnchanged bool `json:"skip_unchanged"`
+	// Destinations overrides the ARTIFACT_DESTINATIONS buckets installers are replicated to.
+	Destinations []artifactDestination `json:"destinations"`
+	// NotificationEmails are emailed the installers' download links once the request completes.
+	NotificationEmails []string `json:"notification_emails"`
+	// Architecture is the architecture installers are built for, empty for each package type's default.
+	Architecture string `json:"architecture"`
+	// Architectures builds every package type for each architecture it supports, see requestCells.
+	Architectures []string `json:"architectures"`
+	// OrbitChannel, OsquerydChannel and DesktopChannel follow another TUF channel than stable, see agentChannels.
+	OrbitChannel    string `json:"orbit_channel"`
+	OsquerydChannel string `json:"osqueryd_channel"`
+	DesktopChannel  string `json:"desktop_channel"`
+	// FleetURL overrides the FLEET_SERVER_URL installers enroll to, it must be listed in FLEET_SERVER_URL_ALLOWLIST.
+	FleetURL string `json:"fleet_url"`
+	// UpdateURL overrides the TUF_UPDATE_URL repository installers fetch and update the agent from, it must be listed
+	// in TUF_UPDATE_URL_ALLOWLIST.
+	UpdateURL string `json:"update_url"`
+	// FleetDesktop includes the Fleet Desktop tray app in the installers, they're built without it when it's unset.
+	FleetDesktop *bool `json:"fleet_desktop"`
+	// OsqueryFlagfile is an osquery flagfile baked into the installers, e.g. with watchdog and logger flags.
+	OsqueryFlagfile *requestFile `json:"osquery_flagfile"`
+	// FleetCertificate is a PEM bundle of the certificates installers trust the Fleet server with, e.g. an internal CA.
+	FleetCertificate *requestFile `json:"fleet_certificate"`
+	// HostIdentifier is the identifier hosts enroll with, one of hostIdentifiers, the packaging library's default
+	// when empty.
+	HostIdentifier string `json:"host_identifier"`
+	// EndUserEmail associates the hosts installing the installers with an end user in Fleet, e.g. for BYOD
+	// onboarding.
+	EndUserEmail string `json:"end_user_email"`
+	// UseSystemConfiguration makes pkgs read the Fleet URL and enroll secret from the MDM enrollment profile.
+	UseSystemConfiguration bool `json:"use_system_configuration"`
+	// EnableScripts lets Fleet run scripts on the hosts through orbit.
+	EnableScripts bool `json:"enable_scripts"`
+	// Debug builds troubleshooting installers with verbose orbit logging.
+	Debug bool `json:"debug"`
+	// DisableUpdates builds installers whose agent never updates itself from the TUF repository.
+	DisableUpdates bool `json:"disable_updates"`
+	// OrbitUpdateInterval is how often orbit checks the TUF repository for updates, a Go duration like "1h".
+	OrbitUpdateInterval string `json:"orbit_update_interval"`
+	// OrbitVersion pins the orbit version installers are built with, e.g. "1.16.0", instead of the stable channel.
+	OrbitVersion string `json:"orbit_version"`
+	// OsquerydVersion pins the osqueryd version installers are built with, e.g. "5.9.1".
+	OsquerydVersion string `json:"osqueryd_version"`
+	// DesktopVersion pins the Fleet Desktop version installers are built with, e.g. "1.16.0".
+	DesktopVersion string `json:"desktop_version"`
+	// FleetInstance builds installers for the named Fleet instance instead of FLEET_URL, see loadFleetInstances.
+	FleetInstance string `json:"fleet_instance"`
+}
+
+// packagers maps each supported package type to the fleet packaging function that builds it.
+var packagers = map[string]func(opt packaging.Options) (string, error){
+	"deb": packaging.BuildDeb,
+	"rpm": packaging.BuildRPM,
+	"pkg": packaging.BuildPkg,
+	"msi": packaging.BuildMSI,
+}
+
+// buildJob describes a single installer build and where its artifact is uploaded.
+type buildJob struct {
+	PackageType string
+	Options     packaging.Options
+	TeamName    string
+	// KeyTemplate is the text/template the artifact's object key is rendered from, see objectKey.
+	KeyTemplate string
+	// NameTemplate is the text/template the artifact's file name is rendered from, see artifactFileName.
+	NameTemplate string
+	// Architecture is the architecture the installer is built for, see packageArchitecture.
+	Architecture string
+	// KMSKeyID is the KMS key the artifact is encrypted with, empty for the bucket's default encryption.
+	KMSKeyID string
+	// StorageClass is the S3 storage class the artifact is uploaded with, empty for STANDARD.
+	StorageClass string
+	// Destinations are the additional buckets the artifact is replicated to.
+	Destinations []artifactDestination
+	// StagingPrefix is prepended to the artifact's key when it's staged before publishing. It's unique per request,
+	// so staged builds are never shared with other requests.
+	StagingPrefix string
+	// BuildID identifies the request the job belongs to. It doesn't influence the build, so it's left out of the
+	// build key.
+	BuildID string `json:"-"`
+	// BuilderID identifies the Lambda function building the job in its provenance, see builderID.
+	BuilderID string `json:"-"`
+	// FleetInstance is the Fleet instance the installer enrolls to, empty for FLEET_URL.
+	FleetInstance string
+	// slots bounds how many of the request's installers are built at once.
+	slots buildSlots
 }
 
 // The 'handler' function is the primary entry-point for the AWS Lambda function
@@ -39,176 +168,380 @@ type CreateInstallersRequest struct {
 // builds the different packages types as requested, logs all built package identifiers and finally returns an HTTP response.
 func handler(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	log.Printf("hello lambda handler")
+	if routeHandler, ok := routes[route{method: event.HTTPMethod, resource: event.Resource}]; ok {
+		return routeHandler(ctx, event)
+	}
+	if _, err := negotiateSchemaVersion(event); err != nil {
+		return respondError(err)
+	}
 	// parse the APIGateway event body
 	installersRequest, err := parseEventBody(event)
 	if err != nil {
-		return respondError(fmt.Errorf("failed to parse generate installer request: %w", err))
+		return respondError(fmt.Errorf("%w: failed to parse generate installer request: %w", ErrBadRequest, err))
+	}
+	installersRequest, err = applyTeamDefaults(ctx, installersRequest)
+	if err != nil {
+		return respondError(err)
+	}
+	installersRequest.Packages = expandPackageSpecs(installersRequest.Packages)
+	if err := validateRequest(installersRequest); err != nil {
+		return respondError(err)
 	}
-	response, err := invoke(installersRequest)
+	response, err := invokeRequest(ctx, idempotencyKey(event, installersRequest), installersRequest)
 	if err != nil {
 		return respondError(err)
 	}
 	return response, nil
 }
 
-func invoke(installersRequest CreateInstallersRequest) (events.APIGatewayProxyResponse, error) {
-	response := events.APIGatewayProxyResponse{
-		StatusCode: 200,
-		Body:       "\"Hello from Lambda!\"",
-	}
-	// create a new fleet client
-	fleetClient, err := service.NewClient(os.Getenv("FLEET_URL"), false, "", "")
+// invokeRequest runs a validated request, at most once per idempotency key, see runOnce. Package types built by other
+// execution backends are dispatched to them within the same claim, so a retry never starts their jobs again, see
+// dispatch.
+func invokeRequest(ctx context.Context, key string, installersRequest CreateInstallersRequest) (events.APIGatewayProxyResponse, error) {
+	return runOnce(ctx, key, installersRequest, func() (events.APIGatewayProxyResponse, error) {
+		return dispatch(ctx, key, installersRequest, func(installersRequest CreateInstallersRequest) (events.APIGatewayProxyResponse, error) {
+			return invoke(ctx, installersRequest)
+		})
+	})
+}
+
+func invoke(ctx context.Context, installersRequest CreateInstallersRequest) (events.APIGatewayProxyResponse, error) {
+	ctx = withFleetInstance(ctx, installersRequest.FleetInstance)
+	fleetClient, err := newFleetClient(ctx)
 	if err != nil {
-		return respondError(fmt.Errorf("failed to create fleet server client: %w", err))
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if err := checkFleetServer(ctx, fleetClient); err != nil {
+		return events.APIGatewayProxyResponse{}, err
 	}
-	// set up the fleet client authentication
-	fleetClient.SetToken(os.Getenv("FLEET_API_ONLY_USER_TOKEN"))
 
-	restClient := resty.New().SetBaseURL(os.Getenv("FLEET_URL")).SetAuthToken(os.Getenv("FLEET_API_ONLY_USER_TOKEN"))
+	// keys, indexes and messages are all named after the team
+	switch {
+	case isGlobalRequest(installersRequest):
+		installersRequest.Global = true
+		installersRequest.TeamName = globalTeamName
+	case installersRequest.TeamID != 0:
+		installersRequest.TeamName, err = teamNameByID(ctx, fleetClient, installersRequest)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
 
-	type fleetTeam struct {
-		Team fleet.Team `json:"team"`
+	if installersRequest.DryRun {
+		return planInstallers(ctx, fleetClient, installersRequest)
 	}
-	var team fleetTeam
-	var apiErr *apiError
-	resp, err := restClient.R().
-		SetHeader("Accept", "application/json").
-		SetBody(fleet.Team{Name: installersRequest.TeamName}).
-		SetError(&apiErr).
-		SetResult(&team).
-		Post("/api/latest/fleet/teams")
+	startedAt := time.Now()
+	notifier.notify(ctx, buildStartedMessage(installersRequest))
+
+	resetBuildWorkspace()
+	defer resetBuildWorkspace()
+
+	cells := requestCells(installersRequest)
+	concurrency, err := planBuildConcurrency(cells)
 	if err != nil {
-		return respondError(err)
+		notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+		return events.APIGatewayProxyResponse{}, err
 	}
-	if apiErr != nil {
-		return respondError(errorFromAPIError(apiErr))
-	}
-	// todo make this less lazy
-	if resp.StatusCode() != http.StatusOK {
-		return respondError(fmt.Errorf("unexpected api response status code: %d", resp.StatusCode()))
+
+	// read the files the request supplies before the team is created, so a missing file fails the request first
+	resolved, sources := resolvePackagingOptions(installersRequest)
+	options, err := writeRequestFiles(ctx, resolved, installersRequest)
+	if err != nil {
+		notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+		return events.APIGatewayProxyResponse{}, err
 	}
 
-	err = os.Mkdir("/tmp/build", 0755)
+	agentOptions, err := requestAgentOptions(ctx, installersRequest)
 	if err != nil {
-		log.Printf("/tmp/build already exists")
+		notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+		return events.APIGatewayProxyResponse{}, err
 	}
 
-	// default packaging options
-	options := packaging.Options{
-		FleetURL:            os.Getenv("FLEET_SERVER_URL"),
-		EnrollSecret:        team.Team.Secrets[0].Secret, // create the installers with the new enroll secret
-		UpdateURL:           "https://tuf.fleetctl.com",
-		Identifier:          "com.fleetdm.orbit",
-		StartService:        true,
-		NativeTooling:       true,
-		OrbitChannel:        "stable",
-		OsquerydChannel:     "stable",
-		DesktopChannel:      "stable",
-		OrbitUpdateInterval: 15 * time.Minute,
+	team, created, err := resolveTeam(ctx, fleetClient, installersRequest)
+	if err != nil {
+		notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+		return events.APIGatewayProxyResponse{}, err
+	}
+	if created && agentOptions != nil {
+		if err := applyTeamAgentOptions(ctx, fleetClient, team.ID, agentOptions); err != nil {
+			notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+			return events.APIGatewayProxyResponse{}, err
+		}
 	}
 
-	buildWg := sync.WaitGroup{}
-	var installers []string
-	var buildErr error
-	var errResp events.APIGatewayProxyResponse
-	for _, packageType := range installersRequest.Packages {
-		packageType := packageType // needed to capture current value of i during for loop fixed in Go 1.22
-		buildWg.Add(1)
-		go func() {
-			defer buildWg.Done()
-			switch packageType {
-			case "deb":
-				pkg, err := buildPackage(packageType, packaging.BuildDeb, options)
-				if err != nil {
-					errResp, buildErr = respondError(err)
-				}
-				installers = append(installers, pkg)
-			case "rpm":
-				pkg, err := buildPackage(packageType, packaging.BuildRPM, options)
-				if err != nil {
-					errResp, buildErr = respondError(err)
-				}
-				installers = append(installers, pkg)
-			case "pkg":
-				pkg, err := buildPackage(packageType, packaging.BuildPkg, options)
-				if err != nil {
-					errResp, buildErr = respondError(err)
-				}
-				installers = append(installers, pkg)
-			case "msi":
-				pkg, err := buildPackage(packageType, packaging.BuildMSI, options)
-				if err != nil {
-					errResp, buildErr = respondError(err)
-				}
-				installers = append(installers, pkg)
-			}
-		}()
+	// create the installers with the requested enroll secret, else the team's current one
+	if len(team.Secrets) > 0 {
+		options.EnrollSecret = team.Secrets[0].Secret
+	}
+	if installersRequest.EnrollSecret != "" {
+		if err := addTeamEnrollSecret(ctx, fleetClient, team, installersRequest.EnrollSecret); err != nil {
+			notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+			return events.APIGatewayProxyResponse{}, err
+		}
+		options.EnrollSecret = installersRequest.EnrollSecret
 	}
-	buildWg.Wait()
-	if buildErr != nil {
-		return errResp, buildErr
+	if options.EnrollSecret == "" {
+		err := fmt.Errorf("%w: team %s has no enroll secret", ErrUnprocessable, team.Name)
+		notifier.notify(ctx, buildFailedMessage(installersRequest.TeamName, err, time.Since(startedAt)))
+		return events.APIGatewayProxyResponse{}, err
 	}
 
-	uploadWg := sync.WaitGroup{}
-	for _, i := range installers {
+	// build and upload every package independently, one failing package type doesn't discard the others
+	results := make([]PackageResult, len(cells))
+	errs := make([]error, len(cells))
+	jobs := make([]buildJob, len(cells))
+	id := buildID(ctx)
+	staged := artifactPublishMode() == artifactPublishStaged
+	changes := &changeDetector{}
+	slots := newBuildSlots(concurrency)
+	wg := sync.WaitGroup{}
+	for i, cell := range cells {
 		i := i // needed to capture current value of i during for loop fixed in Go 1.22
-		uploadWg.Add(1)
+		job := buildJob{
+			PackageType:   cell.PackageType,
+			Options:       cell.Spec.apply(options),
+			TeamName:      installersRequest.TeamName,
+			KeyTemplate:   keyTemplate(installersRequest),
+			NameTemplate:  nameTemplate(installersRequest),
+			KMSKeyID:      kmsKeyID(installersRequest),
+			StorageClass:  storageClass(installersRequest),
+			Destinations:  artifactDestinations(installersRequest),
+			BuildID:       id,
+			BuilderID:     builderID(ctx),
+			FleetInstance: installersRequest.FleetInstance,
+			slots:         slots,
+		}
+		job = newArchitectureJob(job, cell.Architecture)
+		if staged {
+			job.StagingPrefix = stagingPrefix(id)
+		}
+		jobs[i] = job
+		var hash string
+		var unchanged *PackageResult
+		if installersRequest.SkipUnchanged {
+			hash, unchanged = changes.unchanged(ctx, job)
+		}
+		wg.Add(1)
 		go func() {
-			defer uploadWg.Done()
-			log.Printf("built %s", i)
-			info, err := os.Stat(i)
-			if err != nil {
-				log.Printf("error getting file info %s: %s\n", i, err)
+			defer wg.Done()
+			if unchanged != nil {
+				results[i] = *unchanged
+				results[i].Architecture = job.Architecture
+				results[i].InputsHash = hash
 				return
 			}
-			log.Printf("file info: %+v\n", info)
-
-			// upload results to S3
-			err = uploadArtifact(i, installersRequest.TeamName)
+			result, err := buildOnce(ctx, job, installersRequest.ForceRebuild)
+			result.InputsHash = hash
+			results[i] = result
 			if err != nil {
-				log.Printf("failed to upload to s3: %s", err)
+				log.Printf("%s: %s", packageLabel(job.PackageType, job.Architecture), err)
+				class := classifyError(err)
+				errs[i] = err
+				results[i] = PackageResult{Package: job.PackageType, Status: packageStatusFailed, Error: err.Error(), Code: class.code, Retryable: class.retryable}
 			}
+			results[i].Architecture = job.Architecture
 		}()
 	}
-	uploadWg.Wait()
+	wg.Wait()
+	if installersRequest.SkipUnchanged {
+		log.Printf("team %s: %s", installersRequest.TeamName, unchangedSummary(results))
+	}
+	if staged {
+		publishStaged(ctx, installersRequest.TeamName, id, jobs, results, errs)
+	}
+	manifest, err := writeBuildManifest(ctx, installersRequest, options, jobs, results, startedAt)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+	if err := updateIndexes(ctx, installersRequest.TeamName, jobs, results, startedAt); err != nil {
+		log.Printf("%s", err)
+	}
+	if aptRepositoryEnabled() {
+		if err := updateAptRepository(ctx, installersRequest.TeamName, jobs, results); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	if yumRepositoryEnabled() {
+		if err := updateYumRepository(ctx, installersRequest.TeamName, jobs, results); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	if chocolateyFeed != nil {
+		if err := publishChocolateyPackages(ctx, results); err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	signDownloadURLs(results)
+	response := CreateInstallersResponse{TeamName: installersRequest.TeamName, Results: results, Manifest: manifest, SecretRotation: installersRequest.secretRotation, Jobs: installersRequest.offloadedJobs}
+	if responseDebugEnabled() {
+		response.Debug = &ResponseDebug{Options: redactOptions(options), OptionSources: sources}
+	}
+	if created && allFailed(errs) {
+		response.EmptyTeam = rollbackTeam(ctx, fleetClient, team)
+	}
+	if downloadPageEnabled() {
+		response.DownloadPage, err = writeDownloadPage(ctx, installersRequest.TeamName, jobs, results)
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	if homebrewCaskEnabled() {
+		if err := writeHomebrewCask(ctx, installersRequest.TeamName, jobs, results); err != nil {
+			log.Printf("%s", err)
+		}
+	}
 
-	return response, nil
+	if err := sendCompletionEmail(ctx, installersRequest.NotificationEmails, response); err != nil {
+		log.Printf("%s", err)
+	}
+	notifier.notify(ctx, buildCompletedMessage(response, time.Since(startedAt)))
+
+	return respondResults(response, errs)
 }
 
-func uploadArtifact(file string, name string) error {
-	bucket := os.Getenv("ARTIFACT_BUCKET")
-	if bucket == "" {
-		return errors.New("bucket name cannot be empty")
+// buildID returns an identifier for the current invocation: the Lambda request ID, or a random ID when running
+// outside of Lambda.
+func buildID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		return lc.AwsRequestID
+	}
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "local"
 	}
-	objectKey := fmt.Sprintf("teamName=%s/%s", name, file)
-	f, err := os.Open(file)
+	return "local-" + hex.EncodeToString(buf)
+}
+
+// buildAndUpload builds a single package type with the job's options and uploads it to the artifact bucket.
+// It returns the result describing the uploaded installer.
+func buildAndUpload(job buildJob) (PackageResult, error) {
+	startedAt := time.Now()
+	// resolve the component versions right before the build fetches them
+	var components []component
+	if sbomEnabled() || provenanceEnabled() {
+		var err error
+		components, err = resolveComponents(context.Background(), job.PackageType, job.Options)
+		if err != nil {
+			return PackageResult{}, fmt.Errorf("%w: failed to resolve %s components: %w", ErrBuildFailed, job.PackageType, err)
+		}
+	}
+	workspace, err := newBuildWorkspace()
 	if err != nil {
-		return err
+		return PackageResult{}, fmt.Errorf("%w: failed to create build workspace: %w", ErrBuildFailed, err)
 	}
-	params := &s3.PutObjectInput{
-		Bucket: &bucket,
-		Key:    &objectKey,
-		Body:   f,
+	defer os.RemoveAll(workspace)
+	// hold a build slot until the installer is ready to upload, or the build fails
+	job.slots.acquire()
+	building := true
+	defer func() {
+		if building {
+			job.slots.release()
+		}
+	}()
+	pkg, err := buildPackage(job.PackageType, packagers[job.PackageType], job.Options)
+	if err != nil {
+		return PackageResult{}, err
 	}
-	_, err = s3Client.PutObject(context.Background(), params)
+	pkg, err = moveToWorkspace(pkg, workspace)
 	if err != nil {
-		return err
+		return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
 	}
-	log.Println("successfully uploaded to bucket")
-	return nil
-}
+	log.Printf("built %s", pkg)
+	if packageSigner != nil {
+		if err := packageSigner.signPackage(job.PackageType, pkg); err != nil {
+			return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+		}
+	}
+	if msiSigner != nil {
+		if err := msiSigner.signPackage(job.PackageType, pkg); err != nil {
+			return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+		}
+	}
+	if pkgSigner != nil {
+		if err := pkgSigner.signPackage(job.PackageType, pkg); err != nil {
+			return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+		}
+	}
+	// notarization comes last, the stapled ticket is for the exact bytes Apple was sent
+	if notarizer != nil {
+		if err := notarizer.notarize(job.PackageType, pkg); err != nil {
+			return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+		}
+	}
+	built, err := inspectArtifact(pkg)
+	if err != nil {
+		return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+	}
+	log.Printf("artifact: %+v\n", built)
+	name, err := artifactFileName(job, built.Path)
+	if err != nil {
+		return PackageResult{}, err
+	}
+	documents, err := buildSidecars(context.Background(), built, job, name, components, startedAt)
+	if err != nil {
+		return PackageResult{}, fmt.Errorf("%w: %w", ErrBuildFailed, err)
+	}
+
+	job.slots.release()
+	building = false
 
-func errorFromAPIError(err *apiError) error {
+	// upload results to the artifact store and every additional destination concurrently
+	var destinations []DestinationResult
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		destinations = uploadDestinations(built, job)
+	}()
+	key, err := uploadWithRetries(artifactStore, built, job)
+	wg.Wait()
 	if err != nil {
-		if len(err.Errors) > 0 {
-			messages := make([]string, len(err.Errors))
-			for _, msg := range err.Errors {
-				messages = append(messages, fmt.Sprintf("name: %s reason: %s", msg.Name, msg.Reason))
-			}
-			return fmt.Errorf("api error: %s messages: %s", err.Message, strings.Join(messages, ", "))
-		}
+		return PackageResult{}, fmt.Errorf("failed to upload %s to s3: %w", job.PackageType, err)
+	}
+	sidecars, err := uploadSidecars(context.Background(), artifactStore, key, documents, job)
+	if err != nil {
+		return PackageResult{}, err
+	}
+	if job.StagingPrefix == "" {
+		// staged artifacts are pruned once they're published
+		pruneArtifacts(context.Background(), artifactStore, job, key)
 	}
-	return errors.New("no api error defined")
+	return PackageResult{
+		Package:      job.PackageType,
+		Status:       packageStatusSucceeded,
+		Key:          key,
+		URL:          artifactURL(key),
+		SHA256:       built.SHA256,
+		Size:         built.Size,
+		Verified:     true,
+		Sidecars:     sidecars,
+		Destinations: destinations,
+	}, nil
+}
+
+// uploadWithRetries uploads a built installer to store, retrying failed uploads with uploadRetryPolicy.
+func uploadWithRetries(store ArtifactStore, built artifact, job buildJob) (string, error) {
+	var key string
+	err := uploadRetryPolicy.do(context.Background(), fmt.Sprintf("upload %s", job.PackageType), isUploadFailure, func() error {
+		var err error
+		key, err = uploadArtifact(store, built, job)
+		return err
+	})
+	return key, err
+}
+
+// isUploadFailure reports whether err is a failed request to S3 worth retrying, as opposed to e.g. a bad key
+// template that fails the same way every time.
+func isUploadFailure(err error) bool {
+	return errors.Is(err, ErrUploadFailed)
+}
+
+// defaultPackagingOptions returns the options every installer is built with, the deployment's defaults, enrolling
+// with enrollSecret.
+func defaultPackagingOptions(enrollSecret string) packaging.Options {
+	options := appConfig.PackagingDefaults
+	options.EnrollSecret = enrollSecret
+	return options
 }
 
 // buildPackage is a function that takes a packageType string, a packagerFunc function, and options packaging.Options
@@ -219,7 +552,7 @@ func buildPackage(packageType string, packagerFunc func(opt packaging.Options) (
 	pkg, err := packagerFunc(options)
 	if err != nil {
 		// If an error occurs during the packaging process, return an error with an informative message.
-		return "", fmt.Errorf("failed to package %s: %w", packageType, err)
+		return "", fmt.Errorf("%w: failed to package %s: %w", ErrBuildFailed, packageType, err)
 	}
 
 	// Return the path of the built package and nil for the error.
@@ -228,9 +561,24 @@ func buildPackage(packageType string, packagerFunc func(opt packaging.Options) (
 
 // parseEventBody is a function that takes an event of type events.APIGatewayProxyRequest
 // and parses its body into a CreateInstallersRequest struct.
+// When strict parsing is enabled, fields that do not exist on CreateInstallersRequest are rejected
+// with an unknownFieldsError instead of being silently ignored.
 func parseEventBody(event events.APIGatewayProxyRequest) (CreateInstallersRequest, error) {
-	// Use json.Unmarshal to unmarshal the event body into a CreateInstallersRequest struct.
 	request := CreateInstallersRequest{}
+	if strictParsingEnabled(event) {
+		// Collect every unrecognized field up front, json.Decoder only reports the first one it finds.
+		if unknown := unknownRequestFields([]byte(event.Body)); len(unknown) > 0 {
+			return CreateInstallersRequest{}, &unknownFieldsError{Fields: unknown}
+		}
+		decoder := json.NewDecoder(strings.NewReader(event.Body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil {
+			return CreateInstallersRequest{}, fmt.Errorf("failed to parse event body: %w", err)
+		}
+		return request, nil
+	}
+
+	// Use json.Unmarshal to unmarshal the event body into a CreateInstallersRequest struct.
 	if err := json.Unmarshal([]byte(event.Body), &request); err != nil {
 		return CreateInstallersRequest{}, fmt.Errorf("failed to parse event body: %w", err)
 	}
@@ -239,51 +587,222 @@ func parseEventBody(event events.APIGatewayProxyRequest) (CreateInstallersReques
 	return request, nil
 }
 
-// The 'respondError' function takes an error as input, formats it as a JSON string, and returns an API Gateway
-// proxy response with a status code of 500 (Internal Server Error). If the JSON marshalling of the error fails,
-// it returns a predefined error response indicating that marshalling failed.
-func respondError(err error) (events.APIGatewayProxyResponse, error) {
-	// Initialise an empty map for the response body
-	respBody := map[string]string{}
-
-	// Set the error message in the response body
-	respBody["error"] = err.Error()
-
-	// Attempt to marshal the response body into JSON
-	buf, marshalErr := json.Marshal(respBody)
-	if marshalErr != nil {
-		// If marshalling failed, return an error response with an appropriate message
-		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: "[\"error\":\"failed to marshal err response\"}"}, err
+// strictParsingEnabled reports whether unknown request fields should be rejected.
+// The "strict" query string parameter takes precedence over the STRICT_REQUEST_PARSING env var,
+// so callers can opt in (or out) per request without changing the deployment default.
+func strictParsingEnabled(event events.APIGatewayProxyRequest) bool {
+	if v, ok := event.QueryStringParameters["strict"]; ok {
+		strict, err := strconv.ParseBool(v)
+		return err == nil && strict
 	}
+	strict, _ := strconv.ParseBool(os.Getenv("STRICT_REQUEST_PARSING"))
+	return strict
+}
 
-	// If marshalling was successful, return an error response with the original error message
-	errResponse := events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError, Body: string(buf)}
-	return errResponse, err
+// unknownRequestFields returns the sorted top level keys of body that don't map to a CreateInstallersRequest field.
+// Matching is case-insensitive to mirror encoding/json. A body that isn't a JSON object yields no fields,
+// the decoder reports those errors itself.
+func unknownRequestFields(body []byte) []string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil
+	}
+	known := map[string]bool{}
+	t := reflect.TypeOf(CreateInstallersRequest{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		known[strings.ToLower(name)] = true
+	}
+	var unknown []string
+	for key := range raw {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
 }
 
 func main() {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(os.Getenv("AWS_REGION")))
+	var err error
+	appConfig, err = loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	enabledPackageTypes = appConfig.PackageTypes
+	uploadRetryPolicy = appConfig.UploadRetryPolicy
+	fleetRetryPolicy = appConfig.FleetRetryPolicy
+	fleetCallTimeouts = appConfig.FleetTimeouts
+	artifactRetention = appConfig.Retention
+	applyProxy(appConfig.ProxyURL)
+	if err := startTUFCache(); err != nil {
+		log.Fatalf("unable to start the TUF cache, %v", err)
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(appConfig.AWSRegion))
 	if err != nil {
 		log.Fatalf("unable to load SDK config, %v", err)
 	}
-	s3Client = s3.NewFromConfig(cfg)
-	if os.Getenv("LOCAL") != "" {
-		createInstallersRequest := CreateInstallersRequest{TeamName: "bentestteam", EnrollSecret: "test123", Packages: []string{"deb", "rpm"}}
+	s3Options, err := s3ClientOptions()
+	if err != nil {
+		log.Fatalf("unable to configure S3 client, %v", err)
+	}
+	s3Client = s3.NewFromConfig(artifactStoreConfig(cfg), s3Options)
+	appConfig.PackagingDefaults.UpdateRoots, err = loadTUFRoots(context.TODO())
+	if err != nil {
+		log.Fatalf("unable to load the TUF root, %v", err)
+	}
+	if appConfig.PackagingDefaults.UpdateRoots != "" {
+		appConfig.PackagingSources["UpdateRoots"] = optionSourceEnv
+	}
+	artifactUploader, err = newArtifactUploader(s3Client)
+	if err != nil {
+		log.Fatalf("unable to create artifact uploader, %v", err)
+	}
+	artifactStore, err = newArtifactStore(context.TODO())
+	if err != nil {
+		log.Fatalf("unable to create artifact store, %v", err)
+	}
+	defaultDestinations, err = parseArtifactDestinations(os.Getenv("ARTIFACT_DESTINATIONS"))
+	if err != nil {
+		log.Fatalf("invalid ARTIFACT_DESTINATIONS, %v", err)
+	}
+	if artifactPublishMode() == artifactPublishStaged && artifactLayout() == artifactLayoutContent {
+		log.Fatalf("ARTIFACT_PUBLISH=%s can't be combined with ARTIFACT_LAYOUT=%s", artifactPublishStaged, artifactLayoutContent)
+	}
+	dynamoClient = dynamodb.NewFromConfig(cfg)
+	sesClient = sesv2.NewFromConfig(cfg)
+	kmsClient = kms.NewFromConfig(cfg)
+	artifactSigner = newKMSSigner()
+	if provenanceEnabled() && artifactSigner == nil {
+		log.Fatalf("ARTIFACT_PROVENANCE requires SIGNING_KMS_KEY_ID to sign provenance statements")
+	}
+	if signatureEnabled() && artifactSigner == nil {
+		log.Fatalf("ARTIFACT_SIGNATURE requires SIGNING_KMS_KEY_ID to sign installers")
+	}
+	secrets := secretsmanager.NewFromConfig(cfg)
+	parameters := ssm.NewFromConfig(cfg)
+	secretValues, err = newSecretCache(secrets, parameters)
+	if err != nil {
+		log.Fatalf("unable to configure secrets, %v", err)
+	}
+	fleetInstances, err = loadFleetInstances(context.TODO(), parameters)
+	if err != nil {
+		log.Fatalf("unable to configure Fleet instances, %v", err)
+	}
+	for _, name := range fleetInstanceNames() {
+		if _, err := secretValues.get(context.TODO(), fleetInstances[name].TokenSecret); err != nil {
+			log.Fatalf("unable to read the API token of Fleet instance %s, %v", name, err)
+		}
+	}
+	for _, name := range secretEnvVars {
+		if _, err := envSecret(context.TODO(), name); err != nil {
+			log.Fatalf("unable to read %s, %v", name, err)
+		}
+	}
+	fleetTokenRefresher = newFleetLogin(secrets)
+	appConfig.FleetRootCA, err = fleetRootCAFromSecret(context.TODO())
+	if err != nil {
+		log.Fatalf("unable to configure the Fleet server's CA, %v", err)
+	}
+	if appConfig.FleetInsecureSkipVerify {
+		log.Printf("FLEET_INSECURE_SKIP_VERIFY is set, the Fleet server's certificate isn't verified")
+	}
+	fleetMTLSProxyURL, err = startFleetMTLSProxy(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure the Fleet client certificate, %v", err)
+	}
+	downloadSigner, err = newCloudFrontSigner(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure CloudFront signed URLs, %v", err)
+	}
+	packageSigner, err = newGPGSigner(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure GPG package signing, %v", err)
+	}
+	msiSigner, err = newAuthenticodeSigner(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure Authenticode signing, %v", err)
+	}
+	pkgSigner, err = newMacOSSigner(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure pkg signing, %v", err)
+	}
+	notarizer, err = newAppleNotarizer(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure notarization, %v", err)
+	}
+	chocolateyFeed, err = newNugetFeed(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure the Chocolatey feed, %v", err)
+	}
+	homebrewTap, err = newGitHubTap(context.TODO(), secrets)
+	if err != nil {
+		log.Fatalf("unable to configure the Homebrew tap, %v", err)
+	}
+	if aptRepositoryEnabled() && packageSigner == nil {
+		log.Fatalf("APT_REPOSITORY requires GPG_SIGNING_KEY_SECRET to sign the repository")
+	}
+	if yumRepositoryEnabled() && packageSigner == nil {
+		log.Fatalf("YUM_REPOSITORY requires GPG_SIGNING_KEY_SECRET to sign the repository")
+	}
+	if _, err := presignedURLTTL(); err != nil {
+		log.Fatalf("unable to configure presigned URLs, %v", err)
+	}
+	notifier, err = newWebhookNotifier(context.TODO())
+	if err != nil {
+		log.Fatalf("unable to configure webhook notifications, %v", err)
+	}
+	if _, err := offloadMinPackages(); err != nil {
+		log.Fatalf("unable to configure build offloading, %v", err)
+	}
+	var backends []executionBackend
+	if backend := newCodeBuildBackend(codebuild.NewFromConfig(cfg)); backend != nil {
+		backends = append(backends, backend)
+	}
+	fargate, err := newFargateBackend(ecs.NewFromConfig(cfg))
+	if err != nil {
+		log.Fatalf("unable to configure the Fargate backend, %v", err)
+	}
+	if fargate != nil {
+		backends = append(backends, fargate)
+	}
+	macOS, err := newMacOSBackend(sqs.NewFromConfig(cfg))
+	if err != nil {
+		log.Fatalf("unable to configure the macOS backend, %v", err)
+	}
+	if macOS != nil {
+		backends = append(backends, macOS)
+	}
+	if err := loadExecutionBackends(backends...); err != nil {
+		log.Fatalf("unable to configure execution backends, %v", err)
+	}
+	enabledPackageTypes, err = detectPackageTypes(appConfig.PackageTypes)
+	if err != nil {
+		log.Fatalf("unable to detect the package types this deployment builds, %v", err)
+	}
+	if id := os.Getenv(jobIDEnv); id != "" {
+		os.Exit(runAsyncJob(context.Background(), id))
+	}
+	if worker, _ := strconv.ParseBool(os.Getenv("MACOS_WORKER")); worker {
+		if macOS == nil {
+			log.Fatalf("MACOS_WORKER requires MACOS_BUILD_QUEUE_URL")
+		}
+		runMacOSWorker(context.Background(), macOS)
+		return
+	}
+	if appConfig.Local {
+		createInstallersRequest := CreateInstallersRequest{TeamName: "bentestteam", EnrollSecret: "test123", Packages: []packageSpec{{Type: "deb"}, {Type: "rpm"}}}
 		buf, _ := json.Marshal(createInstallersRequest)
 		fmt.Println(string(buf))
-		_, err := invoke(createInstallersRequest)
+		response, err := invoke(context.Background(), createInstallersRequest)
 		if err != nil {
 			log.Fatal(err)
 		}
+		log.Printf("%d %s", response.StatusCode, response.Body)
 	} else {
-		lambda.Start(handler)
+		lambda.Start(lambdaHandler)
 	}
 }
-
-type apiError struct {
-	Message string `json:"message"`
-	Errors  []struct {
-		Name   string `json:"name"`
-		Reason string `json:"reason"`
-	} `json:"errors"`
-}
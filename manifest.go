@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// manifestFileName is the file name build manifests are uploaded as, rendered into the key template like an
+// installer's file name.
+const manifestFileName = "manifest.json"
+
+// redacted replaces secrets and personal data in build manifests.
+const redacted = "<redacted>"
+
+// buildManifest describes a request's build: what was asked for, the options the installers were packaged with and
+// the installers that were uploaded. It's uploaded next to the installers as manifest.json.
+type buildManifest struct {
+	SchemaVersion string                  `json:"schema_version"`
+	BuildID       string                  `json:"build_id"`
+	TeamName      string                  `json:"team_name"`
+	Request       CreateInstallersRequest `json:"request"`
+	Options       packaging.Options       `json:"options"`
+	Artifacts     []manifestArtifact      `json:"artifacts"`
+	StartedAt     time.Time               `json:"started_at"`
+	CompletedAt   time.Time               `json:"completed_at"`
+}
+
+// manifestArtifact is an installer listed in a build manifest.
+type manifestArtifact struct {
+	Package  string `json:"package"`
+	Status   string `json:"status"`
+	File     string `json:"file,omitempty"`
+	Key      string `json:"key,omitempty"`
+	URL      string `json:"url,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Verified bool   `json:"verified,omitempty"`
+	Cached   bool   `json:"cached,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Sidecars are the documents uploaded next to the installer, e.g. its SBOM.
+	Sidecars []SidecarResult `json:"sidecars,omitempty"`
+}
+
+// redactOptions returns options with the secrets and email address they're packaged with replaced.
+func redactOptions(options packaging.Options) packaging.Options {
+	for _, secret := range []*string{&options.EnrollSecret, &options.MacOSDevIDCertificateContent, &options.AppStoreConnectAPIKeyContent, &options.EndUserEmail} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return options
+}
+
+// manifestObjectKey returns the key of job's build manifest, rendered from the key template with the manifest's
+// file name.
+func manifestObjectKey(job buildJob) (string, error) {
+	return objectKey(job.KeyTemplate, newObjectKeyData(job, manifestFileName, time.Now()))
+}
+
+// writeBuildManifest uploads the manifest of a request's build next to its first requested installer and returns
+// its URL. Nothing is written when no installer was uploaded.
+func writeBuildManifest(ctx context.Context, installersRequest CreateInstallersRequest, options packaging.Options, jobs []buildJob, results []PackageResult, startedAt time.Time) (string, error) {
+	manifest := buildManifest{
+		SchemaVersion: currentSchemaVersion,
+		BuildID:       jobs[0].BuildID,
+		TeamName:      installersRequest.TeamName,
+		Request:       installersRequest,
+		Options:       redactOptions(options),
+		StartedAt:     startedAt,
+		CompletedAt:   time.Now(),
+	}
+	if manifest.Request.EnrollSecret != "" {
+		manifest.Request.EnrollSecret = redacted
+	}
+	if manifest.Request.EndUserEmail != "" {
+		manifest.Request.EndUserEmail = redacted
+	}
+	if len(manifest.Request.NotificationEmails) > 0 {
+		// copied so the addresses are still emailed once the request completes
+		emails := make([]string, len(manifest.Request.NotificationEmails))
+		for i := range emails {
+			emails[i] = redacted
+		}
+		manifest.Request.NotificationEmails = emails
+	}
+	uploaded := false
+	for _, result := range results {
+		artifact := manifestArtifact{Package: result.Package, Status: result.Status, Error: result.Error}
+		if result.Status == packageStatusSucceeded {
+			uploaded = true
+			artifact.File = path.Base(result.Key)
+			artifact.Key = result.Key
+			artifact.URL = result.URL
+			artifact.SHA256 = result.SHA256
+			artifact.Size = result.Size
+			artifact.Verified = result.Verified
+			artifact.Cached = result.Cached
+			artifact.Sidecars = result.Sidecars
+		}
+		manifest.Artifacts = append(manifest.Artifacts, artifact)
+	}
+	if !uploaded {
+		return "", nil
+	}
+
+	key, err := manifestObjectKey(jobs[0])
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal build manifest: %w", err)
+	}
+	if err := artifactStore.PutObject(ctx, key, buf, "application/json", jobs[0]); err != nil {
+		return "", fmt.Errorf("failed to write build manifest: %w", err)
+	}
+	log.Printf("wrote build manifest %s", key)
+	return artifactURL(key), nil
+}
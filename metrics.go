@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultMetricsNamespace is the CloudWatch namespace metrics are published in, unless METRICS_NAMESPACE is set.
+const defaultMetricsNamespace = "FleetPackager"
+
+// metric is a CloudWatch metric value.
+type metric struct {
+	Name  string
+	Unit  string
+	Value float64
+}
+
+// emitMetrics publishes metrics in the CloudWatch embedded metric format: a JSON log line CloudWatch Logs extracts
+// them from, no API call needed. The line is written to stdout without the log package's prefix, which would make it
+// a plain log line.
+func emitMetrics(metrics ...metric) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = defaultMetricsNamespace
+	}
+	definitions := make([]map[string]string, 0, len(metrics))
+	line := map[string]any{}
+	for _, m := range metrics {
+		definitions = append(definitions, map[string]string{"Name": m.Name, "Unit": m.Unit})
+		line[m.Name] = m.Value
+	}
+	line["_aws"] = map[string]any{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]any{{
+			"Namespace":  namespace,
+			"Dimensions": [][]string{{}},
+			"Metrics":    definitions,
+		}},
+	}
+	buf, err := json.Marshal(line)
+	if err != nil {
+		log.Printf("failed to encode metrics: %s", err)
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(buf))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// fleetMTLSProxyURL is the address of the in-process proxy attaching the client certificate to Fleet API calls, empty
+// without mutual TLS. Set in main.
+var fleetMTLSProxyURL string
+
+// fleetAPIURL returns the URL the Fleet client calls: FLEET_URL, or the mutual TLS proxy in front of it.
+func fleetAPIURL() string {
+	if fleetMTLSProxyURL != "" {
+		return fleetMTLSProxyURL
+	}
+	return appConfig.FleetURL
+}
+
+// startFleetMTLSProxy starts a proxy to FLEET_URL presenting the client certificate and key in the Secrets Manager
+// secrets FLEET_CLIENT_CERT_SECRET and FLEET_CLIENT_KEY_SECRET, PEM encoded, and returns its URL. It returns an empty
+// URL if they aren't set. The Fleet client has no way to present a client certificate itself, so it calls the proxy
+// on the loopback interface and the proxy makes the TLS connection to the Fleet server.
+func startFleetMTLSProxy(ctx context.Context, secrets *secretsmanager.Client) (string, error) {
+	certID, keyID := os.Getenv("FLEET_CLIENT_CERT_SECRET"), os.Getenv("FLEET_CLIENT_KEY_SECRET")
+	if certID == "" && keyID == "" {
+		return "", nil
+	}
+	if certID == "" || keyID == "" {
+		return "", errors.New("FLEET_CLIENT_CERT_SECRET and FLEET_CLIENT_KEY_SECRET must both be set")
+	}
+	certPEM, err := secretString(ctx, secrets, certID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Fleet client certificate: %w", err)
+	}
+	keyPEM, err := secretString(ctx, secrets, keyID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Fleet client key: %w", err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return "", fmt.Errorf("invalid Fleet client certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, InsecureSkipVerify: appConfig.FleetInsecureSkipVerify}
+	if appConfig.FleetRootCA != "" {
+		bundle, err := os.ReadFile(appConfig.FleetRootCA)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		tlsConfig.RootCAs.AppendCertsFromPEM(bundle)
+	}
+
+	target, err := url.Parse(appConfig.FleetURL)
+	if err != nil {
+		return "", err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	proxy.Transport = transport
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(listener, proxy); err != nil {
+			log.Printf("fleet mutual TLS proxy stopped: %s", err)
+		}
+	}()
+	log.Printf("calling %s with a client certificate through %s", appConfig.FleetURL, listener.Addr())
+	return "http://" + listener.Addr().String(), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// defaultNotarizeTimeout is how long a submission is waited for unless NOTARIZE_TIMEOUT is set. Apple usually
+// answers within minutes, and the build has to finish within the Lambda timeout.
+const defaultNotarizeTimeout = 10 * time.Minute
+
+// notarizer submits signed pkgs to Apple's Notary API and staples the ticket, it's nil unless MACOS_NOTARIZE is set.
+var notarizer *appleNotarizer
+
+// appleNotarizer notarizes with the tooling of the configured MACOS_SIGNER: rcodesign anywhere, or notarytool and
+// stapler on a macOS build backend. Both authenticate with an App Store Connect API key.
+type appleNotarizer struct {
+	signer   string
+	dir      string
+	keyID    string
+	issuer   string
+	timeout  time.Duration
+	keyPath  string
+	jsonPath string
+}
+
+// newAppleNotarizer returns the notarizer for the App Store Connect API key whose .p8 private key is in the Secrets
+// Manager secret APP_STORE_CONNECT_API_KEY_SECRET, or nil unless MACOS_NOTARIZE is set. The key is identified by
+// APP_STORE_CONNECT_API_KEY_ID and APP_STORE_CONNECT_API_ISSUER.
+func newAppleNotarizer(ctx context.Context, secrets *secretsmanager.Client) (*appleNotarizer, error) {
+	if enabled, _ := strconv.ParseBool(os.Getenv("MACOS_NOTARIZE")); !enabled {
+		return nil, nil
+	}
+	n := &appleNotarizer{
+		signer:  os.Getenv("MACOS_SIGNER"),
+		keyID:   os.Getenv("APP_STORE_CONNECT_API_KEY_ID"),
+		issuer:  os.Getenv("APP_STORE_CONNECT_API_ISSUER"),
+		timeout: defaultNotarizeTimeout,
+	}
+	if n.signer == "" {
+		return nil, errors.New("MACOS_NOTARIZE requires MACOS_SIGNER, Apple only notarizes signed pkgs")
+	}
+	secretID := os.Getenv("APP_STORE_CONNECT_API_KEY_SECRET")
+	if secretID == "" || n.keyID == "" || n.issuer == "" {
+		return nil, errors.New("APP_STORE_CONNECT_API_KEY_SECRET, APP_STORE_CONNECT_API_KEY_ID and APP_STORE_CONNECT_API_ISSUER must be set to notarize")
+	}
+	if v := os.Getenv("NOTARIZE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid NOTARIZE_TIMEOUT %q, must be a positive duration", v)
+		}
+		n.timeout = d
+	}
+	privateKey, err := secretString(ctx, secrets, secretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get App Store Connect API key: %w", err)
+	}
+	n.dir, err = os.MkdirTemp("", "notarize")
+	if err != nil {
+		return nil, err
+	}
+	n.keyPath = filepath.Join(n.dir, fmt.Sprintf("AuthKey_%s.p8", n.keyID))
+	if err := os.WriteFile(n.keyPath, []byte(privateKey), 0o600); err != nil {
+		return nil, err
+	}
+	if n.signer == macOSSignerRcodesign {
+		// rcodesign reads the key, its ID and issuer from a single JSON file
+		n.jsonPath = filepath.Join(n.dir, "key.json")
+		if _, err := runNotaryTool("rcodesign", "encode-app-store-connect-api-key", "--output-path", n.jsonPath, n.issuer, n.keyID, n.keyPath); err != nil {
+			return nil, fmt.Errorf("failed to encode App Store Connect API key: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// notarize submits a signed pkg to the Notary API, waits for Apple to accept it and staples the ticket to the pkg in
+// place, so Gatekeeper can verify it offline. Other package types are left alone.
+func (n *appleNotarizer) notarize(packageType string, path string) error {
+	if packageType != "pkg" {
+		return nil
+	}
+	if n.signer == macOSSignerRcodesign {
+		if _, err := runNotaryTool("rcodesign", "notary-submit", "--api-key-path", n.jsonPath,
+			"--wait", "--max-wait-seconds", strconv.Itoa(int(n.timeout.Seconds())), "--staple", path); err != nil {
+			return fmt.Errorf("failed to notarize pkg: %w", err)
+		}
+		return nil
+	}
+
+	out, err := runNotaryTool("xcrun", "notarytool", "submit", path, "--key", n.keyPath, "--key-id", n.keyID, "--issuer", n.issuer,
+		"--wait", "--timeout", n.timeout.String(), "--output-format", "json")
+	if err != nil {
+		return fmt.Errorf("failed to notarize pkg: %w", err)
+	}
+	// notarytool exits successfully for rejected submissions too, the outcome is in its status
+	var submission struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(out), &submission); err != nil {
+		return fmt.Errorf("failed to parse notarytool output: %w", err)
+	}
+	if submission.Status != "Accepted" {
+		return fmt.Errorf("failed to notarize pkg: submission %s is %s, see xcrun notarytool log %s", submission.ID, submission.Status, submission.ID)
+	}
+	if _, err := runNotaryTool("xcrun", "stapler", "staple", path); err != nil {
+		return fmt.Errorf("failed to staple notarization ticket: %w", err)
+	}
+	return nil
+}
+
+// runNotaryTool runs a notarization command and returns its output.
+func runNotaryTool(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// Sources a packaging option's value is resolved from, a request's fields override a deployment's env defaults,
+// which override the built-in defaults.
+const (
+	optionSourceDefault = "default"
+	optionSourceEnv     = "env"
+	optionSourceRequest = "request"
+	// optionSourceInstance is the named Fleet instance a request builds installers for.
+	optionSourceInstance = "fleet_instance"
+)
+
+// packagingOptionFields are the packaging options whose source is reported, by their packaging.Options field name.
+var packagingOptionFields = []string{
+	"FleetURL", "UpdateURL", "OrbitChannel", "OsquerydChannel", "DesktopChannel", "Desktop", "OrbitUpdateInterval",
+	"HostIdentifier", "DisableUpdates", "EnableScripts", "EndUserEmail", "UseSystemConfiguration", "Debug",
+	"OsqueryFlagfile", "FleetCertificate", "UpdateRoots",
+}
+
+// envPackagingOption is a packaging option a deployment sets the default of with an env var.
+type envPackagingOption struct {
+	field string
+	env   string
+	set   func(options *packaging.Options, value string) error
+}
+
+// envPackagingOptions lists the packaging options with env defaults.
+var envPackagingOptions = []envPackagingOption{
+	{"FleetURL", "FLEET_SERVER_URL", func(options *packaging.Options, value string) error {
+		options.FleetURL = value
+		return nil
+	}},
+	{"UpdateURL", "TUF_UPDATE_URL", func(options *packaging.Options, value string) error {
+		options.UpdateURL = value
+		return validateUpdateURL(value)
+	}},
+	{"OrbitChannel", "ORBIT_CHANNEL", channelOption(func(options *packaging.Options) *string { return &options.OrbitChannel })},
+	{"OsquerydChannel", "OSQUERYD_CHANNEL", channelOption(func(options *packaging.Options) *string { return &options.OsquerydChannel })},
+	{"DesktopChannel", "DESKTOP_CHANNEL", channelOption(func(options *packaging.Options) *string { return &options.DesktopChannel })},
+	{"Desktop", "FLEET_DESKTOP", func(options *packaging.Options, value string) error {
+		desktop, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		options.Desktop = desktop
+		return nil
+	}},
+	{"OrbitUpdateInterval", "ORBIT_UPDATE_INTERVAL", func(options *packaging.Options, value string) error {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < minOrbitUpdateInterval || interval > maxOrbitUpdateInterval {
+			return fmt.Errorf("invalid interval %q, must be a duration between %s and %s", value, minOrbitUpdateInterval, maxOrbitUpdateInterval)
+		}
+		options.OrbitUpdateInterval = interval
+		return nil
+	}},
+	{"HostIdentifier", "HOST_IDENTIFIER", func(options *packaging.Options, value string) error {
+		if !isSupported(hostIdentifiers, value) {
+			return fmt.Errorf("unsupported host identifier %q, must be one of: %s", value, strings.Join(hostIdentifiers, ", "))
+		}
+		options.HostIdentifier = value
+		return nil
+	}},
+}
+
+// channelOption returns the setter of an agent component's channel option.
+func channelOption(channel func(options *packaging.Options) *string) func(*packaging.Options, string) error {
+	return func(options *packaging.Options, value string) error {
+		if !isSupported(agentChannels, value) {
+			return fmt.Errorf("unsupported channel %q, must be one of: %s", value, strings.Join(agentChannels, ", "))
+		}
+		*channel(options) = value
+		return nil
+	}
+}
+
+// builtinPackagingOptions returns the options every installer is built with unless the deployment or the request
+// overrides them.
+func builtinPackagingOptions() packaging.Options {
+	return packaging.Options{
+		UpdateURL:           defaultUpdateURL,
+		Identifier:          "com.fleetdm.orbit",
+		StartService:        true,
+		NativeTooling:       true,
+		OrbitChannel:        "stable",
+		OsquerydChannel:     "stable",
+		DesktopChannel:      "stable",
+		OrbitUpdateInterval: defaultOrbitUpdateInterval,
+	}
+}
+
+// loadPackagingDefaults returns the built-in packaging options with the deployment's env defaults applied, and the
+// source of every option. Invalid env vars are recorded in cerr.
+func loadPackagingDefaults(cerr *configError) (packaging.Options, map[string]string) {
+	options := builtinPackagingOptions()
+	sources := map[string]string{}
+	for _, field := range packagingOptionFields {
+		sources[field] = optionSourceDefault
+	}
+	for _, option := range envPackagingOptions {
+		value := os.Getenv(option.env)
+		if value == "" {
+			continue
+		}
+		if err := option.set(&options, value); err != nil {
+			cerr.check(option.env, err)
+			continue
+		}
+		sources[option.field] = optionSourceEnv
+	}
+	return options, sources
+}
+
+// resolvePackagingOptions returns the options a request's installers are built with and the source of every option,
+// see packagingOptionFields.
+func resolvePackagingOptions(request CreateInstallersRequest) (packaging.Options, map[string]string) {
+	sources := make(map[string]string, len(appConfig.PackagingSources))
+	for field, source := range appConfig.PackagingSources {
+		sources[field] = source
+	}
+	defaults := defaultPackagingOptions("")
+	if instance, ok := fleetInstances[request.FleetInstance]; ok {
+		defaults.FleetURL = instance.ServerURL
+		sources["FleetURL"] = optionSourceInstance
+	}
+	for _, field := range requestedOptionFields(request) {
+		sources[field] = optionSourceRequest
+	}
+	return requestPackagingOptions(defaults, request), sources
+}
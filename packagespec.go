@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// packageSpec is an entry of a request's packages: either a bare package type, e.g. "deb", or an object building the
+// package type with its own architecture and agent settings, e.g. {"type": "msi", "orbit_channel": "edge"}. Settings
+// an object leaves unset fall back to the request's.
+type packageSpec struct {
+	Type string `json:"type"`
+	// Architecture builds the package type for this architecture only, instead of the request's architectures.
+	Architecture    string `json:"architecture,omitempty"`
+	OrbitChannel    string `json:"orbit_channel,omitempty"`
+	OsquerydChannel string `json:"osqueryd_channel,omitempty"`
+	DesktopChannel  string `json:"desktop_channel,omitempty"`
+	OrbitVersion    string `json:"orbit_version,omitempty"`
+	OsquerydVersion string `json:"osqueryd_version,omitempty"`
+	DesktopVersion  string `json:"desktop_version,omitempty"`
+	FleetDesktop    *bool  `json:"fleet_desktop,omitempty"`
+	DisableUpdates  *bool  `json:"disable_updates,omitempty"`
+	EnableScripts   *bool  `json:"enable_scripts,omitempty"`
+	Debug           *bool  `json:"debug,omitempty"`
+}
+
+// UnmarshalJSON accepts a bare package type or an object. Objects are new, so their unknown fields are always
+// rejected.
+func (s *packageSpec) UnmarshalJSON(data []byte) error {
+	var packageType string
+	if err := json.Unmarshal(data, &packageType); err == nil {
+		*s = packageSpec{Type: packageType}
+		return nil
+	}
+	type plain packageSpec
+	var spec plain
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return fmt.Errorf("package must be a package type or an object: %w", err)
+	}
+	*s = packageSpec(spec)
+	return nil
+}
+
+// MarshalJSON writes a spec without overrides as its bare package type, so requests listing package types hash and
+// record the same as before specs could be objects.
+func (s packageSpec) MarshalJSON() ([]byte, error) {
+	if s == (packageSpec{Type: s.Type}) {
+		return json.Marshal(s.Type)
+	}
+	type plain packageSpec
+	return json.Marshal(plain(s))
+}
+
+// apply returns options with the spec's agent settings applied over the request's.
+func (s packageSpec) apply(options packaging.Options) packaging.Options {
+	for _, component := range []struct {
+		channel *string
+		values  []string
+	}{
+		{&options.OrbitChannel, []string{s.OrbitChannel, s.OrbitVersion}},
+		{&options.OsquerydChannel, []string{s.OsquerydChannel, s.OsquerydVersion}},
+		{&options.DesktopChannel, []string{s.DesktopChannel, s.DesktopVersion}},
+	} {
+		for _, v := range component.values {
+			if v != "" {
+				*component.channel = v
+			}
+		}
+	}
+	for _, flag := range []struct {
+		option *bool
+		value  *bool
+	}{
+		{&options.Desktop, s.FleetDesktop},
+		{&options.DisableUpdates, s.DisableUpdates},
+		{&options.EnableScripts, s.EnableScripts},
+		{&options.Debug, s.Debug},
+	} {
+		if flag.value != nil {
+			*flag.option = *flag.value
+		}
+	}
+	return options
+}
+
+// components returns the agent components the spec overrides.
+func (s packageSpec) components() []agentComponent {
+	return []agentComponent{
+		{"orbit", s.OrbitChannel, s.OrbitVersion},
+		{"osqueryd", s.OsquerydChannel, s.OsquerydVersion},
+		{"desktop", s.DesktopChannel, s.DesktopVersion},
+	}
+}
+
+// validatePackageSpec checks the overrides of a request's package, reported under field.
+func validatePackageSpec(verr *validationError, field string, spec packageSpec) {
+	if spec.Architecture != "" && isSupportedPackageType(spec.Type) && !isSupportedArchitecture(spec.Type, spec.Architecture) {
+		verr.add(field+".architecture", "%s installers can't be built for %q, must be one of: %s", spec.Type, spec.Architecture, strings.Join(packageArchitectures[spec.Type], ", "))
+	}
+	validateAgentComponents(verr, field+".", spec.components())
+	if spec.FleetDesktop != nil && !*spec.FleetDesktop && (spec.DesktopChannel != "" || spec.DesktopVersion != "") {
+		verr.add(field+".fleet_desktop", "must not be false with desktop_channel or desktop_version")
+	}
+}
+
+// allPackageTypes is the package type standing for every package type the deployment builds.
+const allPackageTypes = "all"
+
+// expandPackageSpecs replaces an "all" entry of a request's packages with an entry for every package type the
+// deployment builds, with the entry's settings. Package types listed on their own keep their own entry.
+func expandPackageSpecs(specs []packageSpec) []packageSpec {
+	listed := map[string]bool{}
+	for _, spec := range specs {
+		listed[spec.Type] = true
+	}
+	if !listed[allPackageTypes] {
+		return specs
+	}
+	var expanded []packageSpec
+	for _, spec := range specs {
+		if spec.Type != allPackageTypes {
+			expanded = append(expanded, spec)
+			continue
+		}
+		for _, packageType := range enabledPackageTypes {
+			if !listed[packageType] {
+				listed[packageType] = true
+				typed := spec
+				typed.Type = packageType
+				expanded = append(expanded, typed)
+			}
+		}
+	}
+	return expanded
+}
+
+// packageTypes returns the package types of a request's packages.
+func packageTypes(specs []packageSpec) []string {
+	types := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		types = append(types, spec.Type)
+	}
+	return types
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPackageSpecJSON(t *testing.T) {
+	disabled := false
+	tests := []struct {
+		name string
+		in   string
+		want packageSpec
+		// out is the JSON the spec marshals to, in if empty.
+		out string
+	}{
+		{name: "package type", in: `"deb"`, want: packageSpec{Type: "deb"}},
+		{name: "object without overrides", in: `{"type":"rpm"}`, want: packageSpec{Type: "rpm"}, out: `"rpm"`},
+		{
+			name: "object with overrides",
+			in:   `{"type":"msi","orbit_channel":"edge","osqueryd_version":"5.9.1"}`,
+			want: packageSpec{Type: "msi", OrbitChannel: "edge", OsquerydVersion: "5.9.1"},
+		},
+		{
+			name: "architecture and disabled desktop",
+			in:   `{"type":"deb","architecture":"arm64","fleet_desktop":false}`,
+			want: packageSpec{Type: "deb", Architecture: archArm64, FleetDesktop: &disabled},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var spec packageSpec
+			if err := json.Unmarshal([]byte(tt.in), &spec); err != nil {
+				t.Fatalf("Unmarshal(%s) failed: %s", tt.in, err)
+			}
+			if !reflect.DeepEqual(spec, tt.want) {
+				t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.in, spec, tt.want)
+			}
+			buf, err := json.Marshal(spec)
+			if err != nil {
+				t.Fatalf("Marshal(%+v) failed: %s", spec, err)
+			}
+			want := tt.out
+			if want == "" {
+				want = tt.in
+			}
+			if string(buf) != want {
+				t.Errorf("Marshal(%+v) = %s, want %s", spec, buf, want)
+			}
+		})
+	}
+}
+
+func TestPackageSpecUnmarshalInvalid(t *testing.T) {
+	for _, in := range []string{`1`, `["deb"]`, `{"type":"deb","orbit":"edge"}`} {
+		var spec packageSpec
+		if err := json.Unmarshal([]byte(in), &spec); err == nil {
+			t.Errorf("Unmarshal(%s) = %+v, want an error", in, spec)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+// downloadPageFileName is the file name download pages are uploaded as, rendered into the key template like an
+// installer's file name.
+const downloadPageFileName = "index.html"
+
+// defaultDownloadPageAccentColor is the color of the download page's header and buttons unless overridden with
+// DOWNLOAD_PAGE_ACCENT_COLOR.
+const defaultDownloadPageAccentColor = "#6a67fe"
+
+// downloadPageTemplate renders a team's download page, html/template escapes every value.
+var downloadPageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; color: #192147; }
+header { background: {{.AccentColor}}; color: #fff; padding: 24px 32px; display: flex; align-items: center; gap: 16px; }
+header img { height: 40px; }
+main { padding: 32px; max-width: 800px; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 12px 8px; border-bottom: 1px solid #e2e4ea; vertical-align: top; }
+code { font-size: 12px; word-break: break-all; }
+a.download { background: {{.AccentColor}}; color: #fff; padding: 8px 16px; border-radius: 4px; text-decoration: none; white-space: nowrap; }
+footer { color: #8b8fa2; font-size: 12px; padding: 0 32px 32px; }
+</style>
+</head>
+<body>
+<header>{{if .LogoURL}}<img src="{{.LogoURL}}" alt="">{{end}}<h1>{{.Title}}</h1></header>
+<main>
+<p>Download the installer for your operating system to enroll your device in {{.TeamName}}.</p>
+<table>
+<tr><th>Installer</th><th>SHA-256</th><th></th></tr>
+{{range .Installers}}<tr><td>{{.Name}}<br>{{.File}}</td><td><code>{{.SHA256}}</code></td><td><a class="download" href="{{.URL}}">Download</a></td></tr>
+{{end}}</table>
+</main>
+<footer>Built {{.BuiltAt.Format "2006-01-02 15:04 MST"}}.{{if not .ExpiresAt.IsZero}} Links expire {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.{{end}}</footer>
+</body>
+</html>
+`))
+
+// packageDisplayNames names the platform installers of each package type are for on download pages.
+var packageDisplayNames = map[string]string{
+	"deb": "Linux (Debian, Ubuntu)",
+	"rpm": "Linux (Fedora, RHEL, CentOS)",
+	"pkg": "macOS",
+	"msi": "Windows",
+}
+
+// downloadPage holds the values download pages are rendered with.
+type downloadPage struct {
+	Title       string
+	TeamName    string
+	LogoURL     string
+	AccentColor template.CSS
+	Installers  []downloadPageInstaller
+	BuiltAt     time.Time
+	// ExpiresAt is when the first download link expires.
+	ExpiresAt time.Time
+}
+
+// downloadPageInstaller is an installer listed on a download page.
+type downloadPageInstaller struct {
+	Name   string
+	File   string
+	SHA256 string
+	URL    string
+}
+
+// downloadPageEnabled reports whether download pages are rendered, set DOWNLOAD_PAGE to enable them.
+func downloadPageEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("DOWNLOAD_PAGE"))
+	return enabled
+}
+
+// downloadPageKey returns the key of the download page of job's team, rendered from the key template with the page's
+// file name.
+func downloadPageKey(job buildJob) (string, error) {
+	return objectKey(job.KeyTemplate, newObjectKeyData(job, downloadPageFileName, time.Now()))
+}
+
+// writeDownloadPage renders the download page of a request's installers, uploads it next to them and returns a link
+// to it. The installers are linked with the links of downloadLink, so the page stops working once they expire and
+// is rendered again by the next build. Nothing is written when no installer was uploaded.
+func writeDownloadPage(ctx context.Context, teamName string, jobs []buildJob, results []PackageResult) (string, error) {
+	title := os.Getenv("DOWNLOAD_PAGE_TITLE")
+	if title == "" {
+		title = fmt.Sprintf("%s installers", teamName)
+	}
+	accentColor := os.Getenv("DOWNLOAD_PAGE_ACCENT_COLOR")
+	if accentColor == "" {
+		accentColor = defaultDownloadPageAccentColor
+	}
+	page := downloadPage{
+		Title:       title,
+		TeamName:    teamName,
+		LogoURL:     os.Getenv("DOWNLOAD_PAGE_LOGO_URL"),
+		AccentColor: template.CSS(accentColor),
+		BuiltAt:     time.Now().UTC(),
+	}
+	for _, result := range results {
+		if result.Status != packageStatusSucceeded {
+			continue
+		}
+		link, expires, err := downloadLink(ctx, result.Key)
+		if err != nil {
+			return "", fmt.Errorf("failed to link %s on the download page: %w", result.Package, err)
+		}
+		if page.ExpiresAt.IsZero() || expires.Before(page.ExpiresAt) {
+			page.ExpiresAt = expires.UTC()
+		}
+		name := packageDisplayNames[result.Package]
+		if name == "" {
+			name = result.Package
+		}
+		if packageLabel(result.Package, result.Architecture) != result.Package {
+			name = fmt.Sprintf("%s, %s", name, result.Architecture)
+		}
+		page.Installers = append(page.Installers, downloadPageInstaller{Name: name, File: path.Base(result.Key), SHA256: result.SHA256, URL: link})
+	}
+	if len(page.Installers) == 0 {
+		return "", nil
+	}
+
+	var buf bytes.Buffer
+	if err := downloadPageTemplate.Execute(&buf, page); err != nil {
+		return "", fmt.Errorf("failed to render download page: %w", err)
+	}
+	key, err := downloadPageKey(jobs[0])
+	if err != nil {
+		return "", err
+	}
+	if err := artifactStore.PutObject(ctx, key, buf.Bytes(), "text/html; charset=utf-8", jobs[0]); err != nil {
+		return "", fmt.Errorf("failed to write download page: %w", err)
+	}
+	log.Printf("wrote download page %s", key)
+	link, _, err := downloadLink(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return link, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// buildSlots bounds how many installers of a request are built at once. A build holds a slot while it packages and
+// signs its installer and gives it up before uploading it, so the next build overlaps the upload. A nil buildSlots
+// doesn't bound anything.
+type buildSlots chan struct{}
+
+func newBuildSlots(n int) buildSlots {
+	if n < 1 {
+		n = 1
+	}
+	return make(buildSlots, n)
+}
+
+func (s buildSlots) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s buildSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// buildConcurrency returns how many installers are built at once at most: BUILD_CONCURRENCY, or one per CPU the
+// function has, which its memory setting determines.
+func buildConcurrency() (int, error) {
+	v := os.Getenv("BUILD_CONCURRENCY")
+	if v == "" {
+		return runtime.NumCPU(), nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid BUILD_CONCURRENCY %q, must be a positive number", v)
+	}
+	return n, nil
+}
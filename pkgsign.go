@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+const (
+	// macOSSignerRcodesign signs with rcodesign and a certificate from Secrets Manager, on any platform.
+	macOSSignerRcodesign = "rcodesign"
+	// macOSSignerProductsign delegates signing to productsign and a keychain identity, on a macOS build backend.
+	macOSSignerProductsign = "productsign"
+)
+
+// pkgSigner signs pkg installers with a Developer ID Installer certificate after they're built, it's nil unless
+// MACOS_SIGNER is set.
+var pkgSigner installerSigner
+
+// installerSigner signs a built package in place, leaving package types it doesn't sign alone.
+type installerSigner interface {
+	signPackage(packageType string, path string) error
+}
+
+// newMacOSSigner returns the pkg signer selected with MACOS_SIGNER: "rcodesign" or "productsign", or nil if it isn't
+// set.
+func newMacOSSigner(ctx context.Context, secrets *secretsmanager.Client) (installerSigner, error) {
+	switch signer := os.Getenv("MACOS_SIGNER"); signer {
+	case "":
+		return nil, nil
+	case macOSSignerRcodesign:
+		return newRcodesignSigner(ctx, secrets)
+	case macOSSignerProductsign:
+		return newProductsignSigner()
+	default:
+		return nil, fmt.Errorf("unsupported MACOS_SIGNER %q, must be one of: %s, %s", signer, macOSSignerRcodesign, macOSSignerProductsign)
+	}
+}
+
+// rcodesignSigner signs pkgs with rcodesign using a PKCS#12 Developer ID Installer certificate, without a Mac.
+type rcodesignSigner struct {
+	dir string
+}
+
+// newRcodesignSigner returns the signer for the PKCS#12 certificate in the Secrets Manager secret
+// MACOS_DEVID_CERT_SECRET, stored as a binary secret or base64 encoded in a string secret. Its password is read from
+// the secret MACOS_DEVID_CERT_PASSWORD_SECRET.
+func newRcodesignSigner(ctx context.Context, secrets *secretsmanager.Client) (*rcodesignSigner, error) {
+	secretID := os.Getenv("MACOS_DEVID_CERT_SECRET")
+	if secretID == "" {
+		return nil, errors.New("MACOS_DEVID_CERT_SECRET must be set to sign with rcodesign")
+	}
+	cert, err := secretBytes(ctx, secrets, secretID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Developer ID certificate: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "rcodesign")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cert.p12"), cert, 0o600); err != nil {
+		return nil, err
+	}
+	var password string
+	if passwordID := os.Getenv("MACOS_DEVID_CERT_PASSWORD_SECRET"); passwordID != "" {
+		password, err = secretString(ctx, secrets, passwordID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Developer ID certificate password: %w", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte(password), 0o600); err != nil {
+		return nil, err
+	}
+	return &rcodesignSigner{dir: dir}, nil
+}
+
+// signPackage signs a built pkg in place, timestamped by Apple's timestamp server. Other package types are left alone.
+func (s *rcodesignSigner) signPackage(packageType string, path string) error {
+	if packageType != "pkg" {
+		return nil
+	}
+	return signToFile(path, "rcodesign", "sign",
+		"--p12-file", filepath.Join(s.dir, "cert.p12"),
+		"--p12-password-file", filepath.Join(s.dir, "password"),
+		path, path+".signed",
+	)
+}
+
+// productsignSigner signs pkgs with productsign using a Developer ID Installer identity from the build backend's
+// keychain. It only runs on macOS.
+type productsignSigner struct {
+	identity string
+	keychain string
+}
+
+// newProductsignSigner returns the signer for the keychain identity MACOS_SIGN_IDENTITY, e.g.
+// "Developer ID Installer: Example Inc (ABCDE12345)", looked up in MACOS_SIGN_KEYCHAIN or the default keychain.
+func newProductsignSigner() (*productsignSigner, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, fmt.Errorf("MACOS_SIGNER %s requires a macOS build backend", macOSSignerProductsign)
+	}
+	identity := os.Getenv("MACOS_SIGN_IDENTITY")
+	if identity == "" {
+		return nil, errors.New("MACOS_SIGN_IDENTITY must be set to sign with productsign")
+	}
+	return &productsignSigner{identity: identity, keychain: os.Getenv("MACOS_SIGN_KEYCHAIN")}, nil
+}
+
+// signPackage signs a built pkg in place with a secure timestamp. Other package types are left alone.
+func (s *productsignSigner) signPackage(packageType string, path string) error {
+	if packageType != "pkg" {
+		return nil
+	}
+	args := []string{"--sign", s.identity, "--timestamp"}
+	if s.keychain != "" {
+		args = append(args, "--keychain", s.keychain)
+	}
+	return signToFile(path, "productsign", append(args, path, path+".signed")...)
+}
+
+// signToFile runs a signing tool writing the signed package to path.signed, and replaces the package at path with it.
+func signToFile(path string, name string, args ...string) error {
+	signed := path + ".signed"
+	cmd := exec.Command(name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(signed)
+		return fmt.Errorf("failed to sign pkg: %s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(signed, path)
+}
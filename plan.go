@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+	"github.com/fleetdm/fleet/v4/server/service"
+)
+
+// DryRunPlan describes what a request would do without building or uploading anything.
+type DryRunPlan struct {
+	Team     TeamPlan          `json:"team"`
+	Options  packaging.Options `json:"options"`
+	Packages []PackagePlan     `json:"packages"`
+}
+
+// TeamPlan describes how the request's team would be resolved on the Fleet server.
+type TeamPlan struct {
+	Name    string `json:"name"`
+	Action  string `json:"action"`
+	ID      uint   `json:"id,omitempty"`
+	Warning string `json:"warning,omitempty"`
+}
+
+// PackagePlan describes where a requested installer would be uploaded.
+type PackagePlan struct {
+	Package      string `json:"package"`
+	Architecture string `json:"architecture"`
+	Key          string `json:"key"`
+	URL          string `json:"url"`
+	// Destinations are the URLs the installer would be replicated to.
+	Destinations []string `json:"destinations,omitempty"`
+}
+
+// planInstallers resolves everything a request would do up to, but not including, building and uploading the
+// installers. The Fleet server is only read from, the team is looked up rather than created.
+func planInstallers(ctx context.Context, fleetClient *service.Client, installersRequest CreateInstallersRequest) (events.APIGatewayProxyResponse, error) {
+	var existing *fleet.Team
+	if !installersRequest.Global {
+		var err error
+		existing, err = findTeam(ctx, fleetClient, installersRequest.TeamName)
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, err
+		}
+	}
+	teamPlan := TeamPlan{Name: installersRequest.TeamName, Action: "create"}
+	switch {
+	case installersRequest.Global:
+		teamPlan.Action = "use"
+	case installersRequest.TeamID != 0:
+		teamPlan.ID = installersRequest.TeamID
+		teamPlan.Action = "use"
+	case existing != nil:
+		teamPlan.ID = existing.ID
+		teamPlan.Action = "use"
+	}
+
+	options, sources := resolvePackagingOptions(installersRequest)
+	// the enroll secret is generated by Fleet when the team is created
+	options.EnrollSecret = "<generated>"
+	plan := DryRunPlan{Team: teamPlan, Options: options}
+	if installersRequest.EnrollSecret != "" {
+		plan.Options.EnrollSecret = redacted
+	}
+	for _, cell := range requestCells(installersRequest) {
+		job := buildJob{
+			PackageType:  cell.PackageType,
+			Options:      cell.Spec.apply(plan.Options),
+			TeamName:     installersRequest.TeamName,
+			KeyTemplate:  keyTemplate(installersRequest),
+			NameTemplate: nameTemplate(installersRequest),
+		}
+		job = newArchitectureJob(job, cell.Architecture)
+		// the built file is named by the packaging library, use a representative name for it
+		file, err := artifactFileName(job, representativeFileName(job))
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("%w: %w", ErrBadRequest, err)
+		}
+		key, err := objectKey(job.KeyTemplate, newObjectKeyData(job, file, time.Now()))
+		if err != nil {
+			return events.APIGatewayProxyResponse{}, fmt.Errorf("%w: %w", ErrBadRequest, err)
+		}
+		if artifactLayout() == artifactLayoutContent {
+			// the digest is only known once the installer is built
+			key = contentObjectKey("<digest>", file)
+		}
+		packagePlan := PackagePlan{Package: job.PackageType, Architecture: job.Architecture, Key: key, URL: artifactURL(key)}
+		for _, destination := range artifactDestinations(installersRequest) {
+			store := &s3ArtifactStore{bucket: destination.Bucket, region: destination.Region}
+			packagePlan.Destinations = append(packagePlan.Destinations, store.URL(key))
+		}
+		plan.Packages = append(plan.Packages, packagePlan)
+	}
+
+	response := CreateInstallersResponse{
+		SchemaVersion: currentSchemaVersion,
+		TeamName:      installersRequest.TeamName,
+		Results:       []PackageResult{},
+		DryRun:        &plan,
+	}
+	if responseDebugEnabled() {
+		response.Debug = &ResponseDebug{Options: plan.Options, OptionSources: sources}
+	}
+	return respondJSON(http.StatusOK, response)
+}
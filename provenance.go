@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+const (
+	inTotoStatementType   = "https://in-toto.io/Statement/v0.1"
+	slsaProvenanceType    = "https://slsa.dev/provenance/v0.2"
+	provenanceBuildType   = "urn:fleet-lambda-packager:build:v1"
+	dssePayloadTypeInToto = "application/vnd.in-toto+json"
+)
+
+// inTotoStatement is an in-toto attestation about the installers in Subject.
+type inTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []inTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     slsaProvenance  `json:"predicate"`
+}
+
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// slsaProvenance is a SLSA v0.2 provenance predicate.
+type slsaProvenance struct {
+	Builder    slsaBuilder    `json:"builder"`
+	BuildType  string         `json:"buildType"`
+	Invocation slsaInvocation `json:"invocation"`
+	Metadata   slsaMetadata   `json:"metadata"`
+	Materials  []slsaMaterial `json:"materials"`
+}
+
+type slsaBuilder struct {
+	ID string `json:"id"`
+}
+
+type slsaInvocation struct {
+	Parameters  provenanceParameters `json:"parameters"`
+	Environment map[string]string    `json:"environment"`
+}
+
+// provenanceParameters are the inputs of a build recorded in its provenance, secrets are redacted.
+type provenanceParameters struct {
+	TeamName     string            `json:"team_name"`
+	PackageType  string            `json:"package_type"`
+	Options      packaging.Options `json:"options"`
+	KeyTemplate  string            `json:"key_template"`
+	ArtifactName string            `json:"artifact_name,omitempty"`
+}
+
+type slsaMetadata struct {
+	BuildInvocationID string           `json:"buildInvocationId"`
+	BuildStartedOn    time.Time        `json:"buildStartedOn"`
+	BuildFinishedOn   time.Time        `json:"buildFinishedOn"`
+	Completeness      slsaCompleteness `json:"completeness"`
+	Reproducible      bool             `json:"reproducible"`
+}
+
+type slsaCompleteness struct {
+	Parameters  bool `json:"parameters"`
+	Environment bool `json:"environment"`
+	Materials   bool `json:"materials"`
+}
+
+type slsaMaterial struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// dsseEnvelope is a signed DSSE envelope around an in-toto statement.
+type dsseEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"`
+	Signatures  []dsseSignature `json:"signatures"`
+}
+
+type dsseSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// provenanceEnabled reports whether provenance is attested for installers, set ARTIFACT_PROVENANCE to enable it.
+// Statements are signed with SIGNING_KMS_KEY_ID, which has to be set as well.
+func provenanceEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ARTIFACT_PROVENANCE"))
+	return enabled
+}
+
+// builderID identifies the builder in provenance statements: the ARN of the invoked Lambda function, or the host
+// name when running outside of Lambda.
+func builderID(ctx context.Context) string {
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.InvokedFunctionArn != "" {
+		return lc.InvokedFunctionArn
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "local"
+	}
+	return "local:" + host
+}
+
+// generateProvenance returns the signed SLSA provenance of an installer named name as a DSSE envelope: who built it,
+// from which inputs, and which TUF targets went into it.
+func generateProvenance(ctx context.Context, built artifact, job buildJob, name string, components []component, startedAt time.Time) ([]byte, error) {
+	statement := inTotoStatement{
+		Type:          inTotoStatementType,
+		Subject:       []inTotoSubject{{Name: name, Digest: map[string]string{"sha256": built.SHA256}}},
+		PredicateType: slsaProvenanceType,
+		Predicate: slsaProvenance{
+			Builder:   slsaBuilder{ID: job.BuilderID},
+			BuildType: provenanceBuildType,
+			Invocation: slsaInvocation{
+				Parameters: provenanceParameters{
+					TeamName:     job.TeamName,
+					PackageType:  job.PackageType,
+					Options:      redactOptions(job.Options),
+					KeyTemplate:  job.KeyTemplate,
+					ArtifactName: job.NameTemplate,
+				},
+				Environment: map[string]string{
+					"aws_region":       appConfig.AWSRegion,
+					"function_version": lambdacontext.FunctionVersion,
+				},
+			},
+			Metadata: slsaMetadata{
+				BuildInvocationID: job.BuildID,
+				BuildStartedOn:    startedAt.UTC(),
+				BuildFinishedOn:   time.Now().UTC(),
+				Completeness:      slsaCompleteness{Parameters: true, Materials: true},
+			},
+		},
+	}
+	updateURL := strings.TrimRight(job.Options.UpdateURL, "/")
+	for _, c := range components {
+		statement.Predicate.Materials = append(statement.Predicate.Materials, slsaMaterial{
+			URI:    fmt.Sprintf("%s/targets/%s", updateURL, c.Target),
+			Digest: map[string]string{"sha512": c.SHA512},
+		})
+	}
+
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance: %w", err)
+	}
+	sig, err := artifactSigner.sign(ctx, dssePAE(dssePayloadTypeInToto, payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign provenance: %w", err)
+	}
+	buf, err := json.Marshal(dsseEnvelope{
+		PayloadType: dssePayloadTypeInToto,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []dsseSignature{{KeyID: artifactSigner.keyID, Sig: base64.StdEncoding.EncodeToString(sig)}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance envelope: %w", err)
+	}
+	// the envelope is stored as a single line of JSON Lines, which verifiers like slsa-verifier expect
+	return append(buf, '\n'), nil
+}
+
+// dssePAE returns the DSSE pre-authentication encoding of a payload, the message its signatures are computed over.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
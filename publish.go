@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// artifactPublishDirect uploads installers straight to their keys, the default.
+	artifactPublishDirect = "direct"
+	// artifactPublishStaged uploads installers under a staging prefix first and only copies them to their keys once
+	// every installer of the request was uploaded, so a partially failed request publishes nothing.
+	artifactPublishStaged = "staged"
+
+	publishStatusCompleted = "completed"
+)
+
+// artifactPublishMode returns the publish mode selected with ARTIFACT_PUBLISH.
+func artifactPublishMode() string {
+	if os.Getenv("ARTIFACT_PUBLISH") == artifactPublishStaged {
+		return artifactPublishStaged
+	}
+	return artifactPublishDirect
+}
+
+// stagingPrefix returns the key prefix the installers of a request are staged under.
+func stagingPrefix(buildID string) string {
+	return fmt.Sprintf("staging/%s/", escapeKeySegment(buildID))
+}
+
+// publishManifest commits a staged publish. It's written to the staging prefix once every installer of the request
+// was staged and before any of them is copied to its key, and deleted once the promotion completed or was rolled
+// back, so a manifest left behind lists the copies of an invocation killed mid-promotion.
+type publishManifest struct {
+	BuildID   string           `json:"build_id"`
+	TeamName  string           `json:"team_name"`
+	Status    string           `json:"status"`
+	Artifacts []stagedArtifact `json:"artifacts"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// stagedArtifact is a staged installer and the key it's published to.
+type stagedArtifact struct {
+	Package      string `json:"package"`
+	Architecture string `json:"architecture,omitempty"`
+	// Destination is the bucket of an additional destination, empty for the artifact store.
+	Destination string `json:"destination,omitempty"`
+	// Sidecar is the kind of the installer's sidecar, empty for the installer itself.
+	Sidecar   string `json:"sidecar,omitempty"`
+	StagedKey string `json:"staged_key"`
+	Key       string `json:"key"`
+	SHA256    string `json:"sha256"`
+}
+
+// publishStaged promotes the staged installers of a request to their keys if every package succeeded, and discards
+// them otherwise. A copy failing mid-promotion deletes the copies already made, so a request publishes all of its
+// installers or none. The results of discarded packages are replaced by ErrPublishAborted failures, results of promoted
+// packages point at the published keys.
+func publishStaged(ctx context.Context, teamName string, buildID string, jobs []buildJob, results []PackageResult, errs []error) {
+	prefix := stagingPrefix(buildID)
+	var staged []stagedArtifact
+	for i, result := range results {
+		if !strings.HasPrefix(result.Key, prefix) {
+			continue
+		}
+		arch := jobs[i].Architecture
+		staged = append(staged, stagedArtifact{Package: result.Package, Architecture: arch, StagedKey: result.Key, Key: strings.TrimPrefix(result.Key, prefix), SHA256: result.SHA256})
+		for _, sidecar := range result.Sidecars {
+			staged = append(staged, stagedArtifact{Package: result.Package, Architecture: arch, Sidecar: sidecar.Kind, StagedKey: sidecar.Key, Key: strings.TrimPrefix(sidecar.Key, prefix)})
+		}
+		for _, destination := range result.Destinations {
+			if destination.Status == packageStatusSucceeded {
+				staged = append(staged, stagedArtifact{Package: result.Package, Architecture: arch, Destination: destination.Bucket, StagedKey: destination.Key, Key: strings.TrimPrefix(destination.Key, prefix), SHA256: result.SHA256})
+			}
+		}
+	}
+
+	var abort error
+	for _, err := range errs {
+		if err != nil {
+			abort = fmt.Errorf("%w: another package of the request failed", ErrPublishAborted)
+			break
+		}
+	}
+	if abort == nil {
+		buf, err := json.Marshal(publishManifest{BuildID: buildID, TeamName: teamName, Status: publishStatusCompleted, Artifacts: staged, CreatedAt: time.Now()})
+		if err == nil {
+			err = artifactStore.PutObject(ctx, prefix+"manifest.json", buf, "application/json", jobs[0])
+		}
+		if err != nil {
+			abort = fmt.Errorf("%w: failed to commit publish: %w", ErrPublishAborted, err)
+		}
+	}
+	if abort != nil {
+		log.Printf("discarding staged installers of %s: %s", buildID, abort)
+		discardStaged(ctx, jobs, staged)
+		abortPublish(results, errs, abort)
+		return
+	}
+
+	// copy everything before touching the results, a failed copy rolls back the copies already made
+	var copied []promotedArtifact
+	for i := range results {
+		job := jobs[i]
+		for _, artifact := range staged {
+			// a request builds a package type for several architectures, every cell publishes only its own artifacts
+			if artifact.Package != job.PackageType || artifact.Architecture != job.Architecture {
+				continue
+			}
+			store := stagedArtifactStore(job, artifact)
+			if err := store.CopyObject(ctx, artifact.StagedKey, artifact.Key, job); err != nil {
+				log.Printf("%s: failed to publish %s, rolling back %d published artifacts: %s", job.PackageType, artifact.StagedKey, len(copied), err)
+				rollbackPromoted(ctx, copied)
+				discardStaged(ctx, jobs, staged)
+				abortPublish(results, errs, fmt.Errorf("%w: failed to publish %s: %w", ErrPublishAborted, artifact.Key, err))
+				if err := artifactStore.DeleteObjects(ctx, []string{prefix + "manifest.json"}); err != nil {
+					log.Printf("failed to delete publish manifest of %s: %s", buildID, err)
+				}
+				return
+			}
+			copied = append(copied, promotedArtifact{index: i, artifact: artifact, store: store})
+		}
+	}
+
+	for _, promoted := range copied {
+		i, artifact, store := promoted.index, promoted.artifact, promoted.store
+		job := jobs[i]
+		if err := store.DeleteObjects(ctx, []string{artifact.StagedKey}); err != nil {
+			log.Printf("%s: failed to delete staged %s: %s", job.PackageType, artifact.StagedKey, err)
+		}
+		if artifact.Sidecar != "" {
+			for j := range results[i].Sidecars {
+				if results[i].Sidecars[j].Kind == artifact.Sidecar {
+					results[i].Sidecars[j].Key = artifact.Key
+					results[i].Sidecars[j].URL = store.URL(artifact.Key)
+				}
+			}
+			continue
+		}
+		if artifact.Destination == "" {
+			results[i].Key = artifact.Key
+			results[i].URL = artifactURL(artifact.Key)
+			pruneArtifacts(ctx, artifactStore, job, artifact.Key)
+			continue
+		}
+		for j := range results[i].Destinations {
+			if results[i].Destinations[j].Bucket == artifact.Destination {
+				results[i].Destinations[j].Key = artifact.Key
+				results[i].Destinations[j].URL = store.URL(artifact.Key)
+			}
+		}
+	}
+	if err := artifactStore.DeleteObjects(ctx, []string{prefix + "manifest.json"}); err != nil {
+		log.Printf("failed to delete publish manifest of %s: %s", buildID, err)
+	}
+}
+
+// promotedArtifact is a staged artifact copied to its key for the result at index.
+type promotedArtifact struct {
+	index    int
+	artifact stagedArtifact
+	store    ArtifactStore
+}
+
+// rollbackPromoted deletes the artifacts a failed promotion already copied to their keys.
+func rollbackPromoted(ctx context.Context, copied []promotedArtifact) {
+	for _, promoted := range copied {
+		if err := promoted.store.DeleteObjects(ctx, []string{promoted.artifact.Key}); err != nil {
+			log.Printf("failed to roll back published %s: %s", promoted.artifact.Key, err)
+		}
+	}
+}
+
+// abortPublish replaces the results of the packages that succeeded with abort.
+func abortPublish(results []PackageResult, errs []error, abort error) {
+	class := classifyError(abort)
+	for i := range results {
+		if errs[i] != nil {
+			continue
+		}
+		errs[i] = abort
+		results[i] = PackageResult{Package: results[i].Package, Status: packageStatusFailed, Error: abort.Error(), Code: class.code, Retryable: class.retryable}
+	}
+}
+
+// discardStaged deletes staged installers that won't be published.
+func discardStaged(ctx context.Context, jobs []buildJob, staged []stagedArtifact) {
+	for _, artifact := range staged {
+		if err := stagedArtifactStore(jobs[0], artifact).DeleteObjects(ctx, []string{artifact.StagedKey}); err != nil {
+			log.Printf("failed to delete staged %s: %s", artifact.StagedKey, err)
+		}
+	}
+}
+
+// stagedArtifactStore returns the store a staged artifact was uploaded to.
+func stagedArtifactStore(job buildJob, artifact stagedArtifact) ArtifactStore {
+	if artifact.Destination == "" {
+		return artifactStore
+	}
+	for _, destination := range job.Destinations {
+		if destination.Bucket == artifact.Destination {
+			return &s3ArtifactStore{bucket: destination.Bucket, region: destination.Region}
+		}
+	}
+	return &s3ArtifactStore{bucket: artifact.Destination}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+)
+
+// rebuildMinRemaining is the time an invocation must have left to start rebuilding another team, teams left over are
+// rebuilt by the next scheduled run.
+const rebuildMinRemaining = 3 * time.Minute
+
+// RebuildReport reports a scheduled rebuild.
+type RebuildReport struct {
+	SchemaVersion string        `json:"schema_version"`
+	Teams         []RebuiltTeam `json:"teams"`
+	Skipped       []string      `json:"skipped"`
+	Deferred      []string      `json:"deferred"`
+}
+
+// RebuiltTeam is a team a scheduled rebuild built installers for, and the status code of its build.
+type RebuiltTeam struct {
+	TeamName   string `json:"team_name"`
+	StatusCode int    `json:"status_code"`
+}
+
+// lambdaHandler dispatches an invocation's payload to handleScheduledRebuild for EventBridge scheduled events, or to
+// handleTUFWatch for the TUF_WATCH_RULE's, and to handler for API Gateway requests.
+func lambdaHandler(ctx context.Context, payload json.RawMessage) (any, error) {
+	var envelope struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err == nil && envelope.DetailType == "Scheduled Event" {
+		var event events.CloudWatchEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		if isTUFWatchEvent(event) {
+			return handleTUFWatch(ctx)
+		}
+		return handleScheduledRebuild(ctx, event)
+	}
+	var event events.APIGatewayProxyRequest
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return handler(ctx, event)
+}
+
+// handleScheduledRebuild rebuilds the installers of every team in the global index, so published installers bundle
+// current agent versions. Teams are rebuilt with the package types and architectures they have installers for, and
+// their team defaults, least recently built first and one at a time like batch builds. Teams deleted from the Fleet
+// server are skipped, teams that don't fit in the invocation's remaining time are deferred to the next run.
+func handleScheduledRebuild(ctx context.Context, event events.CloudWatchEvent) (RebuildReport, error) {
+	log.Printf("scheduled rebuild %s started by %s", event.ID, strings.Join(event.Resources, ", "))
+	return rebuildTeams(ctx, time.Time{})
+}
+
+// rebuildTeams rebuilds the teams of the global index, only those whose installers were built before since unless
+// it's zero.
+func rebuildTeams(ctx context.Context, since time.Time) (RebuildReport, error) {
+	global := globalIndex{}
+	if err := getIndex(ctx, globalIndexKey, &global); err != nil {
+		return RebuildReport{}, err
+	}
+	report := RebuildReport{SchemaVersion: currentSchemaVersion, Teams: []RebuiltTeam{}, Skipped: []string{}, Deferred: []string{}}
+	// teams are reported by their global index key, which tells teams of the same name on different instances apart
+	for _, key := range rebuildOrder(global) {
+		teamName := global.Teams[key].teamName(key)
+		if !since.IsZero() && !builtBefore(global.Teams[key], since) {
+			continue
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < rebuildMinRemaining {
+			report.Deferred = append(report.Deferred, key)
+			continue
+		}
+		request := rebuildRequest(global.Teams[key])
+		if teamName == globalTeamName {
+			request.Global = true
+		} else {
+			team, err := rebuildTeam(ctx, request.FleetInstance, teamName)
+			if err != nil {
+				return report, err
+			}
+			if team == nil {
+				log.Printf("team %s no longer exists, not rebuilding its installers", key)
+				report.Skipped = append(report.Skipped, key)
+				continue
+			}
+			request.TeamName = teamName
+			request.UseExistingTeam = true
+		}
+		request, err := applyTeamDefaults(ctx, request)
+		if err != nil {
+			return report, err
+		}
+		request.Packages = expandPackageSpecs(request.Packages)
+		statusCode := http.StatusOK
+		if err := validateRequest(request); err != nil {
+			log.Printf("not rebuilding team %s: %s", key, err)
+			statusCode = classifyError(err).statusCode
+		} else {
+			response, err := invoke(ctx, request)
+			if err != nil {
+				response, _ = respondError(err)
+			}
+			statusCode = response.StatusCode
+		}
+		report.Teams = append(report.Teams, RebuiltTeam{TeamName: key, StatusCode: statusCode})
+	}
+	if len(report.Deferred) > 0 {
+		log.Printf("deferred rebuilding %d teams to the next run: %s", len(report.Deferred), strings.Join(report.Deferred, ", "))
+	}
+	return report, nil
+}
+
+// rebuildTeam looks up a team to rebuild on the Fleet instance it's on, nil if it no longer exists.
+func rebuildTeam(ctx context.Context, instance string, teamName string) (*fleet.Team, error) {
+	ctx = withFleetInstance(ctx, instance)
+	fleetClient, err := newFleetClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return findTeam(ctx, fleetClient, teamName)
+}
+
+// builtBefore reports whether any of a team's indexed installers was built before t.
+func builtBefore(team globalIndexTeam, t time.Time) bool {
+	for _, entry := range team.Packages {
+		if entry.UpdatedAt.Before(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// rebuildOrder returns the keys of the teams of the global index, least recently built first.
+func rebuildOrder(global globalIndex) []string {
+	builtAt := map[string]time.Time{}
+	teams := make([]string, 0, len(global.Teams))
+	for key, team := range global.Teams {
+		teams = append(teams, key)
+		for _, entry := range team.Packages {
+			if at, ok := builtAt[key]; !ok || entry.UpdatedAt.Before(at) {
+				builtAt[key] = entry.UpdatedAt
+			}
+		}
+	}
+	sort.Slice(teams, func(i, j int) bool {
+		if !builtAt[teams[i]].Equal(builtAt[teams[j]]) {
+			return builtAt[teams[i]].Before(builtAt[teams[j]])
+		}
+		return teams[i] < teams[j]
+	})
+	return teams
+}
+
+// rebuildRequest returns a request rebuilding the installers indexed for a team: every package type it has, for every
+// architecture it has installers of. Index entries are named after the package type, with the architecture appended
+// for other than the default one, see indexEntryName.
+func rebuildRequest(team globalIndexTeam) CreateInstallersRequest {
+	request := CreateInstallersRequest{ForceRebuild: true, SkipUnchanged: true, FleetInstance: team.FleetInstance}
+	types := map[string]bool{}
+	architectures := map[string]bool{}
+	matrix := false
+	for name, entry := range team.Packages {
+		packageType, _, nonDefault := strings.Cut(name, "-")
+		if !types[packageType] {
+			types[packageType] = true
+			request.Packages = append(request.Packages, packageSpec{Type: packageType})
+		}
+		if entry.Architecture != "" {
+			architectures[entry.Architecture] = true
+		}
+		matrix = matrix || nonDefault
+	}
+	sort.Slice(request.Packages, func(i, j int) bool { return request.Packages[i].Type < request.Packages[j].Type })
+	if matrix {
+		for architecture := range architectures {
+			request.Architectures = append(request.Architectures, architecture)
+		}
+		sort.Strings(request.Architectures)
+	}
+	return request
+}
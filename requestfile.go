@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// requestFilesDir is where files supplied with requests are written for the packaging library, which takes paths.
+// They're removed with the rest of the build workspace once the request is done.
+const requestFilesDir = buildWorkspaceRoot + "/request-files"
+
+// requestFile is a file a request supplies for its installers, either inline or as an S3 object.
+type requestFile struct {
+	// Content is the file's base64 encoded content.
+	Content string `json:"content,omitempty"`
+	// S3URI is the S3 object the file is read from, e.g. s3://bucket/osquery.flags.
+	S3URI string `json:"s3_uri,omitempty"`
+}
+
+// validate checks exactly one of the file's sources is set and well-formed, reporting problems under field.
+func (f *requestFile) validate(verr *validationError, field string) {
+	switch {
+	case f.Content == "" && f.S3URI == "":
+		verr.add(field, "must set content or s3_uri")
+	case f.Content != "" && f.S3URI != "":
+		verr.add(field, "must set only one of content and s3_uri")
+	case f.Content != "":
+		if _, err := base64.StdEncoding.DecodeString(f.Content); err != nil {
+			verr.add(field+".content", "must be base64 encoded: %s", err)
+		}
+	default:
+		if _, _, err := parseS3URI(f.S3URI); err != nil {
+			verr.add(field+".s3_uri", "%s", err)
+		}
+	}
+}
+
+// read returns the file's content, reading it from S3 if it isn't inline.
+func (f *requestFile) read(ctx context.Context) ([]byte, error) {
+	if f.Content != "" {
+		return base64.StdEncoding.DecodeString(f.Content)
+	}
+	bucket, key, err := parseS3URI(f.S3URI)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := (&s3ArtifactStore{bucket: bucket}).GetObject(ctx, key)
+	if errors.Is(err, errObjectNotFound) {
+		return nil, fmt.Errorf("%w: %s not found", ErrBadRequest, f.S3URI)
+	}
+	return buf, err
+}
+
+// writeRequestFile writes a request's file to disk as name and returns its path. Files are stored by their content's
+// digest, so identical requests build with identical options and share their builds. check, if set, rejects
+// unusable content before it's written.
+func writeRequestFile(ctx context.Context, f *requestFile, name string, check func([]byte) error) (string, error) {
+	content, err := f.read(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if check != nil {
+		if err := check(content); err != nil {
+			return "", fmt.Errorf("%w: invalid %s: %w", ErrBadRequest, name, err)
+		}
+	}
+	sum := sha256.Sum256(content)
+	dir := filepath.Join(requestFilesDir, hex.EncodeToString(sum[:]))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// checkPEMCertificates checks content is a bundle of PEM encoded certificates.
+func checkPEMCertificates(content []byte) error {
+	count := 0
+	for rest := content; ; count++ {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return fmt.Errorf("unexpected PEM block %q, must only contain certificates", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return err
+		}
+	}
+	if count == 0 {
+		return errors.New("no PEM encoded certificate found")
+	}
+	return nil
+}
+
+// parseS3URI splits an s3://bucket/key URI.
+func parseS3URI(uri string) (string, string, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !strings.HasPrefix(uri, "s3://") || !ok || bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid S3 URI %q, must be like s3://bucket/key", uri)
+	}
+	return bucket, key, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// schemaVersion1 is the first versioned response schema. Bump to a new constant (and keep rendering the old one
+// for callers that ask for it) whenever a response change would break existing callers.
+const schemaVersion1 = "1"
+
+// currentSchemaVersion is used when the caller doesn't send an Accept-Version header.
+const currentSchemaVersion = schemaVersion1
+
+// supportedSchemaVersions lists every response schema version the packager can render.
+var supportedSchemaVersions = []string{schemaVersion1}
+
+const (
+	packageStatusSucceeded = "succeeded"
+	packageStatusFailed    = "failed"
+)
+
+// CreateInstallersResponse is the body returned for a create installers request.
+type CreateInstallersResponse struct {
+	SchemaVersion string          `json:"schema_version"`
+	TeamName      string          `json:"team_name"`
+	Results       []PackageResult `json:"results"`
+	// Manifest is the URL of the build manifest, see buildManifest.
+	Manifest string `json:"manifest,omitempty"`
+	// DownloadPage is a link to the team's download page, see writeDownloadPage.
+	DownloadPage string      `json:"download_page,omitempty"`
+	DryRun       *DryRunPlan `json:"dry_run,omitempty"`
+	// SecretRotation reports the enroll secrets a rotation replaced, see handleRotateEnrollSecret.
+	SecretRotation *SecretRotation `json:"secret_rotation,omitempty"`
+	// EmptyTeam reports the team the request created when no installer was built for it, see rollbackTeam.
+	EmptyTeam *EmptyTeam `json:"empty_team,omitempty"`
+	// Debug reports how the request's packaging options were resolved.
+	Debug *ResponseDebug `json:"debug,omitempty"`
+	// Jobs are the jobs building the request's package types on other execution backends, see dispatch.
+	Jobs []JobResponse `json:"jobs,omitempty"`
+}
+
+// ResponseDebug reports the packaging options a request's installers were built with, secrets redacted, and where
+// each option came from: "request", "env" or "default". Packages overriding agent settings apply them on top.
+type ResponseDebug struct {
+	Options       packaging.Options `json:"options"`
+	OptionSources map[string]string `json:"option_sources"`
+}
+
+// responseDebugEnabled reports whether responses include how their options were resolved, set RESPONSE_DEBUG to
+// enable it.
+func responseDebugEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("RESPONSE_DEBUG"))
+	return enabled
+}
+
+// EmptyTeam is a team a request created without building any installer for it.
+type EmptyTeam struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+	// Deleted is set when the team was deleted from the Fleet server.
+	Deleted bool `json:"deleted"`
+}
+
+// PackageResult is the outcome of building and uploading a single package type.
+type PackageResult struct {
+	Package string `json:"package"`
+	Status  string `json:"status"`
+	// Architecture is the architecture the installer was built for.
+	Architecture string `json:"architecture,omitempty"`
+	Key          string `json:"key,omitempty"`
+	URL          string `json:"url,omitempty"`
+	SHA256       string `json:"sha256,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Cached       bool   `json:"cached,omitempty"`
+	// Unchanged is set when the installer wasn't built because its inputs didn't change, see changeDetector.
+	Unchanged bool `json:"unchanged,omitempty"`
+	// InputsHash fingerprints the inputs the installer was built from, it's recorded in the indexes.
+	InputsHash string `json:"-"`
+	Verified   bool   `json:"verified,omitempty"`
+	// DownloadURL is a signed CloudFront URL of the installer, valid until DownloadURLExpiresAt.
+	DownloadURL          string     `json:"download_url,omitempty"`
+	DownloadURLExpiresAt *time.Time `json:"download_url_expires_at,omitempty"`
+	// Sidecars are the documents uploaded next to the installer, e.g. its SBOM.
+	Sidecars []SidecarResult `json:"sidecars,omitempty"`
+	// Destinations reports the uploads to the request's additional destinations.
+	Destinations []DestinationResult `json:"destinations,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	Code         string              `json:"code,omitempty"`
+	Retryable    bool                `json:"retryable,omitempty"`
+}
+
+// ErrorResponse is the body returned when a request fails as a whole.
+type ErrorResponse struct {
+	SchemaVersion string       `json:"schema_version"`
+	Error         string       `json:"error"`
+	Code          string       `json:"code"`
+	Retryable     bool         `json:"retryable"`
+	Fields        []fieldError `json:"fields,omitempty"`
+	UnknownFields []string     `json:"unknown_fields,omitempty"`
+}
+
+// negotiateSchemaVersion returns the response schema version requested with the Accept-Version header,
+// defaulting to currentSchemaVersion. Unsupported versions are rejected with ErrUnsupportedVersion.
+func negotiateSchemaVersion(event events.APIGatewayProxyRequest) (string, error) {
+	requested := headerValue(event.Headers, "Accept-Version")
+	if requested == "" {
+		return currentSchemaVersion, nil
+	}
+	for _, v := range supportedSchemaVersions {
+		if v == requested {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("%w: schema version %q is not supported, must be one of: %s", ErrUnsupportedVersion, requested, strings.Join(supportedSchemaVersions, ", "))
+}
+
+// headerValue looks up a header by name. API Gateway passes headers through with whatever casing the client used.
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// respondResults returns the per package results of a request in response. The status code is 200 (OK) when every
+// package succeeded, 207 (Multi-Status) when only some did, and the status code of the first failure when none did.
+func respondResults(response CreateInstallersResponse, errs []error) (events.APIGatewayProxyResponse, error) {
+	results := response.Results
+	statusCode := http.StatusOK
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	switch len(failures) {
+	case 0:
+		// the installers are in the artifact bucket, but missing from some of the destinations
+		if destinationFailed(results) {
+			statusCode = http.StatusMultiStatus
+		}
+	case len(results):
+		// report the failure that caused the others when staged packages were aborted because of it
+		cause := failures[0]
+		for _, err := range failures {
+			if !errors.Is(err, ErrPublishAborted) {
+				cause = err
+				break
+			}
+		}
+		statusCode = classifyError(cause).statusCode
+	default:
+		statusCode = http.StatusMultiStatus
+	}
+
+	response.SchemaVersion = currentSchemaVersion
+	return respondJSON(statusCode, response)
+}
+
+// respondJSON marshals body into an API Gateway proxy response with the given status code.
+func respondJSON(statusCode int, body any) (events.APIGatewayProxyResponse, error) {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(buf),
+	}, nil
+}
+
+// allFailed reports whether every package of a request failed.
+func allFailed(errs []error) bool {
+	for _, err := range errs {
+		if err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// destinationFailed reports whether an upload to any of the additional destinations failed.
+func destinationFailed(results []PackageResult) bool {
+	for _, result := range results {
+		for _, destination := range result.Destinations {
+			if destination.Status == packageStatusFailed {
+				return true
+			}
+		}
+	}
+	return false
+}
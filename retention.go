@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionPolicy limits how many artifacts of a team and package type are kept in the artifact store.
+type retentionPolicy struct {
+	// Count is how many of the newest artifacts are kept, zero keeps all of them.
+	Count int
+	// MaxAge is how long artifacts are kept, zero keeps them regardless of age.
+	MaxAge time.Duration
+}
+
+// artifactRetention is the retention policy enforced after every upload, set in main from ARTIFACT_RETENTION_COUNT
+// and ARTIFACT_RETENTION_MAX_AGE.
+var artifactRetention retentionPolicy
+
+func retentionPolicyFromEnv() (retentionPolicy, error) {
+	var policy retentionPolicy
+	if v := os.Getenv("ARTIFACT_RETENTION_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return retentionPolicy{}, fmt.Errorf("invalid ARTIFACT_RETENTION_COUNT %q, must be a positive number", v)
+		}
+		policy.Count = n
+	}
+	if v := os.Getenv("ARTIFACT_RETENTION_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return retentionPolicy{}, fmt.Errorf("invalid ARTIFACT_RETENTION_MAX_AGE %q, must be a positive duration", v)
+		}
+		policy.MaxAge = d
+	}
+	return policy, nil
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.Count > 0 || p.MaxAge > 0
+}
+
+// pruneArtifacts applies the retention policy to the artifacts of job's team and package type, keeping the artifact
+// just uploaded to key. Content addressed artifacts are shared between teams and never pruned.
+func pruneArtifacts(ctx context.Context, store ArtifactStore, job buildJob, key string) {
+	if !artifactRetention.enabled() || artifactLayout() == artifactLayoutContent {
+		return
+	}
+	deleted, err := artifactRetention.apply(ctx, store, job, key)
+	if err != nil {
+		log.Printf("%s: failed to prune old artifacts: %s", job.PackageType, err)
+		return
+	}
+	if len(deleted) > 0 {
+		log.Printf("%s: pruned %d old artifacts: %s", job.PackageType, len(deleted), strings.Join(deleted, ", "))
+	}
+}
+
+// apply deletes the artifacts of job's team and package type the policy doesn't keep, along with their sidecars, and
+// returns their keys. The artifact at keep counts towards the kept artifacts but is never deleted.
+func (p retentionPolicy) apply(ctx context.Context, store ArtifactStore, job buildJob, keep string) ([]string, error) {
+	prefix, pattern, err := artifactKeyPattern(job, "")
+	if err != nil {
+		return nil, err
+	}
+	objects, err := store.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var previous []objectSummary
+	for _, object := range objects {
+		if object.Key != keep && pattern.MatchString(object.Key) && !isOtherArchitecture(job, object.Key) {
+			previous = append(previous, object)
+		}
+	}
+	stale := p.stale(previous, time.Now())
+	if len(stale) == 0 {
+		return nil, nil
+	}
+	// sidecars go with their installer
+	keys := append([]string{}, stale...)
+	for _, key := range stale {
+		keys = append(keys, sidecarKeys(key)...)
+	}
+	if err := store.DeleteObjects(ctx, keys); err != nil {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// stale returns the keys of the previous artifacts the policy doesn't keep at now, newest first. The artifact just
+// uploaded isn't among previous but counts towards the kept artifacts.
+func (p retentionPolicy) stale(previous []objectSummary, now time.Time) []string {
+	previous = append([]objectSummary{}, previous...)
+	sort.Slice(previous, func(i, j int) bool {
+		return previous[i].LastModified.After(previous[j].LastModified)
+	})
+	cutoff := now.Add(-p.MaxAge)
+	var stale []string
+	for i, object := range previous {
+		if (p.Count > 0 && i+1 >= p.Count) || (p.MaxAge > 0 && object.LastModified.Before(cutoff)) {
+			stale = append(stale, object.Key)
+		}
+	}
+	return stale
+}
+
+// isOtherArchitecture reports whether key is an installer of another architecture than job's, by the architecture its
+// file name or key mentions. Default key templates don't tell architectures apart, so without it the pattern of an
+// amd64 installer matches the arm64 ones too, and counting them would prune the other architecture's installers.
+func isOtherArchitecture(job buildJob, key string) bool {
+	if job.Architecture == "" {
+		return false
+	}
+	if mentionsArchitecture(job.PackageType, job.Architecture, key) {
+		return false
+	}
+	for _, arch := range packageArchitectures[job.PackageType] {
+		if arch != job.Architecture && mentionsArchitecture(job.PackageType, arch, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionsArchitecture reports whether key names arch as a word, by its name or by the name installers of
+// packageType use for it, e.g. x86_64 for rpms.
+func mentionsArchitecture(packageType string, arch string, key string) bool {
+	names := []string{arch}
+	if name, ok := archFileNames[packageType][arch]; ok {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if regexp.MustCompile(`(^|[^a-z0-9])` + regexp.QuoteMeta(name) + `([^a-z0-9]|$)`).MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyPlaceholder marks a template value that changes between builds when rendering key patterns.
+func keyPlaceholder(name string) string {
+	return "\x00" + name + "\x00"
+}
+
+// artifactKeyPattern returns a pattern matching every key job's key and name templates render for its team and
+// package type, whatever the file name, date or version, and the literal prefix of those keys to list them by.
+// fileSuffix is appended to the file name, e.g. ".json" for the pointers of content addressed artifacts.
+func artifactKeyPattern(job buildJob, fileSuffix string) (string, *regexp.Regexp, error) {
+	name, err := artifactFileName(job, fmt.Sprintf("%s.%s", keyPlaceholder("File"), job.PackageType))
+	if err != nil {
+		return "", nil, err
+	}
+	return keyPattern(job, name+fileSuffix)
+}
+
+// keyPattern returns a pattern matching every key job's key template renders for a file name, whatever the date or
+// version, and the literal prefix of those keys. The file name may contain a "File" placeholder.
+func keyPattern(job buildJob, file string) (string, *regexp.Regexp, error) {
+	// render the template with placeholders for everything that changes between builds
+	data := newObjectKeyData(job, file, time.Now())
+	data.Date = keyPlaceholder("Date")
+	data.Year = keyPlaceholder("Year")
+	data.Month = keyPlaceholder("Month")
+	data.Day = keyPlaceholder("Day")
+	data.Version = keyPlaceholder("Version")
+	if job.Architecture == "" {
+		data.Arch = keyPlaceholder("Arch")
+	}
+	key, err := objectKey(job.KeyTemplate, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	prefix, _, _ := strings.Cut(key, "\x00")
+	expr := regexp.QuoteMeta(key)
+	for _, field := range []string{"File", "Date", "Year", "Month", "Day", "Version", "Arch"} {
+		expr = strings.ReplaceAll(expr, keyPlaceholder(field), "[^/]*")
+	}
+	pattern, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return "", nil, err
+	}
+	return prefix, pattern, nil
+}
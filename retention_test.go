@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicyStale(t *testing.T) {
+	now := time.Date(2023, 9, 22, 10, 0, 0, 0, time.UTC)
+	// listed out of order, the policy sorts them newest first
+	previous := []objectSummary{
+		{Key: "three-days", LastModified: now.Add(-72 * time.Hour)},
+		{Key: "one-hour", LastModified: now.Add(-time.Hour)},
+		{Key: "ten-days", LastModified: now.Add(-240 * time.Hour)},
+		{Key: "two-hours", LastModified: now.Add(-2 * time.Hour)},
+	}
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   []string
+	}{
+		{name: "keep all", policy: retentionPolicy{}, want: nil},
+		{name: "keep the uploaded one", policy: retentionPolicy{Count: 1}, want: []string{"one-hour", "two-hours", "three-days", "ten-days"}},
+		{name: "count", policy: retentionPolicy{Count: 3}, want: []string{"three-days", "ten-days"}},
+		{name: "count above listed", policy: retentionPolicy{Count: 10}, want: nil},
+		{name: "max age", policy: retentionPolicy{MaxAge: 48 * time.Hour}, want: []string{"three-days", "ten-days"}},
+		{name: "count and max age", policy: retentionPolicy{Count: 4, MaxAge: 120 * time.Hour}, want: []string{"ten-days"}},
+		{name: "count stricter than max age", policy: retentionPolicy{Count: 2, MaxAge: 120 * time.Hour}, want: []string{"two-hours", "three-days", "ten-days"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.stale(previous, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
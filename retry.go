@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retryPolicy retries failed operations with exponential backoff and full jitter.
+type retryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the upper bound of the delay before the first retry, it doubles for every further retry.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts.
+	MaxDelay time.Duration
+}
+
+// retryPolicyFromEnv returns defaults overridden by the <prefix>_MAX_ATTEMPTS, <prefix>_RETRY_BASE_DELAY and
+// <prefix>_RETRY_MAX_DELAY env vars, e.g. UPLOAD_MAX_ATTEMPTS=5.
+func retryPolicyFromEnv(prefix string, defaults retryPolicy) (retryPolicy, error) {
+	policy := defaults
+	if v := os.Getenv(prefix + "_MAX_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return retryPolicy{}, fmt.Errorf("invalid %s_MAX_ATTEMPTS %q, must be a positive number", prefix, v)
+		}
+		policy.MaxAttempts = n
+	}
+	for name, d := range map[string]*time.Duration{
+		prefix + "_RETRY_BASE_DELAY": &policy.BaseDelay,
+		prefix + "_RETRY_MAX_DELAY":  &policy.MaxDelay,
+	} {
+		if v := os.Getenv(name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed <= 0 {
+				return retryPolicy{}, fmt.Errorf("invalid %s %q, must be a positive duration", name, v)
+			}
+			*d = parsed
+		}
+	}
+	return policy, nil
+}
+
+// retryAfterError is a failure the server asked to retry no sooner than after delay, e.g. with a Retry-After header.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// parseRetryAfter parses a Retry-After header, either delay seconds or an HTTP date.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at), true
+	}
+	return 0, false
+}
+
+// do runs fn until it succeeds, returns an error retryable rejects, or the policy runs out of attempts. It stops
+// waiting when ctx is done. A retryAfterError delays the retry to its delay, up to MaxDelay. The returned error tells
+// how many attempts were made.
+func (p retryPolicy) do(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		}
+		delay := p.backoff(attempt)
+		var retryAfter *retryAfterError
+		if errors.As(err, &retryAfter) && retryAfter.delay > delay {
+			delay = retryAfter.delay
+			if delay > p.MaxDelay {
+				delay = p.MaxDelay
+			}
+		}
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %s", op, attempt, p.MaxAttempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay between zero and BaseDelay*2^(attempt-1), capped at MaxDelay.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/fleetdm/fleet/v4/server/fleet"
+)
+
+// SecretRotation reports a rotation of a team's enroll secret. Secrets are identified by their fingerprint,
+// secretFingerprint, the secrets themselves are never returned.
+type SecretRotation struct {
+	OldSecretIDs []string `json:"old_secret_ids"`
+	NewSecretID  string   `json:"new_secret_id"`
+}
+
+// handleRotateEnrollSecret replaces a team's enroll secrets with a new one and rebuilds the installers the body asks
+// for with it, like a create installers request for the team. The old secrets stop enrolling hosts right away, hosts
+// already enrolled keep working. It responds like a create installers request, with secret_rotation reporting the
+// secrets that were replaced.
+func handleRotateEnrollSecret(ctx context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if err := authorizeAdmin(ctx, event); err != nil {
+		return respondError(err)
+	}
+	teamName := event.PathParameters["team_name"]
+	if strings.TrimSpace(teamName) == "" || !isSafeTeamName(teamName) {
+		return respondError(fmt.Errorf("%w: invalid team name %q", ErrBadRequest, teamName))
+	}
+	installersRequest, err := parseEventBody(event)
+	if err != nil {
+		return respondError(fmt.Errorf("%w: failed to parse rotate enroll secret request: %w", ErrBadRequest, err))
+	}
+	if installersRequest.TeamName != "" || installersRequest.TeamID != 0 || installersRequest.Global || installersRequest.EnrollSecret != "" || installersRequest.DryRun {
+		return respondError(fmt.Errorf("%w: the team and enroll secret are set by the rotation", ErrBadRequest))
+	}
+	installersRequest.TeamName = teamName
+	installersRequest, err = applyTeamDefaults(ctx, installersRequest)
+	if err != nil {
+		return respondError(err)
+	}
+	installersRequest.Packages = expandPackageSpecs(installersRequest.Packages)
+	if err := validateRequest(installersRequest); err != nil {
+		return respondError(err)
+	}
+
+	ctx = withFleetInstance(ctx, installersRequest.FleetInstance)
+	fleetClient, err := newFleetClient(ctx)
+	if err != nil {
+		return respondError(err)
+	}
+	team, err := findTeam(ctx, fleetClient, teamName)
+	if err != nil {
+		return respondError(err)
+	}
+	if team == nil {
+		return respondError(fmt.Errorf("%w: team %s doesn't exist", ErrUnprocessable, teamName))
+	}
+	old, err := teamEnrollSecrets(ctx, fleetClient, team.ID)
+	if err != nil {
+		return respondError(err)
+	}
+	secret, err := newEnrollSecret()
+	if err != nil {
+		return respondError(err)
+	}
+	if err := setTeamEnrollSecrets(ctx, fleetClient, team.ID, fleet.EnrollSecretSpec{Secrets: []*fleet.EnrollSecret{{Secret: secret}}}); err != nil {
+		return respondError(err)
+	}
+	rotation := &SecretRotation{OldSecretIDs: []string{}, NewSecretID: secretFingerprint(secret)}
+	for _, s := range old {
+		rotation.OldSecretIDs = append(rotation.OldSecretIDs, secretFingerprint(s.Secret))
+	}
+	log.Printf("rotated enroll secret of team %s (%d) from %v to %s", teamName, team.ID, rotation.OldSecretIDs, rotation.NewSecretID)
+
+	installersRequest.TeamID = team.ID
+	installersRequest.EnrollSecret = secret
+	installersRequest.secretRotation = rotation
+	response, err := invoke(ctx, installersRequest)
+	if err != nil {
+		return respondError(err)
+	}
+	return response, nil
+}
+
+// newEnrollSecret returns a random enroll secret, as long as the ones Fleet generates.
+func newEnrollSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate enroll secret: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// secretFingerprint identifies an enroll secret without revealing it, by the first 12 hex digits of its SHA-256.
+func secretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])[:12]
+}
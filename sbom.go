@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// cycloneDXSpecVersion is the CycloneDX specification version of generated SBOMs.
+const cycloneDXSpecVersion = "1.4"
+
+// cycloneDXBOM is a CycloneDX JSON SBOM.
+type cycloneDXBOM struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp time.Time          `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Hashes     []cycloneDXHash     `json:"hashes,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Algorithm string `json:"alg"`
+	Content   string `json:"content"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// sbomEnabled reports whether SBOMs are generated for installers, set ARTIFACT_SBOM to enable them.
+func sbomEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ARTIFACT_SBOM"))
+	return enabled
+}
+
+// generateSBOM returns the CycloneDX SBOM of an installer named name: the installer itself and the orbit, osqueryd
+// and Fleet Desktop versions packaged into it.
+func generateSBOM(built artifact, job buildJob, name string, components []component) ([]byte, error) {
+	serial, err := uuid()
+	if err != nil {
+		return nil, err
+	}
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  cycloneDXSpecVersion,
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: time.Now().UTC(),
+			Tools:     []cycloneDXTool{{Vendor: "Fleet", Name: "fleet-lambda-packager"}},
+			Component: cycloneDXComponent{
+				Type:   "application",
+				BOMRef: name,
+				Name:   name,
+				Hashes: []cycloneDXHash{{Algorithm: "SHA-256", Content: built.SHA256}},
+				Properties: []cycloneDXProperty{
+					{Name: "fleet:package_type", Value: job.PackageType},
+					{Name: "fleet:team", Value: job.TeamName},
+					{Name: "fleet:update_url", Value: job.Options.UpdateURL},
+				},
+			},
+		},
+	}
+	for _, c := range components {
+		bom.Components = append(bom.Components, cycloneDXComponent{
+			Type:    "application",
+			BOMRef:  c.Name,
+			Name:    c.Name,
+			Version: c.Version,
+			PURL:    fmt.Sprintf("pkg:generic/fleetdm/%s@%s", c.Name, c.Version),
+			Hashes:  []cycloneDXHash{{Algorithm: "SHA-512", Content: c.SHA512}},
+			Properties: []cycloneDXProperty{
+				{Name: "fleet:channel", Value: c.Channel},
+				{Name: "fleet:tuf_target", Value: c.Target},
+			},
+		})
+	}
+	buf, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SBOM: %w", err)
+	}
+	return buf, nil
+}
+
+// uuid returns a random version 4 UUID.
+func uuid() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// defaultSecretRefreshInterval is how long secrets read per invocation are cached unless SECRETS_REFRESH_INTERVAL is
+// set.
+const defaultSecretRefreshInterval = 15 * time.Minute
+
+// secretCache reads secrets from Secrets Manager or SSM Parameter Store and caches them across warm invocations, so
+// rotated secrets are picked up without a cold start.
+type secretCache struct {
+	secrets         *secretsmanager.Client
+	parameters      *ssm.Client
+	refreshInterval time.Duration
+
+	mu     sync.Mutex
+	values map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+// secretValues is the cache of secrets referenced by env vars, set in main.
+var secretValues *secretCache
+
+// newSecretCache returns a cache of the secrets read with secrets and parameters, refreshed every
+// SECRETS_REFRESH_INTERVAL.
+func newSecretCache(secrets *secretsmanager.Client, parameters *ssm.Client) (*secretCache, error) {
+	interval := defaultSecretRefreshInterval
+	if v := os.Getenv("SECRETS_REFRESH_INTERVAL"); v != "" {
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SECRETS_REFRESH_INTERVAL %q, must be a positive duration", v)
+		}
+		interval = parsed
+	}
+	return &secretCache{secrets: secrets, parameters: parameters, refreshInterval: interval, values: map[string]cachedSecret{}}, nil
+}
+
+// get returns the value of the secret ref refers to, read again once it's older than the refresh interval. A failed
+// refresh keeps the cached value.
+func (c *secretCache) get(ctx context.Context, ref string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.values[ref]
+	if ok && time.Since(cached.fetchedAt) < c.refreshInterval {
+		return cached.value, nil
+	}
+	value, err := c.read(ctx, ref)
+	if err != nil {
+		if ok {
+			log.Printf("failed to refresh secret %s, using the cached value: %s", ref, err)
+			return cached.value, nil
+		}
+		return "", fmt.Errorf("failed to read secret %s: %w", ref, err)
+	}
+	c.values[ref] = cachedSecret{value: value, fetchedAt: time.Now()}
+	return value, nil
+}
+
+// read returns the value of the secret ref refers to: an SSM parameter, see ssmParameterName, else a Secrets Manager
+// secret's name or ARN.
+func (c *secretCache) read(ctx context.Context, ref string) (string, error) {
+	name, ok := ssmParameterName(ref)
+	if !ok {
+		return secretString(ctx, c.secrets, ref)
+	}
+	out, err := c.parameters.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return "", err
+	}
+	if out.Parameter == nil {
+		return "", fmt.Errorf("parameter %s has no value", name)
+	}
+	return aws.ToString(out.Parameter.Value), nil
+}
+
+// ssmParameterName returns the name of the SSM parameter a secret reference refers to, either "ssm:" followed by the
+// parameter's name, e.g. ssm:/fleet/api-token, or the parameter's ARN.
+func ssmParameterName(ref string) (string, bool) {
+	if name, ok := strings.CutPrefix(ref, "ssm:"); ok {
+		return name, true
+	}
+	if strings.HasPrefix(ref, "arn:") && strings.Contains(ref, ":ssm:") {
+		return ref, true
+	}
+	return "", false
+}
+
+// envSecret returns the value of the env var name, or of the secret referenced by the env var <name>_SECRET if it's
+// set, e.g. FLEET_API_ONLY_USER_TOKEN_SECRET=ssm:/fleet/api-token, so the value isn't kept in plaintext.
+func envSecret(ctx context.Context, name string) (string, error) {
+	ref := os.Getenv(name + "_SECRET")
+	if ref == "" || secretValues == nil {
+		return os.Getenv(name), nil
+	}
+	return secretValues.get(ctx, ref)
+}
+
+// secretEnvVars are the env vars whose values can be referenced secrets, read at cold start so a missing secret fails
+// the deployment rather than requests.
+var secretEnvVars = []string{"FLEET_API_ONLY_USER_TOKEN", "ADMIN_API_TOKEN", "NOTIFY_WEBHOOK_URL"}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+)
+
+// Config is the packager's core configuration, loaded from env vars and validated once at init. Optional features
+// read their own env vars when they're set up.
+type Config struct {
+	// FleetURL is FLEET_URL, the Fleet server the packager creates teams on.
+	FleetURL string
+	// FleetServerURL is FLEET_SERVER_URL, the Fleet server URL installers enroll to, e.g. behind a load balancer
+	// hosts reach but the Lambda function doesn't.
+	FleetServerURL string
+	// FleetRootCA is FLEET_ROOT_CA, a PEM bundle of the CA certificates the Fleet server's certificate is verified
+	// with instead of the system's, e.g. of an internal CA. See fleetRootCAFromSecret for reading it from a secret.
+	FleetRootCA string
+	// FleetInsecureSkipVerify is FLEET_INSECURE_SKIP_VERIFY, skipping verification of the Fleet server's
+	// certificate. It's meant for development servers only.
+	FleetInsecureSkipVerify bool
+	// ArtifactBucket is ARTIFACT_BUCKET, the bucket or container installers are uploaded to.
+	ArtifactBucket string
+	// AWSRegion is AWS_REGION, set by the Lambda runtime.
+	AWSRegion string
+	// PackagingDefaults are the packaging options installers are built with unless a request overrides them, the
+	// built-in ones with the deployment's env defaults applied, see envPackagingOptions.
+	PackagingDefaults packaging.Options
+	// PackagingSources is the source of every packaging default, "env" or "default".
+	PackagingSources map[string]string
+	// PackageTypes are the PACKAGE_TYPES the deployment builds.
+	PackageTypes      []string
+	UploadRetryPolicy retryPolicy
+	FleetRetryPolicy  retryPolicy
+	FleetTimeouts     fleetTimeouts
+	Retention         retentionPolicy
+	// ProxyURL is OUTBOUND_PROXY_URL, the HTTP(S) proxy outbound calls go through, see applyProxy.
+	ProxyURL string
+	// Local runs a single request from the command line instead of starting the Lambda handler.
+	Local bool
+}
+
+// appConfig is the loaded Config, set in main.
+var appConfig Config
+
+// configError lists every missing or invalid env var found loading the Config.
+type configError struct {
+	Problems []string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(e.Problems, "\n  "))
+}
+
+func (e *configError) add(format string, args ...any) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// check records err, if set, as a problem with the env var name.
+func (e *configError) check(name string, err error) {
+	if err != nil {
+		e.add("%s: %s", name, err)
+	}
+}
+
+// applyProxy routes outbound calls through proxyURL, unless it's empty, by setting HTTP_PROXY and HTTPS_PROXY. Every
+// client honours them: the Fleet client, the AWS SDK, resty and the packaging library's TUF downloads, which build
+// their own transports. It has to run before any call is made, Go reads the proxy env vars once.
+func applyProxy(proxyURL string) {
+	if proxyURL != "" {
+		os.Setenv("HTTP_PROXY", proxyURL)
+		os.Setenv("HTTPS_PROXY", proxyURL)
+	}
+	if proxy := os.Getenv("HTTPS_PROXY"); proxy != "" {
+		if u, err := url.Parse(proxy); err == nil {
+			log.Printf("outbound calls go through the proxy %s, except to NO_PROXY %q", u.Redacted(), os.Getenv("NO_PROXY"))
+		}
+	}
+}
+
+// checkPEMFile checks path is a readable bundle of PEM encoded certificates.
+func checkPEMFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return checkPEMCertificates(content)
+}
+
+// loadConfig loads the Config from env vars. It returns a *configError naming every missing or invalid variable
+// rather than stopping at the first.
+func loadConfig() (Config, error) {
+	cerr := &configError{}
+	config := Config{
+		FleetURL:       os.Getenv("FLEET_URL"),
+		FleetServerURL: os.Getenv("FLEET_SERVER_URL"),
+		FleetRootCA:    os.Getenv("FLEET_ROOT_CA"),
+		ArtifactBucket: os.Getenv("ARTIFACT_BUCKET"),
+		AWSRegion:      os.Getenv("AWS_REGION"),
+		ProxyURL:       os.Getenv("OUTBOUND_PROXY_URL"),
+		Local:          os.Getenv("LOCAL") != "",
+	}
+	for name, value := range map[string]string{"FLEET_URL": config.FleetURL, "FLEET_SERVER_URL": config.FleetServerURL} {
+		if value == "" {
+			cerr.add("%s: must be set", name)
+		} else if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			cerr.add("%s: invalid URL %q, must be like https://fleet.example.com", name, value)
+		}
+	}
+	if config.FleetRootCA != "" {
+		cerr.check("FLEET_ROOT_CA", checkPEMFile(config.FleetRootCA))
+		if os.Getenv("FLEET_ROOT_CA_SECRET") != "" {
+			cerr.add("FLEET_ROOT_CA: must not be set with FLEET_ROOT_CA_SECRET")
+		}
+	}
+	if v := os.Getenv("FLEET_INSECURE_SKIP_VERIFY"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		cerr.check("FLEET_INSECURE_SKIP_VERIFY", err)
+		config.FleetInsecureSkipVerify = insecure
+	}
+	if config.FleetInsecureSkipVerify && (config.FleetRootCA != "" || os.Getenv("FLEET_ROOT_CA_SECRET") != "") {
+		cerr.add("FLEET_INSECURE_SKIP_VERIFY: must not be set with FLEET_ROOT_CA or FLEET_ROOT_CA_SECRET")
+	}
+	if config.ProxyURL != "" {
+		if u, err := url.Parse(config.ProxyURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			cerr.add("OUTBOUND_PROXY_URL: invalid URL %q, must be like http://proxy.example.com:3128", config.ProxyURL)
+		}
+	}
+	if config.ArtifactBucket == "" {
+		cerr.add("ARTIFACT_BUCKET: must be set")
+	}
+	if os.Getenv("FLEET_API_ONLY_USER_TOKEN") == "" && os.Getenv("FLEET_API_ONLY_USER_TOKEN_SECRET") == "" && os.Getenv("FLEET_LOGIN_SECRET") == "" {
+		cerr.add("FLEET_API_ONLY_USER_TOKEN: must be set, or FLEET_API_ONLY_USER_TOKEN_SECRET or FLEET_LOGIN_SECRET")
+	}
+	config.PackagingDefaults, config.PackagingSources = loadPackagingDefaults(cerr)
+	var err error
+	config.PackageTypes, err = parseEnabledPackageTypes(os.Getenv("PACKAGE_TYPES"))
+	cerr.check("PACKAGE_TYPES", err)
+	config.UploadRetryPolicy, err = retryPolicyFromEnv("UPLOAD", defaultUploadRetryPolicy)
+	cerr.check("upload retries", err)
+	config.FleetRetryPolicy, err = retryPolicyFromEnv("FLEET", defaultFleetRetryPolicy)
+	cerr.check("Fleet API retries", err)
+	config.FleetTimeouts, err = fleetTimeoutsFromEnv()
+	cerr.check("Fleet API timeouts", err)
+	config.Retention, err = retentionPolicyFromEnv()
+	cerr.check("artifact retention", err)
+	if len(cerr.Problems) > 0 {
+		return Config{}, cerr
+	}
+	return config, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	sidecarSBOM       = "sbom"
+	sidecarProvenance = "provenance"
+	sidecarSignature  = "signature"
+	sidecarIntunewin  = "intunewin"
+	sidecarChocolatey = "chocolatey"
+)
+
+// sidecarSuffixes maps each kind of sidecar to the suffix appended to its installer's key.
+var sidecarSuffixes = map[string]string{
+	sidecarSBOM:       ".cdx.json",
+	sidecarProvenance: ".intoto.jsonl",
+	sidecarSignature:  ".sig",
+	sidecarIntunewin:  ".intunewin",
+	sidecarChocolatey: ".nupkg",
+}
+
+// sidecarContentTypes maps each kind of sidecar to the MIME type it's served with.
+var sidecarContentTypes = map[string]string{
+	sidecarSBOM:       "application/vnd.cyclonedx+json",
+	sidecarProvenance: "application/vnd.dsse.envelope.v1+json",
+	sidecarSignature:  "text/plain",
+	sidecarIntunewin:  "application/octet-stream",
+	sidecarChocolatey: "application/octet-stream",
+}
+
+// SidecarResult is a document uploaded next to an installer, e.g. its SBOM or a repackaged installer.
+type SidecarResult struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	URL  string `json:"url"`
+}
+
+// sidecarKey returns the key of an installer's sidecar of kind.
+func sidecarKey(key string, kind string) string {
+	return key + sidecarSuffixes[kind]
+}
+
+// sidecarKeys returns the keys of every kind of sidecar an installer at key can have.
+func sidecarKeys(key string) []string {
+	keys := make([]string, 0, len(sidecarSuffixes))
+	for kind := range sidecarSuffixes {
+		keys = append(keys, sidecarKey(key, kind))
+	}
+	return keys
+}
+
+// buildSidecars returns the sidecar documents of a built installer by kind, for every kind that's enabled. startedAt
+// is when the installer's build started.
+func buildSidecars(ctx context.Context, built artifact, job buildJob, name string, components []component, startedAt time.Time) (map[string][]byte, error) {
+	documents := map[string][]byte{}
+	if sbomEnabled() {
+		sbom, err := generateSBOM(built, job, name, components)
+		if err != nil {
+			return nil, err
+		}
+		documents[sidecarSBOM] = sbom
+	}
+	if provenanceEnabled() {
+		provenance, err := generateProvenance(ctx, built, job, name, components, startedAt)
+		if err != nil {
+			return nil, err
+		}
+		documents[sidecarProvenance] = provenance
+	}
+	if signatureEnabled() {
+		signature, err := signArtifact(ctx, built)
+		if err != nil {
+			return nil, err
+		}
+		documents[sidecarSignature] = signature
+	}
+	if intunewinEnabled() && job.PackageType == "msi" {
+		intunewin, err := generateIntunewin(built, name)
+		if err != nil {
+			return nil, err
+		}
+		documents[sidecarIntunewin] = intunewin
+	}
+	if chocolateyEnabled() && job.PackageType == "msi" {
+		nupkg, err := generateChocolateyPackage(built, job, name, startedAt)
+		if err != nil {
+			return nil, err
+		}
+		documents[sidecarChocolatey] = nupkg
+	}
+	return documents, nil
+}
+
+// uploadSidecars uploads the sidecar documents of the installer uploaded to key next to it, retrying failed uploads
+// with uploadRetryPolicy.
+func uploadSidecars(ctx context.Context, store ArtifactStore, key string, documents map[string][]byte, job buildJob) ([]SidecarResult, error) {
+	kinds := make([]string, 0, len(documents))
+	for kind := range documents {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	var sidecars []SidecarResult
+	for _, kind := range kinds {
+		kind, document := kind, documents[kind]
+		sidecar := sidecarKey(key, kind)
+		err := uploadRetryPolicy.do(ctx, fmt.Sprintf("upload %s %s", job.PackageType, kind), isUploadFailure, func() error {
+			return store.PutObject(ctx, sidecar, document, sidecarContentTypes[kind], job)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload %s of %s: %w", kind, job.PackageType, err)
+		}
+		log.Printf("%s: uploaded %s %s", job.PackageType, kind, sidecar)
+		sidecars = append(sidecars, SidecarResult{Kind: kind, Key: sidecar, URL: store.URL(sidecar)})
+	}
+	return sidecars, nil
+}
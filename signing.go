@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+var kmsClient *kms.Client
+
+// artifactSigner signs installers and their provenance statements, it's nil unless SIGNING_KMS_KEY_ID is set.
+var artifactSigner *kmsSigner
+
+// kmsSigner signs with an asymmetric ECC_NIST_P256 KMS key, the private key never leaves KMS.
+type kmsSigner struct {
+	keyID string
+}
+
+// newKMSSigner returns the signer for the KMS key SIGNING_KMS_KEY_ID, or nil if it isn't set.
+func newKMSSigner() *kmsSigner {
+	keyID := os.Getenv("SIGNING_KMS_KEY_ID")
+	if keyID == "" {
+		return nil
+	}
+	return &kmsSigner{keyID: keyID}
+}
+
+// sign returns the ECDSA signature of the SHA-256 digest of message. KMS only signs messages of up to 4 KB, so the
+// digest is computed here and sent instead.
+func (s *kmsSigner) sign(ctx context.Context, message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return s.signDigest(ctx, digest[:])
+}
+
+// signDigest returns the ECDSA signature of a SHA-256 digest.
+func (s *kmsSigner) signDigest(ctx context.Context, digest []byte) ([]byte, error) {
+	out, err := kmsClient.Sign(ctx, &kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest,
+		MessageType:      types.MessageTypeDigest,
+		SigningAlgorithm: types.SigningAlgorithmSpecEcdsaSha256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign with %s: %w", s.keyID, err)
+	}
+	return out.Signature, nil
+}
+
+// signatureEnabled reports whether installers get a detached signature, set ARTIFACT_SIGNATURE to enable it.
+// Installers are signed with SIGNING_KMS_KEY_ID, which has to be set as well.
+func signatureEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("ARTIFACT_SIGNATURE"))
+	return enabled
+}
+
+// signArtifact returns the detached signature of an installer, the base64 encoded ECDSA signature of its SHA-256
+// digest. It's the format of cosign sign-blob, so signatures can be verified with
+// "cosign verify-blob --key awskms:///<key> --signature <installer>.sig <installer>".
+func signArtifact(ctx context.Context, built artifact) ([]byte, error) {
+	digest, err := hex.DecodeString(built.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("invalid installer digest: %w", err)
+	}
+	sig, err := artifactSigner.signDigest(ctx, digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign installer: %w", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+}
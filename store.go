@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	// artifactStoreS3 stores artifacts in the S3 bucket ARTIFACT_BUCKET, the default.
+	artifactStoreS3 = "s3"
+	// artifactStoreGCS stores artifacts in the Google Cloud Storage bucket ARTIFACT_BUCKET.
+	artifactStoreGCS = "gcs"
+	// artifactStoreAzure stores artifacts in the Azure Blob Storage container ARTIFACT_BUCKET of the storage account
+	// AZURE_STORAGE_ACCOUNT.
+	artifactStoreAzure = "azure"
+)
+
+// errObjectNotFound is returned by ArtifactStore.GetObject for keys that don't exist.
+var errObjectNotFound = errors.New("object not found")
+
+// ArtifactStore is the storage backend built installers and the objects describing them are written to. Keys are
+// relative to the store's bucket or container.
+type ArtifactStore interface {
+	// PutArtifact uploads the installer built by job to key, served for download as name. The store must verify
+	// the stored object against the installer's checksum or size. Failed requests wrap ErrUploadFailed.
+	PutArtifact(ctx context.Context, key string, built artifact, job buildJob, name string) error
+	// PutObject stores a small object, like an artifact pointer or a build cache entry, encrypted like job's
+	// installers. Failed requests wrap ErrUploadFailed.
+	PutObject(ctx context.Context, key string, body []byte, contentType string, job buildJob) error
+	// GetObject returns the content of key, or errObjectNotFound.
+	GetObject(ctx context.Context, key string) ([]byte, error)
+	// StatObject returns the size and recorded SHA-256 checksum of key, or nil if it doesn't exist.
+	StatObject(ctx context.Context, key string) (*objectInfo, error)
+	// CopyObject copies the object at src to dst, stored like job's installers.
+	CopyObject(ctx context.Context, src string, dst string, job buildJob) error
+	// ListObjects returns the objects whose keys start with prefix.
+	ListObjects(ctx context.Context, prefix string) ([]objectSummary, error)
+	// DeleteObjects deletes keys, keys that don't exist are ignored.
+	DeleteObjects(ctx context.Context, keys []string) error
+	// URL returns the URL of key, e.g. s3://bucket/key.
+	URL(key string) string
+}
+
+// objectSummary is an object returned by ArtifactStore.ListObjects.
+type objectSummary struct {
+	Key          string
+	LastModified time.Time
+}
+
+// objectInfo describes a stored object.
+type objectInfo struct {
+	Size int64
+	// SHA256 is the hex encoded checksum recorded in the object's "sha256" metadata, empty if there is none.
+	SHA256 string
+}
+
+// artifactStore is the configured ArtifactStore, set in main.
+var artifactStore ArtifactStore
+
+// newArtifactStore returns the storage backend selected with ARTIFACT_STORE: "s3" (the default), "gcs" or "azure".
+func newArtifactStore(ctx context.Context) (ArtifactStore, error) {
+	bucket := appConfig.ArtifactBucket
+	switch backend := os.Getenv("ARTIFACT_STORE"); backend {
+	case "", artifactStoreS3:
+		return &s3ArtifactStore{bucket: bucket}, nil
+	case artifactStoreGCS:
+		return newGCSArtifactStore(ctx, bucket)
+	case artifactStoreAzure:
+		return newAzureArtifactStore(os.Getenv("AZURE_STORAGE_ACCOUNT"), bucket)
+	default:
+		return nil, fmt.Errorf("unsupported ARTIFACT_STORE %q, must be one of: %s, %s, %s", backend, artifactStoreS3, artifactStoreGCS, artifactStoreAzure)
+	}
+}
+
+// artifactStoreConfig returns the AWS config the artifact bucket is accessed with. With ARTIFACT_ROLE_ARN set the
+// role is assumed first, passing ARTIFACT_ROLE_EXTERNAL_ID if set, so installers can be written straight to a bucket
+// in another account.
+func artifactStoreConfig(cfg aws.Config) aws.Config {
+	roleARN := os.Getenv("ARTIFACT_ROLE_ARN")
+	if roleARN == "" {
+		return cfg
+	}
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), roleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = "fleet-lambda-packager"
+		if externalID := os.Getenv("ARTIFACT_ROLE_EXTERNAL_ID"); externalID != "" {
+			o.ExternalID = aws.String(externalID)
+		}
+	})
+	storeCfg := cfg.Copy()
+	storeCfg.Credentials = aws.NewCredentialsCache(provider)
+	return storeCfg
+}
+
+// s3ClientOptions points the S3 client at S3_ENDPOINT instead of AWS, e.g. MinIO or LocalStack, and switches to
+// path style addressing (http://endpoint/bucket/key) with S3_FORCE_PATH_STYLE=true, which most of them require.
+func s3ClientOptions() (func(*s3.Options), error) {
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT %q, must be a URL like http://localhost:9000", endpoint)
+		}
+	}
+	pathStyle := false
+	if v := os.Getenv("S3_FORCE_PATH_STYLE"); v != "" {
+		var err error
+		pathStyle, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_FORCE_PATH_STYLE %q: %w", v, err)
+		}
+	}
+	return func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	}, nil
+}
+
+// s3ArtifactStore stores artifacts in an S3 bucket with s3Client.
+type s3ArtifactStore struct {
+	bucket string
+	// region overrides the client's region for buckets in other regions, empty for the Lambda's own region.
+	region string
+}
+
+// clientOptions returns the options requests to the store's bucket are sent with.
+func (s *s3ArtifactStore) clientOptions() []func(*s3.Options) {
+	if s.region == "" {
+		return nil
+	}
+	return []func(*s3.Options){func(o *s3.Options) {
+		o.Region = s.region
+	}}
+}
+
+func (s *s3ArtifactStore) PutArtifact(ctx context.Context, key string, built artifact, job buildJob, name string) error {
+	return putArtifact(ctx, s, key, built, job, name)
+}
+
+func (s *s3ArtifactStore) PutObject(ctx context.Context, key string, body []byte, contentType string, job buildJob) error {
+	params := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	}
+	setEncryption(params, job)
+	if _, err := s3Client.PutObject(ctx, params, s.clientOptions()...); err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	return nil
+}
+
+func (s *s3ArtifactStore) GetObject(ctx context.Context, key string) ([]byte, error) {
+	out, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s.clientOptions()...)
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, errObjectNotFound
+		}
+		return nil, fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3ArtifactStore) StatObject(ctx context.Context, key string) (*objectInfo, error) {
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s.clientOptions()...)
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	return &objectInfo{Size: head.ContentLength, SHA256: head.Metadata["sha256"]}, nil
+}
+
+func (s *s3ArtifactStore) CopyObject(ctx context.Context, src string, dst string, job buildJob) error {
+	// the copy source is a URL path, escape every key segment
+	segments := strings.Split(src, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	params := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(dst),
+		CopySource:        aws.String(s.bucket + "/" + strings.Join(segments, "/")),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	}
+	// copies get the bucket's default encryption and storage class unless they're requested again
+	if job.KMSKeyID != "" {
+		params.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+		params.SSEKMSKeyId = aws.String(job.KMSKeyID)
+	}
+	if job.StorageClass != "" {
+		params.StorageClass = types.StorageClass(job.StorageClass)
+	}
+	if _, err := s3Client.CopyObject(ctx, params, s.clientOptions()...); err != nil {
+		return fmt.Errorf("%w: failed to copy %s to %s: %w", ErrUploadFailed, src, dst, err)
+	}
+	return nil
+}
+
+func (s *s3ArtifactStore) ListObjects(ctx context.Context, prefix string) ([]objectSummary, error) {
+	var objects []objectSummary
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx, s.clientOptions()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, objectSummary{Key: aws.ToString(object.Key), LastModified: aws.ToTime(object.LastModified)})
+		}
+	}
+	return objects, nil
+}
+
+func (s *s3ArtifactStore) DeleteObjects(ctx context.Context, keys []string) error {
+	// DeleteObjects accepts up to 1000 keys per request
+	const batchSize = 1000
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]types.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+		out, err := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		}, s.clientOptions()...)
+		if err != nil {
+			return fmt.Errorf("failed to delete objects: %w", err)
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("failed to delete %s: %s", aws.ToString(out.Errors[0].Key), aws.ToString(out.Errors[0].Message))
+		}
+	}
+	return nil
+}
+
+func (s *s3ArtifactStore) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, key)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// teamDefaults are the settings a team's requests are built with unless they set their own, e.g. the package types
+// and channels a customer standardized on.
+type teamDefaults struct {
+	Packages           []packageSpec `json:"packages"`
+	Architectures      []string      `json:"architectures"`
+	OrbitChannel       string        `json:"orbit_channel"`
+	OsquerydChannel    string        `json:"osqueryd_channel"`
+	DesktopChannel     string        `json:"desktop_channel"`
+	NotificationEmails []string      `json:"notification_emails"`
+}
+
+// teamDefaultsStore reads teams' defaults from the DynamoDB table named by TEAM_DEFAULTS_TABLE. The table's partition
+// key is the string attribute "team_name", the defaults are the JSON string attribute "defaults". Global installers'
+// defaults are stored under globalTeamName.
+type teamDefaultsStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+// newTeamDefaultsStore returns the configured team defaults store, or nil if TEAM_DEFAULTS_TABLE isn't set.
+func newTeamDefaultsStore() *teamDefaultsStore {
+	table := os.Getenv("TEAM_DEFAULTS_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &teamDefaultsStore{client: dynamoClient, table: table}
+}
+
+// get returns the defaults of teamName, nil if it has none.
+func (s *teamDefaultsStore) get(ctx context.Context, teamName string) (*teamDefaults, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"team_name": &types.AttributeValueMemberS{Value: teamName},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get defaults of team %s: %w", teamName, err)
+	}
+	value := stringAttribute(out.Item, "defaults")
+	if value == "" {
+		return nil, nil
+	}
+	var defaults teamDefaults
+	decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&defaults); err != nil {
+		return nil, fmt.Errorf("invalid defaults of team %s: %w", teamName, err)
+	}
+	return &defaults, nil
+}
+
+// applyTeamDefaults fills the settings a request leaves unset from its team's defaults. Requests naming the team by
+// team_id don't have defaults applied, the team's name is only known once it's looked up on the Fleet server.
+func applyTeamDefaults(ctx context.Context, request CreateInstallersRequest) (CreateInstallersRequest, error) {
+	store := newTeamDefaultsStore()
+	if store == nil || (request.TeamName == "" && !isGlobalRequest(request)) {
+		return request, nil
+	}
+	teamName := request.TeamName
+	if isGlobalRequest(request) {
+		teamName = globalTeamName
+	}
+	defaults, err := store.get(ctx, teamName)
+	if err != nil || defaults == nil {
+		return request, err
+	}
+	if len(request.Packages) == 0 {
+		request.Packages = defaults.Packages
+	}
+	if request.Architecture == "" && len(request.Architectures) == 0 {
+		request.Architectures = defaults.Architectures
+	}
+	if request.OrbitChannel == "" && request.OrbitVersion == "" {
+		request.OrbitChannel = defaults.OrbitChannel
+	}
+	if request.OsquerydChannel == "" && request.OsquerydVersion == "" {
+		request.OsquerydChannel = defaults.OsquerydChannel
+	}
+	if request.DesktopChannel == "" && request.DesktopVersion == "" {
+		request.DesktopChannel = defaults.DesktopChannel
+	}
+	if len(request.NotificationEmails) == 0 {
+		request.NotificationEmails = defaults.NotificationEmails
+	}
+	return request, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// nativeTools are the binaries the packaging library runs to build each package type with NativeTooling, the
+// container image bundles them. deb and rpm are built in-process and need none.
+var nativeTools = map[string][]string{
+	"msi": {"wine", "heat", "candle", "light"},
+	"pkg": {"xar", "mkbom", "cpio", "gzip"},
+}
+
+// missingTools returns the native tools packageType needs that aren't on the PATH.
+func missingTools(packageType string) []string {
+	var missing []string
+	for _, tool := range nativeTools[packageType] {
+		if _, err := exec.LookPath(tool); err != nil {
+			missing = append(missing, tool)
+		}
+	}
+	return missing
+}
+
+// detectPackageTypes returns the package types of packageTypes this process can build, checking the tools of the
+// ones it builds itself rather than on another execution backend, and records every supported package type's
+// capability. Without PACKAGE_TYPES, types missing tools are disabled, e.g. msi and pkg on the provided.al2 runtime,
+// explicitly enabled ones fail instead. The table of tools describes the Linux image, other systems aren't checked.
+func detectPackageTypes(packageTypes []string) ([]string, error) {
+	explicit := strings.TrimSpace(os.Getenv("PACKAGE_TYPES")) != ""
+	packageCapabilities = make(map[string]PackageCapability, len(supportedPackageTypes))
+	var detected, problems []string
+	for _, packageType := range supportedPackageTypes {
+		capability := PackageCapability{Type: packageType, Backend: lambdaBackend, Architectures: packageArchitectures[packageType]}
+		if backend := packageBackends[packageType]; backend != "" {
+			capability.Backend = backend
+		}
+		switch {
+		case !isSupported(packageTypes, packageType):
+			capability.Reason = "not listed in PACKAGE_TYPES"
+		case capability.Backend != lambdaBackend || runtime.GOOS != "linux":
+			capability.Buildable = true
+		default:
+			capability.MissingTools = missingTools(packageType)
+			capability.Buildable = len(capability.MissingTools) == 0
+			if !capability.Buildable {
+				capability.Reason = "missing " + strings.Join(capability.MissingTools, ", ")
+			}
+		}
+		packageCapabilities[packageType] = capability
+		switch {
+		case capability.Buildable:
+			detected = append(detected, packageType)
+		case capability.MissingTools == nil:
+		case explicit:
+			problems = append(problems, fmt.Sprintf("%s needs %s", packageType, strings.Join(capability.MissingTools, ", ")))
+		default:
+			log.Printf("not building %s installers, %s", packageType, capability.Reason)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("PACKAGE_TYPES lists package types whose tools aren't installed: %s", strings.Join(problems, "; "))
+	}
+	if len(detected) == 0 {
+		return nil, fmt.Errorf("no package type's tools are installed, run the packager's container image")
+	}
+	return detected, nil
+}
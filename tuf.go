@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/fleetdm/fleet/v4/orbit/pkg/packaging"
+	"github.com/fleetdm/fleet/v4/orbit/pkg/update"
+	"github.com/theupdateframework/go-tuf/client"
+)
+
+// tufPlatforms maps package types to the platform their components are published for in the TUF repository.
+var tufPlatforms = map[string]string{
+	"deb": "linux",
+	"rpm": "linux",
+	"pkg": "macos",
+	"msi": "windows",
+}
+
+// tufTargets is the part of a TUF repository's targets.json describing its targets.
+type tufTargets struct {
+	Signed struct {
+		Targets map[string]tufTarget `json:"targets"`
+	} `json:"signed"`
+}
+
+// tufTarget is a file in a TUF repository.
+type tufTarget struct {
+	Length int64             `json:"length"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+// component is an orbit component baked into an installer, resolved from the channel it was built with.
+type component struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+	// Version is the version the channel pointed at, or the channel if no versioned target matches it.
+	Version string `json:"version"`
+	// Target is the path of the component's target in the TUF repository.
+	Target string `json:"target"`
+	SHA512 string `json:"sha512"`
+	Size   int64  `json:"size"`
+}
+
+// componentTargets returns the TUF target path of every component packaged for packageType with options.
+func componentTargets(packageType string, options packaging.Options) []component {
+	platform := tufPlatforms[packageType]
+	orbit, osqueryd, desktop := "orbit", "osqueryd", "desktop.tar.gz"
+	if platform == "linux" && options.Architecture == archArm64 {
+		platform = "linux-arm64"
+	}
+	osquerydPlatform := platform
+	switch platform {
+	case "macos":
+		osquerydPlatform, osqueryd, desktop = "macos-app", "osqueryd.app.tar.gz", "desktop.app.tar.gz"
+	case "windows":
+		orbit, osqueryd, desktop = "orbit.exe", "osqueryd.exe", "fleet-desktop.exe"
+	}
+	components := []component{
+		{Name: "orbit", Channel: options.OrbitChannel, Target: fmt.Sprintf("orbit/%s/%s/%s", platform, options.OrbitChannel, orbit)},
+		{Name: "osqueryd", Channel: options.OsquerydChannel, Target: fmt.Sprintf("osqueryd/%s/%s/%s", osquerydPlatform, options.OsquerydChannel, osqueryd)},
+	}
+	if options.Desktop {
+		components = append(components, component{Name: "fleet-desktop", Channel: options.DesktopChannel, Target: fmt.Sprintf("desktop/%s/%s/%s", platform, options.DesktopChannel, desktop)})
+	}
+	return components
+}
+
+// resolveComponents returns the components of an installer built for packageType with options, with the versions
+// their channels currently point at in the TUF repository at options.UpdateURL. A channel's version is the most
+// specific versioned target with the same content, e.g. "1.16.0" over "1.16" for "stable". The repository's metadata
+// is verified against the root the installer pins, like the packaging library does, before its targets are trusted.
+func resolveComponents(ctx context.Context, packageType string, options packaging.Options) ([]component, error) {
+	targets, err := verifiedTUFTargets(ctx, options.UpdateURL, options.UpdateRoots)
+	if err != nil {
+		return nil, err
+	}
+
+	components := componentTargets(packageType, options)
+	for i, c := range components {
+		target, ok := targets.Signed.Targets[c.Target]
+		if !ok {
+			return nil, fmt.Errorf("TUF target %s not found", c.Target)
+		}
+		components[i].SHA512 = target.Hashes["sha512"]
+		components[i].Size = target.Length
+		components[i].Version = c.Channel
+
+		// the target's path is <name>/<platform>/<channel>/<file>, look for a version channel with the same content
+		segments := strings.Split(c.Target, "/")
+		for path, other := range targets.Signed.Targets {
+			otherSegments := strings.Split(path, "/")
+			if len(otherSegments) != len(segments) || otherSegments[0] != segments[0] || otherSegments[1] != segments[1] || otherSegments[3] != segments[3] {
+				continue
+			}
+			version := otherSegments[2]
+			if !isVersionChannel(version) || other.Hashes["sha512"] != components[i].SHA512 {
+				continue
+			}
+			if !isVersionChannel(components[i].Version) || len(version) > len(components[i].Version) {
+				components[i].Version = version
+			}
+		}
+	}
+	return components, nil
+}
+
+// verifiedTUFTargets returns the targets of the TUF repository at updateURL, once its root, timestamp, snapshot and
+// targets metadata were verified starting from the pinned root: the root keys updateRoots, or the root of Fleet's
+// repository the packaging library has built in if it's empty.
+func verifiedTUFTargets(ctx context.Context, updateURL string, updateRoots string) (tufTargets, error) {
+	remote, err := client.HTTPRemoteStore(strings.TrimRight(updateURL, "/"), nil, &http.Client{Transport: contextTransport{ctx: ctx}})
+	if err != nil {
+		return tufTargets{}, fmt.Errorf("invalid TUF repository URL %q: %w", updateURL, err)
+	}
+	if updateRoots == "" {
+		updateRoots = update.DefaultOptions.RootKeys
+	}
+	root, err := pinnedTUFRoot(remote, updateRoots)
+	if err != nil {
+		return tufTargets{}, err
+	}
+	tufClient := client.NewClient(client.MemoryLocalStore(), remote)
+	if err := tufClient.Init(root); err != nil {
+		return tufTargets{}, fmt.Errorf("failed to verify TUF root: %w", err)
+	}
+	if _, err := tufClient.Update(); err != nil {
+		return tufTargets{}, fmt.Errorf("failed to verify TUF metadata: %w", err)
+	}
+	files, err := tufClient.Targets()
+	if err != nil {
+		return tufTargets{}, fmt.Errorf("failed to get TUF targets: %w", err)
+	}
+	var targets tufTargets
+	targets.Signed.Targets = make(map[string]tufTarget, len(files))
+	for path, file := range files {
+		target := tufTarget{Length: file.Length, Hashes: map[string]string{}}
+		for algorithm, hash := range file.Hashes {
+			target.Hashes[algorithm] = hash.String()
+		}
+		targets.Signed.Targets[path] = target
+	}
+	return targets, nil
+}
+
+// pinnedTUFRoot returns the root.json to verify a repository's metadata from. A pinned root.json is returned as is,
+// for pinned root keys it's the first version of the repository's root signed by exactly those keys, later versions
+// are verified from it.
+func pinnedTUFRoot(remote client.RemoteStore, updateRoots string) ([]byte, error) {
+	var root tufRoot
+	if err := json.Unmarshal([]byte(updateRoots), &root); err == nil && root.Signed.Type == "root" {
+		return []byte(updateRoots), nil
+	}
+	pinned, err := tufRootKeySet(updateRoots)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TUF root keys: %w", err)
+	}
+	for version := 1; ; version++ {
+		name := fmt.Sprintf("%d.root.json", version)
+		body, _, err := remote.GetMeta(name)
+		if client.IsNotFound(err) {
+			return nil, errors.New("the TUF repository has no root signed by the pinned root keys")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get TUF %s: %w", name, err)
+		}
+		buf, err := io.ReadAll(io.LimitReader(body, maxTUFRootSize))
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get TUF %s: %w", name, err)
+		}
+		keys, err := tufRootKeys(buf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TUF %s: %w", name, err)
+		}
+		if set, err := tufRootKeySet(keys); err == nil && reflect.DeepEqual(set, pinned) {
+			return buf, nil
+		}
+	}
+}
+
+// tufRootKeySet returns the root keys of a JSON list, canonically encoded so lists of the same keys compare equal
+// whatever their order and formatting.
+func tufRootKeySet(keys string) (map[string]bool, error) {
+	var list []any
+	if err := json.Unmarshal([]byte(keys), &list); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, key := range list {
+		buf, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		set[string(buf)] = true
+	}
+	return set, nil
+}
+
+// contextTransport sends the requests of clients that don't take a context, like go-tuf's, with ctx.
+type contextTransport struct {
+	ctx context.Context
+}
+
+func (t contextTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	return http.DefaultTransport.RoundTrip(request.WithContext(t.ctx))
+}
+
+// isVersionChannel reports whether a TUF channel is a version, e.g. "1.16.0", rather than a name like "stable".
+func isVersionChannel(channel string) bool {
+	return channel != "" && unicode.IsDigit(rune(channel[0]))
+}
+
+// maxTUFRootSize bounds the root.json versions read looking for the pinned root.
+const maxTUFRootSize = 512 << 10
+
+// tufRoot is the part of a TUF repository's root.json naming the keys its root role signs with.
+type tufRoot struct {
+	Signed struct {
+		Type  string                     `json:"_type"`
+		Keys  map[string]json.RawMessage `json:"keys"`
+		Roles map[string]struct {
+			KeyIDs []string `json:"keyids"`
+		} `json:"roles"`
+	} `json:"signed"`
+}
+
+// loadTUFRoots returns the root keys installers and their builds trust the TUF repository with, read from the
+// root.json in TUF_ROOT or the S3 object TUF_ROOT_URI, e.g. of a self-hosted repository. It returns an empty string
+// if neither is set, for the root of Fleet's repository the packaging library has built in.
+func loadTUFRoots(ctx context.Context) (string, error) {
+	content, uri := os.Getenv("TUF_ROOT"), os.Getenv("TUF_ROOT_URI")
+	switch {
+	case content != "" && uri != "":
+		return "", errors.New("TUF_ROOT and TUF_ROOT_URI can't both be set")
+	case uri != "":
+		bucket, key, err := parseS3URI(uri)
+		if err != nil {
+			return "", fmt.Errorf("invalid TUF_ROOT_URI: %w", err)
+		}
+		buf, err := (&s3ArtifactStore{bucket: bucket}).GetObject(ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read TUF_ROOT_URI: %w", err)
+		}
+		content = string(buf)
+	case content == "":
+		return "", nil
+	}
+	return tufRootKeys([]byte(content))
+}
+
+// tufRootKeys returns the keys of the root role of a root.json, JSON encoded like the output of fleetctl updates
+// roots, which is what the packaging library takes. A list of keys is returned as is.
+func tufRootKeys(content []byte) (string, error) {
+	var keys []json.RawMessage
+	if err := json.Unmarshal(content, &keys); err == nil {
+		if len(keys) == 0 {
+			return "", errors.New("the TUF root lists no keys")
+		}
+		buf, err := json.Marshal(keys)
+		return string(buf), err
+	}
+	var root tufRoot
+	if err := json.Unmarshal(content, &root); err != nil {
+		return "", fmt.Errorf("invalid TUF root: %w", err)
+	}
+	if root.Signed.Type != "root" {
+		return "", fmt.Errorf("invalid TUF root: %q metadata isn't a root.json", root.Signed.Type)
+	}
+	for _, id := range root.Signed.Roles["root"].KeyIDs {
+		key, ok := root.Signed.Keys[id]
+		if !ok {
+			return "", fmt.Errorf("invalid TUF root: root key %s isn't listed", id)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return "", errors.New("invalid TUF root: the root role has no keys")
+	}
+	buf, err := json.Marshal(keys)
+	return string(buf), err
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	defaultTUFCacheDir = "/tmp/tuf-cache"
+	// defaultTUFCacheMaxSize bounds the cached target files, unless TUF_CACHE_MAX_SIZE is set, leaving most of the
+	// function's /tmp to builds.
+	defaultTUFCacheMaxSize = 256 << 20
+	// tufTargetsTTL is how long a repository's targets.json is reused to look up the targets requested, the packaging
+	// library fetches and verifies the metadata itself on every build.
+	tufTargetsTTL = time.Minute
+)
+
+// systemCertBundles are the CA bundles Go reads on Linux, the first one found is extended with the TUF cache's CA.
+var systemCertBundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// tufCache is an in-process proxy keeping the agent binaries the packaging library downloads from the TUF repository
+// in /tmp, so warm invocations don't download them again. The library downloads from the installers' own update URL
+// and builds its own HTTP client, so the cache can't be passed to it: it's set as the process's HTTP(S) proxy instead,
+// intercepts the TLS connections to the TUF repository with a certificate of a CA only this process trusts, and
+// tunnels every other connection unchanged.
+type tufCache struct {
+	dir          string
+	maxSize      int64
+	repositories []*url.URL
+	certs        map[string]*tls.Certificate
+	upstream     *http.Transport
+	// upstreamProxy is the proxy the cache itself goes through, OUTBOUND_PROXY_URL or HTTPS_PROXY, nil for none.
+	upstreamProxy *url.URL
+	forward       *httputil.ReverseProxy
+	// mirror is the bucket of TUF_CACHE_S3_URI, holding copies of the repository's files under mirrorPrefix, nil
+	// without a mirror.
+	mirror       *s3ArtifactStore
+	mirrorPrefix string
+	// offline never contacts the repository, serving everything from the mirror.
+	offline bool
+	// seed copies the files downloaded from the repository to the mirror.
+	seed bool
+
+	mu      sync.Mutex
+	targets map[string]cachedTUFTargets
+}
+
+// cachedTUFTargets is a repository's targets.json, fetched at fetchedAt.
+type cachedTUFTargets struct {
+	targets   tufTargets
+	fetchedAt time.Time
+}
+
+// startTUFCache starts the TUF cache in front of TUF_UPDATE_URL when TUF_CACHE or TUF_CACHE_S3_URI is set, and makes
+// it the process's HTTP(S) proxy. It has to run after applyProxy, whose proxy it goes through, and before any call is
+// made.
+func startTUFCache() error {
+	enabled, _ := strconv.ParseBool(os.Getenv("TUF_CACHE"))
+	mirrorURI := os.Getenv("TUF_CACHE_S3_URI")
+	if !enabled && mirrorURI == "" {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		log.Printf("TUF_CACHE is only supported on Linux, downloading agents from the TUF repository")
+		return nil
+	}
+	cache := &tufCache{dir: defaultTUFCacheDir, maxSize: defaultTUFCacheMaxSize, certs: map[string]*tls.Certificate{}, targets: map[string]cachedTUFTargets{}}
+	if dir := os.Getenv("TUF_CACHE_DIR"); dir != "" {
+		cache.dir = dir
+	}
+	if v := os.Getenv("TUF_CACHE_MAX_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("invalid TUF_CACHE_MAX_SIZE %q, must be a positive number of bytes", v)
+		}
+		cache.maxSize = size
+	}
+	if mirrorURI != "" {
+		bucket, prefix, err := parseS3URI(strings.TrimRight(mirrorURI, "/") + "/")
+		if err != nil {
+			return fmt.Errorf("invalid TUF_CACHE_S3_URI: %w", err)
+		}
+		cache.mirror, cache.mirrorPrefix = &s3ArtifactStore{bucket: bucket}, prefix
+	}
+	for name, value := range map[string]*bool{"TUF_CACHE_OFFLINE": &cache.offline, "TUF_CACHE_SEED": &cache.seed} {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, v, err)
+			}
+			if b && cache.mirror == nil {
+				return fmt.Errorf("%s requires TUF_CACHE_S3_URI", name)
+			}
+			*value = b
+		}
+	}
+	if cache.offline && cache.seed {
+		return errors.New("TUF_CACHE_OFFLINE and TUF_CACHE_SEED can't both be set")
+	}
+	if err := os.MkdirAll(cache.dir, 0o700); err != nil {
+		return err
+	}
+	repository, err := url.Parse(strings.TrimRight(appConfig.PackagingDefaults.UpdateURL, "/"))
+	if err != nil {
+		return err
+	}
+	cache.repositories = append(cache.repositories, repository)
+
+	if proxy := os.Getenv("HTTPS_PROXY"); proxy != "" {
+		if cache.upstreamProxy, err = url.Parse(proxy); err != nil {
+			return fmt.Errorf("invalid HTTPS_PROXY: %w", err)
+		}
+	}
+	cache.upstream = &http.Transport{
+		Proxy:               http.ProxyURL(cache.upstreamProxy),
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	cache.forward = &httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: cache.upstream}
+
+	ca, caKey, err := newTUFCacheCA()
+	if err != nil {
+		return err
+	}
+	if repository.Scheme == "https" {
+		cert, err := newTUFCacheCertificate(ca, caKey, repository.Hostname())
+		if err != nil {
+			return err
+		}
+		cache.certs[repository.Hostname()] = cert
+	}
+	if err := trustTUFCacheCA(cache.dir, ca); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := http.Serve(listener, cache); err != nil {
+			log.Printf("TUF cache stopped: %s", err)
+		}
+	}()
+	proxyURL := "http://" + listener.Addr().String()
+	os.Setenv("HTTP_PROXY", proxyURL)
+	os.Setenv("HTTPS_PROXY", proxyURL)
+	switch {
+	case cache.offline:
+		log.Printf("serving %s from %s offline, caching agents in %s", repository, cache.mirror.URL(cache.mirrorPrefix), cache.dir)
+	case cache.mirror != nil:
+		log.Printf("caching agents downloaded from %s in %s and %s", repository, cache.mirror.URL(cache.mirrorPrefix), cache.dir)
+	default:
+		log.Printf("caching agents downloaded from %s in %s", repository, cache.dir)
+	}
+	return nil
+}
+
+// newTUFCacheCA returns a CA certificate and key generated for this process, the key is never written anywhere.
+func newTUFCacheCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "fleet packager TUF cache"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	return ca, key, err
+}
+
+// newTUFCacheCertificate returns a certificate for host signed by the cache's CA.
+func newTUFCacheCertificate(ca *x509.Certificate, caKey *ecdsa.PrivateKey, host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    ca.NotBefore,
+		NotAfter:     ca.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// trustTUFCacheCA adds ca to the certificates the process trusts, by pointing SSL_CERT_FILE at the system's bundle
+// with ca appended. Go reads SSL_CERT_FILE once, the first time a certificate is verified.
+func trustTUFCacheCA(dir string, ca *x509.Certificate) error {
+	var bundle []byte
+	files := systemCertBundles
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		files = []string{file}
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err == nil {
+			bundle = append(content, '\n')
+			break
+		}
+	}
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})...)
+	path := filepath.Join(dir, "ca-bundle.pem")
+	if err := os.WriteFile(path, bundle, 0o600); err != nil {
+		return err
+	}
+	return os.Setenv("SSL_CERT_FILE", path)
+}
+
+// ServeHTTP proxies a request, serving the TUF repository's targets from the cache.
+func (c *tufCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		c.connect(w, r)
+		return
+	}
+	if r.URL.Host == "" {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodGet {
+		for _, repository := range c.repositories {
+			if !sameHost(r.URL, repository) {
+				continue
+			}
+			name, ok := strings.CutPrefix(r.URL.Path, repository.Path+"/")
+			if !ok {
+				continue
+			}
+			if target, ok := strings.CutPrefix(name, "targets/"); ok {
+				c.serveTarget(w, r, repository, target)
+				return
+			}
+			if c.mirror != nil && strings.HasSuffix(name, ".json") && !strings.Contains(name, "/") {
+				c.serveMetadata(w, r, repository, name)
+				return
+			}
+		}
+	}
+	c.forward.ServeHTTP(w, r)
+}
+
+// sameHost reports whether two URLs address the same scheme, host and port.
+func sameHost(u, other *url.URL) bool {
+	return u.Scheme == other.Scheme && u.Hostname() == other.Hostname() && urlPort(u) == urlPort(other)
+}
+
+// urlPort returns a URL's port, the scheme's default if it has none.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// connect intercepts CONNECT requests to the TUF repository and tunnels the others.
+func (c *tufCache) connect(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cert := c.certs[host]
+	var upstream net.Conn
+	if cert == nil {
+		if upstream, err = c.dial(r.Context(), r.Host); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		conn.Close()
+		if upstream != nil {
+			upstream.Close()
+		}
+		return
+	}
+	if upstream != nil {
+		go func() {
+			io.Copy(upstream, buffered)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+		return
+	}
+
+	tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.URL.Scheme, req.URL.Host = "https", net.JoinHostPort(host, port)
+		c.ServeHTTP(w, req)
+	})}
+	server.Serve(&oneConnListener{conn: tlsConn, addr: conn.LocalAddr()})
+}
+
+// dial connects to addr, through the upstream proxy if there's one.
+func (c *tufCache) dial(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if c.upstreamProxy == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.upstreamProxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	request := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if user := c.upstreamProxy.User; user != nil {
+		password, _ := user.Password()
+		request.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused to connect to %s: %s", addr, response.Status)
+	}
+	if reader.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was established")
+	}
+	return conn, nil
+}
+
+// oneConnListener is a net.Listener accepting a single, already established connection.
+type oneConnListener struct {
+	conn net.Conn
+	addr net.Addr
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		return nil, io.EOF
+	}
+	conn := l.conn
+	l.conn = nil
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error   { return nil }
+func (l *oneConnListener) Addr() net.Addr { return l.addr }
+
+// serveTarget serves the target name of repository from the cache, fetching it first if it isn't cached. Targets
+// are cached by the SHA-512 the repository's targets.json lists, so a channel's file is reused until the channel
+// points at another version, and cached files are verified against it again before they're served.
+func (c *tufCache) serveTarget(w http.ResponseWriter, r *http.Request, repository *url.URL, name string) {
+	targets, err := c.repositoryTargets(r.Context(), repository)
+	if err != nil {
+		c.unavailable(w, r, fmt.Errorf("not caching %s: %w", name, err))
+		return
+	}
+	target, ok := targets.Signed.Targets[name]
+	if !ok || len(target.Hashes["sha512"]) != sha512.Size*2 {
+		c.unavailable(w, r, fmt.Errorf("%s isn't a target of %s", name, repository))
+		return
+	}
+	path := filepath.Join(c.dir, target.Hashes["sha512"])
+	if err := verifyTUFTarget(path, target); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("TUF cache: discarding %s: %s", name, err)
+		}
+		if err := c.fetchTarget(r, path, target); err != nil {
+			c.unavailable(w, r, err)
+			return
+		}
+		c.prune(path)
+	} else {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(target.Length, 10))
+	io.Copy(w, file)
+}
+
+// unavailable answers a request the cache can't serve: offline with a 502, otherwise by passing it on to the
+// repository.
+func (c *tufCache) unavailable(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("TUF cache: %s", err)
+	if c.offline {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	c.forward.ServeHTTP(w, r)
+}
+
+// fetchTarget stores the target r asks for at path, from the S3 mirror if it has it, else from the repository.
+// Targets downloaded from the repository are copied to the mirror when seeding.
+func (c *tufCache) fetchTarget(r *http.Request, path string, target tufTarget) error {
+	if c.mirror != nil {
+		err := c.fetchMirrorTarget(r.Context(), path, target)
+		if err == nil {
+			return nil
+		}
+		if c.offline {
+			return err
+		}
+		if !errors.Is(err, errObjectNotFound) {
+			log.Printf("TUF cache: %s, downloading %s from the repository", err, r.URL)
+		}
+	}
+	if err := c.download(r, path, target); err != nil {
+		return err
+	}
+	if c.seed {
+		if err := c.seedTarget(r.Context(), path, target); err != nil {
+			log.Printf("TUF cache: failed to seed %s: %s", r.URL, err)
+		}
+	}
+	return nil
+}
+
+// repositoryTargets returns the targets.json of repository, fetched at most tufTargetsTTL ago.
+func (c *tufCache) repositoryTargets(ctx context.Context, repository *url.URL) (tufTargets, error) {
+	c.mu.Lock()
+	cached, ok := c.targets[repository.String()]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < tufTargetsTTL {
+		return cached.targets, nil
+	}
+	body, err := c.metadata(ctx, repository, "targets.json")
+	if err != nil {
+		return tufTargets{}, fmt.Errorf("failed to get TUF targets: %w", err)
+	}
+	var targets tufTargets
+	if err := json.Unmarshal(body, &targets); err != nil {
+		return tufTargets{}, fmt.Errorf("failed to parse TUF targets: %w", err)
+	}
+	c.mu.Lock()
+	c.targets[repository.String()] = cachedTUFTargets{targets: targets, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return targets, nil
+}
+
+// serveMetadata serves the metadata file name of repository, see metadata.
+func (c *tufCache) serveMetadata(w http.ResponseWriter, r *http.Request, repository *url.URL, name string) {
+	body, err := c.metadata(r.Context(), repository, name)
+	switch {
+	case errors.Is(err, errObjectNotFound):
+		http.NotFound(w, r)
+	case err != nil:
+		log.Printf("TUF cache: %s", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// metadata returns the metadata file name of repository, or errObjectNotFound if the repository doesn't have it,
+// e.g. the next version of root.json. It's fetched from the repository, and copied to the S3 mirror when seeding,
+// falling back to the mirror's copy while the repository can't be reached. Offline, it's read from the mirror only.
+func (c *tufCache) metadata(ctx context.Context, repository *url.URL, name string) ([]byte, error) {
+	if !c.offline {
+		body, err := c.get(ctx, repository.String()+"/"+name)
+		switch {
+		case err == nil:
+			if c.seed {
+				if err := c.mirror.PutObject(ctx, c.mirrorKey("metadata", name), body, "application/json", buildJob{}); err != nil {
+					log.Printf("TUF cache: failed to seed %s: %s", name, err)
+				}
+			}
+			return body, nil
+		case errors.Is(err, errObjectNotFound) || c.mirror == nil:
+			return nil, err
+		}
+		log.Printf("TUF cache: %s, reading %s from %s", err, name, c.mirror.URL(c.mirrorKey("metadata", name)))
+	}
+	return c.mirror.GetObject(ctx, c.mirrorKey("metadata", name))
+}
+
+// get returns the content of url, or errObjectNotFound if the repository answers with a 404.
+func (c *tufCache) get(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.upstream.RoundTrip(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", url, err)
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(response.Body)
+	case http.StatusNotFound:
+		return nil, errObjectNotFound
+	}
+	return nil, fmt.Errorf("failed to get %s: unexpected status code %d", url, response.StatusCode)
+}
+
+// download fetches the target r asks for from the repository into path.
+func (c *tufCache) download(r *http.Request, path string, target tufTarget) error {
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, r.URL.String(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := c.upstream.RoundTrip(request)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %w", r.URL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: unexpected status code %d", r.URL, response.StatusCode)
+	}
+	if err := c.store(response.Body, path, target); err != nil {
+		return fmt.Errorf("failed to download %s: %w", r.URL, err)
+	}
+	return nil
+}
+
+// fetchMirrorTarget fetches target from the S3 mirror into path, or returns errObjectNotFound.
+func (c *tufCache) fetchMirrorTarget(ctx context.Context, path string, target tufTarget) error {
+	key := c.mirrorKey("targets", target.Hashes["sha512"])
+	out, err := s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(c.mirror.bucket), Key: aws.String(key)})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return errObjectNotFound
+		}
+		return fmt.Errorf("failed to get %s: %w", c.mirror.URL(key), err)
+	}
+	defer out.Body.Close()
+	if err := c.store(out.Body, path, target); err != nil {
+		return fmt.Errorf("failed to get %s: %w", c.mirror.URL(key), err)
+	}
+	return nil
+}
+
+// seedTarget copies the cached target at path to the S3 mirror.
+func (c *tufCache) seedTarget(ctx context.Context, path string, target tufTarget) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(c.mirror.bucket),
+		Key:           aws.String(c.mirrorKey("targets", target.Hashes["sha512"])),
+		Body:          file,
+		ContentLength: target.Length,
+		ContentType:   aws.String("application/octet-stream"),
+	})
+	return err
+}
+
+// mirrorKey returns the key of a file in the S3 mirror: metadata by name, targets by their SHA-512.
+func (c *tufCache) mirrorKey(kind string, name string) string {
+	return c.mirrorPrefix + kind + "/" + name
+}
+
+// store writes the target read from body to path, once verified.
+func (c *tufCache) store(body io.Reader, path string, target tufTarget) error {
+	file, err := os.CreateTemp(c.dir, "download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, io.LimitReader(body, target.Length+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := verifyTUFTarget(file.Name(), target); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// verifyTUFTarget checks the file at path has the length and SHA-512 of target.
+func verifyTUFTarget(path string, target tufTarget) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha512.New()
+	n, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if n != target.Length {
+		return fmt.Errorf("has %d bytes, the TUF repository lists %d", n, target.Length)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != target.Hashes["sha512"] {
+		return fmt.Errorf("has SHA-512 %s, the TUF repository lists %s", sum, target.Hashes["sha512"])
+	}
+	return nil
+}
+
+// prune removes the least recently used targets until the cache fits its maximum size, keeping the file at keep.
+func (c *tufCache) prune(keep string) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	var files []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || len(entry.Name()) != sha512.Size*2 {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		if size <= c.maxSize {
+			return
+		}
+		path := filepath.Join(c.dir, info.Name())
+		if path == keep {
+			continue
+		}
+		if err := os.Remove(path); err == nil {
+			size -= info.Size()
+		}
+	}
+}
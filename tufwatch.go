@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// tufWatchStateKey is the key of the TUF watcher's state in the artifact store.
+const tufWatchStateKey = "tuf-watch/state.json"
+
+// tufWatchState is what the TUF watcher saw on its last run.
+type tufWatchState struct {
+	UpdateURL string `json:"update_url"`
+	// Targets maps the TUF targets the deployment's installers are built from to their SHA-512.
+	Targets map[string]string `json:"targets"`
+	// ChangedAt is when the targets last changed, teams built before are rebuilt.
+	ChangedAt time.Time `json:"changed_at"`
+	// Pending is set while teams built before ChangedAt are left to rebuild, see rebuildMinRemaining.
+	Pending   bool      `json:"pending"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// isTUFWatchEvent reports whether a scheduled event was sent by the EventBridge rule named TUF_WATCH_RULE.
+func isTUFWatchEvent(event events.CloudWatchEvent) bool {
+	rule := os.Getenv("TUF_WATCH_RULE")
+	if rule == "" {
+		return false
+	}
+	for _, resource := range event.Resources {
+		if strings.HasSuffix(resource, ":rule/"+rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// tufWatchTargets returns the TUF targets installers of every enabled package type are built from with the
+// deployment's defaults, by target path.
+func tufWatchTargets(ctx context.Context) (map[string]string, error) {
+	options := appConfig.PackagingDefaults
+	options.Desktop = true
+	targets := map[string]string{}
+	for _, packageType := range enabledPackageTypes {
+		components, err := resolveComponents(ctx, packageType, options)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range components {
+			targets[c.Target] = c.SHA512
+		}
+	}
+	return targets, nil
+}
+
+// handleTUFWatch checks whether the agent components the deployment's installers are built from changed in the TUF
+// repository, e.g. because a new orbit release was promoted to stable, and rebuilds the teams built before the
+// change. The first run only records the current targets. Teams deferred for lack of time are rebuilt by the next
+// runs, before changes are looked for again.
+func handleTUFWatch(ctx context.Context) (RebuildReport, error) {
+	state := tufWatchState{}
+	buf, err := artifactStore.GetObject(ctx, tufWatchStateKey)
+	switch {
+	case errors.Is(err, errObjectNotFound):
+	case err != nil:
+		return RebuildReport{}, fmt.Errorf("failed to read TUF watcher state: %w", err)
+	default:
+		if err := json.Unmarshal(buf, &state); err != nil {
+			return RebuildReport{}, fmt.Errorf("failed to parse TUF watcher state: %w", err)
+		}
+	}
+
+	targets, err := tufWatchTargets(ctx)
+	if err != nil {
+		return RebuildReport{}, err
+	}
+	now := time.Now().UTC()
+	report := RebuildReport{SchemaVersion: currentSchemaVersion, Teams: []RebuiltTeam{}, Skipped: []string{}, Deferred: []string{}}
+	switch {
+	case state.Targets == nil || state.UpdateURL != appConfig.PackagingDefaults.UpdateURL:
+		log.Printf("TUF watcher recorded the targets of %s", appConfig.PackagingDefaults.UpdateURL)
+		state = tufWatchState{UpdateURL: appConfig.PackagingDefaults.UpdateURL, Targets: targets, ChangedAt: now}
+	default:
+		if changed := changedTargets(state.Targets, targets); len(changed) > 0 {
+			log.Printf("TUF targets changed, rebuilding teams: %s", strings.Join(changed, ", "))
+			state.Targets, state.ChangedAt, state.Pending = targets, now, true
+		}
+	}
+	if state.Pending {
+		report, err = rebuildTeams(ctx, state.ChangedAt)
+		if err != nil {
+			return report, err
+		}
+		state.Pending = len(report.Deferred) > 0
+	}
+
+	state.CheckedAt = now
+	buf, err = json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	if err := artifactStore.PutObject(ctx, tufWatchStateKey, buf, "application/json", buildJob{}); err != nil {
+		return report, fmt.Errorf("failed to store TUF watcher state: %w", err)
+	}
+	return report, nil
+}
+
+// changedTargets returns the targets whose content differs between old and current, nil if none does.
+func changedTargets(old, current map[string]string) []string {
+	var changed []string
+	for target, sha512 := range current {
+		if old[target] != sha512 {
+			changed = append(changed, target)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
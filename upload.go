@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// artifactLayoutTeam stores installers under the key rendered from the key template, the default.
+	artifactLayoutTeam = "team"
+	// artifactLayoutContent stores installers under sha256/<digest>/<file> with a pointer object per team, so
+	// identical installers are stored once and never overwritten. Pointer keys are rendered from the key template.
+	artifactLayoutContent = "content"
+)
+
+// artifactUploader uploads installers with multipart uploads, it's created from s3Client by newArtifactUploader.
+var artifactUploader *manager.Uploader
+
+// newArtifactUploader returns the transfer manager used to upload installers. ARTIFACT_UPLOAD_PART_SIZE_MB (at
+// least 5) and ARTIFACT_UPLOAD_CONCURRENCY tune the size of the parts and how many are uploaded in parallel.
+func newArtifactUploader(client *s3.Client) (*manager.Uploader, error) {
+	partSize := manager.DefaultUploadPartSize
+	if v := os.Getenv("ARTIFACT_UPLOAD_PART_SIZE_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb*1024*1024 < manager.MinUploadPartSize {
+			return nil, fmt.Errorf("invalid ARTIFACT_UPLOAD_PART_SIZE_MB %q, must be a number of at least 5", v)
+		}
+		partSize = mb * 1024 * 1024
+	}
+	concurrency := manager.DefaultUploadConcurrency
+	if v := os.Getenv("ARTIFACT_UPLOAD_CONCURRENCY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid ARTIFACT_UPLOAD_CONCURRENCY %q, must be a positive number", v)
+		}
+		concurrency = n
+	}
+	return manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = partSize
+		u.Concurrency = concurrency
+	}), nil
+}
+
+// defaultUploadRetryPolicy is used unless overridden with the UPLOAD_MAX_ATTEMPTS, UPLOAD_RETRY_BASE_DELAY and
+// UPLOAD_RETRY_MAX_DELAY env vars.
+var defaultUploadRetryPolicy = retryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 20 * time.Second}
+
+// uploadRetryPolicy is the retry policy of artifact uploads, set in main.
+var uploadRetryPolicy = defaultUploadRetryPolicy
+
+// contentTypes maps package types to the MIME type their installers are served with.
+var contentTypes = map[string]string{
+	"deb": "application/vnd.debian.binary-package",
+	"rpm": "application/x-rpm",
+	"pkg": "application/x-newton-compatible-pkg",
+	"msi": "application/x-msi",
+}
+
+// artifactPointer is the per team object pointing at a content addressed installer.
+type artifactPointer struct {
+	Key       string    `json:"key"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// artifactLayout returns the object layout selected with ARTIFACT_LAYOUT.
+func artifactLayout() string {
+	if os.Getenv("ARTIFACT_LAYOUT") == artifactLayoutContent {
+		return artifactLayoutContent
+	}
+	return artifactLayoutTeam
+}
+
+// artifactURL returns the URL of an object key in the artifact store, e.g. s3://bucket/key.
+func artifactURL(key string) string {
+	return artifactStore.URL(key)
+}
+
+// artifactContentType returns the MIME type installers of packageType are served with.
+func artifactContentType(packageType string) string {
+	if contentType, ok := contentTypes[packageType]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// contentDisposition returns the Content-Disposition that makes browsers save a download as name.
+func contentDisposition(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": name})
+}
+
+// defaultKeyTemplate is the object key template used unless ARTIFACT_KEY_TEMPLATE or the request sets one.
+const defaultKeyTemplate = "teamName={{.Team}}/{{.File}}"
+
+// defaultInstanceKeyTemplate is the default object key template of installers for a named Fleet instance, keeping
+// them apart from the same team's installers for other instances.
+const defaultInstanceKeyTemplate = "fleetInstance={{.Instance}}/teamName={{.Team}}/{{.File}}"
+
+// objectKeyData holds the values available to object key templates.
+type objectKeyData struct {
+	// Team is the team name, escaped with escapeKeySegment.
+	Team string
+	// Package is the package type, e.g. "deb".
+	Package string
+	// File is the artifact's file name, see artifactFileName.
+	File string
+	// Date is the upload date as YYYY-MM-DD, Year, Month and Day are its parts.
+	Date  string
+	Year  string
+	Month string
+	Day   string
+	// Version is the orbit version or channel the installer was built with.
+	Version string
+	// Arch is the architecture the installer is built for, e.g. "arm64", see packageArchitecture.
+	Arch string
+	// Instance is the Fleet instance the installer enrolls to, empty for FLEET_URL.
+	Instance string
+}
+
+// newObjectKeyData returns the template values for uploading an artifact named file built by job at time t.
+func newObjectKeyData(job buildJob, file string, t time.Time) objectKeyData {
+	t = t.UTC()
+	return objectKeyData{
+		Team:     escapeKeySegment(job.TeamName),
+		Package:  job.PackageType,
+		File:     file,
+		Date:     t.Format("2006-01-02"),
+		Year:     t.Format("2006"),
+		Month:    t.Format("01"),
+		Day:      t.Format("02"),
+		Version:  job.Options.OrbitChannel,
+		Arch:     packageArchitecture(job.PackageType, job.Architecture),
+		Instance: job.FleetInstance,
+	}
+}
+
+// fileNameData holds the values available to artifact file name templates.
+type fileNameData struct {
+	// Team is the team name, escaped with escapeKeySegment.
+	Team string
+	// Package is the package type, e.g. "deb".
+	Package string
+	// File is the base name of the built installer file.
+	File string
+	// Ext is the extension of the built installer file without the leading dot.
+	Ext string
+	// Arch is the architecture the installer is built for, e.g. "arm64", see packageArchitecture.
+	Arch string
+}
+
+// artifactFileName returns the file name an installer built by job is uploaded as. The local build directory is
+// never part of it: without a name template it's the base name of the built file, otherwise the template is
+// rendered, e.g. "fleet-osquery-{{.Team}}.{{.Ext}}" always yields the same name for a team and package type.
+func artifactFileName(job buildJob, builtPath string) (string, error) {
+	file := filepath.Base(builtPath)
+	if job.NameTemplate == "" {
+		return file, nil
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(job.NameTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, fileNameData{
+		Team:    escapeKeySegment(job.TeamName),
+		Package: job.PackageType,
+		File:    file,
+		Ext:     strings.TrimPrefix(filepath.Ext(file), "."),
+		Arch:    packageArchitecture(job.PackageType, job.Architecture),
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+	name := buf.String()
+	if name == "" || strings.Contains(name, "/") {
+		return "", fmt.Errorf("invalid name template: rendered %q, names must be non-empty and not contain \"/\"", name)
+	}
+	return name, nil
+}
+
+// nameTemplate returns the artifact file name template for a request: the request's artifact_name, else
+// ARTIFACT_NAME_TEMPLATE. Empty means the built file's own name is used.
+func nameTemplate(installersRequest CreateInstallersRequest) string {
+	if installersRequest.ArtifactName != "" {
+		return installersRequest.ArtifactName
+	}
+	return os.Getenv("ARTIFACT_NAME_TEMPLATE")
+}
+
+// keyTemplate returns the object key template for a request: the request's key_template, else
+// ARTIFACT_KEY_TEMPLATE, else defaultKeyTemplate.
+func keyTemplate(installersRequest CreateInstallersRequest) string {
+	if installersRequest.KeyTemplate != "" {
+		return installersRequest.KeyTemplate
+	}
+	if v := os.Getenv("ARTIFACT_KEY_TEMPLATE"); v != "" {
+		return v
+	}
+	if installersRequest.FleetInstance != "" {
+		return defaultInstanceKeyTemplate
+	}
+	return defaultKeyTemplate
+}
+
+// objectKey renders an object key template, e.g. "installers/dt={{.Date}}/team={{.Team}}/{{.File}}".
+func objectKey(keyTemplate string, data objectKeyData) (string, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(keyTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid key template: %w", err)
+	}
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("invalid key template: %w", err)
+	}
+	key := strings.TrimLeft(buf.String(), "/")
+	if key == "" {
+		return "", errors.New("invalid key template: rendered an empty key")
+	}
+	return key, nil
+}
+
+// escapeKeySegment makes s safe to use as a single object key segment. Bytes outside [A-Za-z0-9._-] are
+// percent-encoded, so slashes, "=", spaces and unicode can't add key segments or partitions, and distinct team
+// names never map to the same key.
+func escapeKeySegment(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// contentObjectKey returns the content addressed key of an artifact named file.
+func contentObjectKey(digest string, file string) string {
+	return fmt.Sprintf("sha256/%s/%s", digest, file)
+}
+
+// pointerObjectKey returns the key of the team's pointer to a content addressed artifact named file, rendered from
+// the job's key template with the pointer's file name.
+func pointerObjectKey(job buildJob, file string) (string, error) {
+	return objectKey(job.KeyTemplate, newObjectKeyData(job, file+".json", time.Now()))
+}
+
+// uploadArtifact uploads a built installer to the artifact store and returns its object key. With the default
+// layout its key is rendered from the job's key template, with the content layout it's stored under its digest.
+// The installer's SHA-256 checksum is attached as object metadata.
+func uploadArtifact(store ArtifactStore, built artifact, job buildJob) (string, error) {
+	if appConfig.ArtifactBucket == "" {
+		return "", errors.New("bucket name cannot be empty")
+	}
+	name, err := artifactFileName(job, built.Path)
+	if err != nil {
+		return "", err
+	}
+	if artifactLayout() == artifactLayoutContent {
+		return uploadContentAddressed(context.Background(), store, built, job, name)
+	}
+	key, err := objectKey(job.KeyTemplate, newObjectKeyData(job, name, time.Now()))
+	if err != nil {
+		return "", err
+	}
+	key = job.StagingPrefix + key
+	if err := store.PutArtifact(context.Background(), key, built, job, name); err != nil {
+		return "", err
+	}
+	log.Println("successfully uploaded to bucket")
+	return key, nil
+}
+
+// uploadContentAddressed stores a built installer under its digest, unless an identical installer was already
+// uploaded, and points the team's pointer object at it. Content addressed objects are immutable.
+func uploadContentAddressed(ctx context.Context, store ArtifactStore, built artifact, job buildJob, name string) (string, error) {
+	key := contentObjectKey(built.SHA256, name)
+	existing, err := store.StatObject(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	if existing != nil {
+		log.Printf("%s already uploaded, skipping", key)
+	} else {
+		if err := store.PutArtifact(ctx, key, built, job, name); err != nil {
+			return "", err
+		}
+		log.Println("successfully uploaded to bucket")
+	}
+
+	pointerKey, err := pointerObjectKey(job, name)
+	if err != nil {
+		return "", err
+	}
+	buf, err := json.Marshal(artifactPointer{Key: key, SHA256: built.SHA256, Size: built.Size, UpdatedAt: time.Now()})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal artifact pointer: %w", err)
+	}
+	if err := store.PutObject(ctx, pointerKey, buf, "application/json", job); err != nil {
+		return "", fmt.Errorf("failed to write artifact pointer: %w", err)
+	}
+	return key, nil
+}
+
+// putArtifact uploads the installer file to key in an S3 bucket, in parts when it's larger than the uploader's part
+// size. The object gets the package type's content type and a Content-Disposition so browsers save it as name. S3
+// validates the payload against its SHA-256 checksum, and the stored object is checked with verifyUpload before the
+// upload counts as done.
+func putArtifact(ctx context.Context, store *s3ArtifactStore, key string, built artifact, job buildJob, name string) error {
+	checksum, err := built.checksumSHA256()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(built.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	params := &s3.PutObjectInput{
+		Bucket:             aws.String(store.bucket),
+		Key:                &key,
+		Body:               f,
+		ContentType:        aws.String(artifactContentType(job.PackageType)),
+		ContentDisposition: aws.String(contentDisposition(name)),
+		Metadata: map[string]string{
+			"sha256": built.SHA256,
+		},
+	}
+	setEncryption(params, job)
+	params.Tagging = aws.String(objectTags(job))
+	if job.StorageClass != "" {
+		params.StorageClass = types.StorageClass(job.StorageClass)
+	}
+	// every part is checksummed, the checksum of the whole object can only be sent along with a single part upload
+	params.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	if built.Size <= artifactUploader.PartSize {
+		params.ChecksumSHA256 = aws.String(checksum)
+	}
+	_, err = artifactUploader.Upload(ctx, params, func(u *manager.Uploader) {
+		u.ClientOptions = append(u.ClientOptions, store.clientOptions()...)
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUploadFailed, err)
+	}
+	return verifyUpload(ctx, store, key, built, checksum)
+}
+
+// uploadPartSize returns the size of the parts the transfer manager splits an upload of size bytes into. It grows
+// the configured part size when the upload would need more than the maximum number of parts.
+func uploadPartSize(size int64) int64 {
+	partSize := artifactUploader.PartSize
+	if size/partSize >= int64(artifactUploader.MaxUploadParts) {
+		partSize = size/int64(artifactUploader.MaxUploadParts) + 1
+	}
+	return partSize
+}
+
+// verifyUpload compares the object stored at key with the local installer. Single part uploads report the SHA-256
+// of the whole object, multipart uploads a checksum of their part checksums ("<checksum>-<parts>") which is
+// recomputed from the local installer with the upload's part size.
+func verifyUpload(ctx context.Context, store *s3ArtifactStore, key string, built artifact, checksum string) error {
+	head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(store.bucket),
+		Key:          aws.String(key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	}, store.clientOptions()...)
+	if err != nil {
+		return fmt.Errorf("%w: failed to verify %s: %w", ErrUploadFailed, key, err)
+	}
+	if head.ContentLength != built.Size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrUploadFailed, key, head.ContentLength, built.Size)
+	}
+	stored := aws.ToString(head.ChecksumSHA256)
+	if stored == "" {
+		// S3 compatible stores set with S3_ENDPOINT may not report checksums, the size was compared
+		return nil
+	}
+	if strings.Contains(stored, "-") {
+		var err error
+		checksum, err = built.multipartChecksumSHA256(uploadPartSize(built.Size))
+		if err != nil {
+			return err
+		}
+	}
+	if stored != checksum {
+		return fmt.Errorf("%w: %s has checksum %s, expected %s", ErrUploadFailed, key, stored, checksum)
+	}
+	return nil
+}
+
+// kmsKeyID returns the KMS key artifacts of a request are encrypted with: the request's kms_key_id, else
+// ARTIFACT_KMS_KEY_ID. Empty means the bucket's default encryption applies.
+func kmsKeyID(installersRequest CreateInstallersRequest) string {
+	if installersRequest.KMSKeyID != "" {
+		return installersRequest.KMSKeyID
+	}
+	return os.Getenv("ARTIFACT_KMS_KEY_ID")
+}
+
+// storageClasses lists the S3 storage classes installers can be uploaded with. Archive classes are left out since
+// their objects can't be downloaded directly.
+var storageClasses = []string{
+	string(types.StorageClassStandard),
+	string(types.StorageClassIntelligentTiering),
+	string(types.StorageClassStandardIa),
+	string(types.StorageClassOnezoneIa),
+}
+
+// storageClass returns the storage class artifacts of a request are uploaded with: the request's storage_class,
+// else ARTIFACT_STORAGE_CLASS. Empty means S3's default, STANDARD.
+func storageClass(installersRequest CreateInstallersRequest) string {
+	if installersRequest.StorageClass != "" {
+		return installersRequest.StorageClass
+	}
+	return os.Getenv("ARTIFACT_STORAGE_CLASS")
+}
+
+func isSupportedStorageClass(class string) bool {
+	for _, c := range storageClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// objectTags returns the URL encoded tag set installers are uploaded with, so lifecycle rules and cost reports can
+// select objects per team without parsing keys. The Fleet URL is hashed, tags are visible to anyone who can read
+// the bucket's inventory.
+func objectTags(job buildJob) string {
+	fleetURLHash := sha256.Sum256([]byte(job.Options.FleetURL))
+	tags := url.Values{}
+	tags.Set("team", tagValue(job.TeamName))
+	tags.Set("package_type", job.PackageType)
+	tags.Set("orbit_channel", tagValue(job.Options.OrbitChannel))
+	tags.Set("fleet_url_hash", hex.EncodeToString(fleetURLHash[:8]))
+	tags.Set("build_id", tagValue(job.BuildID))
+	return tags.Encode()
+}
+
+// tagValue replaces the characters S3 doesn't allow in tag values and truncates s to the maximum tag value length.
+func tagValue(s string) string {
+	const maxTagValueLength = 256
+	value := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsSpace(r) || strings.ContainsRune("+-=._:/@", r) {
+			return r
+		}
+		return '_'
+	}, s)
+	if runes := []rune(value); len(runes) > maxTagValueLength {
+		value = string(runes[:maxTagValueLength])
+	}
+	return value
+}
+
+// setEncryption requests SSE-KMS with the job's customer managed key for an upload, if the job has one.
+func setEncryption(params *s3.PutObjectInput, job buildJob) {
+	if job.KMSKeyID == "" {
+		return
+	}
+	params.ServerSideEncryption = types.ServerSideEncryptionAwsKms
+	params.SSEKMSKeyId = aws.String(job.KMSKeyID)
+}
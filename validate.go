@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEnrollSecretLength mirrors the limit the Fleet server enforces when applying an enroll secret spec.
+const maxEnrollSecretLength = 255
+
+// supportedPackageTypes lists the installer types the packager knows how to build.
+var supportedPackageTypes = []string{"deb", "rpm", "pkg", "msi"}
+
+// enabledPackageTypes lists the installer types this deployment builds, set in main from PACKAGE_TYPES.
+var enabledPackageTypes = supportedPackageTypes
+
+// parseEnabledPackageTypes parses a comma separated list of package types, empty for every supported type.
+func parseEnabledPackageTypes(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return supportedPackageTypes, nil
+	}
+	var packageTypes []string
+	for _, packageType := range strings.Split(s, ",") {
+		packageType = strings.TrimSpace(packageType)
+		if !isSupported(supportedPackageTypes, packageType) {
+			return nil, fmt.Errorf("unsupported package type %q, must be one of: %s", packageType, strings.Join(supportedPackageTypes, ", "))
+		}
+		if !isSupported(packageTypes, packageType) {
+			packageTypes = append(packageTypes, packageType)
+		}
+	}
+	return packageTypes, nil
+}
+
+// fieldError describes a single invalid field in a CreateInstallersRequest.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError is returned by validateRequest and carries every field level problem found in the request,
+// so callers can fix them all in one round trip.
+type validationError struct {
+	Fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		messages = append(messages, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return fmt.Sprintf("invalid request: %s", strings.Join(messages, "; "))
+}
+
+func (e *validationError) Is(target error) bool {
+	return target == ErrBadRequest
+}
+
+func (e *validationError) add(field, format string, args ...any) {
+	e.Fields = append(e.Fields, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateRequest checks a parsed CreateInstallersRequest before any Fleet or build work is started.
+// It returns a *validationError listing every invalid field, or nil if the request is valid.
+func validateRequest(request CreateInstallersRequest) error {
+	verr := &validationError{}
+
+	switch {
+	case request.Global && (request.TeamName != "" || request.TeamID != 0):
+		verr.add("global", "must not be set with team_name or team_id")
+	case isGlobalRequest(request):
+		if request.UseExistingTeam {
+			verr.add("use_existing_team", "must not be set for global installers")
+		}
+	case request.TeamID != 0 && request.TeamName == "":
+		// the name is looked up by ID
+	case strings.TrimSpace(request.TeamName) == "":
+		verr.add("team_name", "must not be empty")
+	case !isSafeTeamName(request.TeamName):
+		verr.add("team_name", "must not be \".\" or \"..\" or contain control characters")
+	}
+
+	if request.TeamID != 0 && request.UseExistingTeam {
+		verr.add("use_existing_team", "must not be set with team_id, which always uses an existing team")
+	}
+
+	if len(request.Packages) == 0 {
+		verr.add("packages", "must contain at least one of: %s", strings.Join(enabledPackageTypes, ", "))
+	}
+	seen := map[string]bool{}
+	for i, spec := range request.Packages {
+		field := fmt.Sprintf("packages[%d]", i)
+		switch {
+		case !isSupported(supportedPackageTypes, spec.Type):
+			verr.add(field, "unsupported package type %q, must be one of: %s", spec.Type, strings.Join(enabledPackageTypes, ", "))
+		case seen[spec.Type]:
+			verr.add(field, "duplicate package type %q", spec.Type)
+		}
+		seen[spec.Type] = true
+		validatePackageSpec(verr, field, spec)
+	}
+
+	// the enroll secret is optional, but when supplied it has to be accepted by the Fleet server
+	if request.EnrollSecret != "" {
+		switch {
+		case strings.TrimSpace(request.EnrollSecret) != request.EnrollSecret:
+			verr.add("enroll_secret", "must not have leading or trailing whitespace")
+		case len(request.EnrollSecret) > maxEnrollSecretLength:
+			verr.add("enroll_secret", "must be at most %d characters", maxEnrollSecretLength)
+		}
+	}
+
+	if request.KMSKeyID != "" && strings.TrimSpace(request.KMSKeyID) != request.KMSKeyID {
+		verr.add("kms_key_id", "must not have leading or trailing whitespace")
+	}
+
+	if request.StorageClass != "" && !isSupportedStorageClass(request.StorageClass) {
+		verr.add("storage_class", "unsupported storage class %q, must be one of: %s", request.StorageClass, strings.Join(storageClasses, ", "))
+	}
+
+	validateArchitecture(verr, request)
+	validateArchitectures(verr, request)
+	validateAgentOptions(verr, request)
+	validateTeamAgentOptions(verr, request)
+	validateFleetInstance(verr, request)
+	validateDestinations(verr, request.Destinations)
+	validateNotificationEmails(verr, request.NotificationEmails)
+
+	if request.ArtifactName != "" || request.KeyTemplate != "" {
+		if field, err := validateArtifactNaming(request); err != nil {
+			verr.add(field, "%s", err)
+		}
+	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return checkPackageCapabilities(request)
+}
+
+// isSupportedPackageType reports whether this deployment builds packageType.
+func isSupportedPackageType(packageType string) bool {
+	return isSupported(enabledPackageTypes, packageType)
+}
+
+// validateArtifactNaming renders the request's artifact name and key templates for every installer and makes sure
+// the installers don't overwrite each other, which happens when the templates reference neither the file name nor
+// the package type and architecture. It returns the name of the offending request field with the error.
+func validateArtifactNaming(request CreateInstallersRequest) (string, error) {
+	seen := map[string]string{}
+	for _, cell := range requestCells(request) {
+		job := buildJob{
+			PackageType:   cell.PackageType,
+			TeamName:      request.TeamName,
+			FleetInstance: request.FleetInstance,
+			KeyTemplate:   keyTemplate(request),
+			NameTemplate:  nameTemplate(request),
+		}
+		job = newArchitectureJob(job, cell.Architecture)
+		label := packageLabel(job.PackageType, job.Architecture)
+		name, err := artifactFileName(job, representativeFileName(job))
+		if err != nil {
+			return "artifact_name", err
+		}
+		key, err := objectKey(job.KeyTemplate, newObjectKeyData(job, name, time.Now()))
+		if err != nil {
+			return "key_template", err
+		}
+		if other, ok := seen[key]; ok {
+			field := "key_template"
+			if request.KeyTemplate == "" {
+				field = "artifact_name"
+			}
+			return field, fmt.Errorf("renders the same key for %s and %s, reference {{.File}}, {{.Package}} or {{.Arch}}", other, label)
+		}
+		seen[key] = label
+	}
+	return "", nil
+}
+
+// isSafeTeamName reports whether a team name can be turned into an object key segment. Most characters are escaped
+// by escapeKeySegment, but relative path names and control characters are rejected outright.
+func isSafeTeamName(name string) bool {
+	if name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	webhookFormatSlack = "slack"
+	webhookFormatTeams = "teams"
+
+	// webhookTimeout bounds a webhook post, notifications must not hold up a build.
+	webhookTimeout = 10 * time.Second
+
+	webhookColorStarted   = "#6a67fe"
+	webhookColorSucceeded = "#3db67b"
+	webhookColorFailed    = "#ff5c83"
+)
+
+// notifier posts build notifications to NOTIFY_WEBHOOK_URL, it's nil unless that's set.
+var notifier *webhookNotifier
+
+// webhookNotifier posts build start, success and failure messages to a Slack or Microsoft Teams incoming webhook.
+type webhookNotifier struct {
+	url    string
+	format string
+	client *resty.Client
+}
+
+// webhookMessage is a notification, rendered for the webhook's format.
+type webhookMessage struct {
+	Title string
+	Text  string
+	Color string
+	Links []webhookLink
+}
+
+// webhookLink is a link button of a notification.
+type webhookLink struct {
+	Name string
+	URL  string
+}
+
+// newWebhookNotifier returns the notifier for NOTIFY_WEBHOOK_URL, see envSecret, or nil if it isn't set.
+// NOTIFY_WEBHOOK_FORMAT selects the message format, "slack" (the default) or "teams".
+func newWebhookNotifier(ctx context.Context) (*webhookNotifier, error) {
+	url, err := envSecret(ctx, "NOTIFY_WEBHOOK_URL")
+	if err != nil {
+		return nil, err
+	}
+	if url == "" {
+		return nil, nil
+	}
+	format := os.Getenv("NOTIFY_WEBHOOK_FORMAT")
+	switch format {
+	case "":
+		format = webhookFormatSlack
+	case webhookFormatSlack, webhookFormatTeams:
+	default:
+		return nil, fmt.Errorf("invalid NOTIFY_WEBHOOK_FORMAT %q, must be %s or %s", format, webhookFormatSlack, webhookFormatTeams)
+	}
+	return &webhookNotifier{url: url, format: format, client: resty.New().SetTimeout(webhookTimeout)}, nil
+}
+
+// notify posts message to the webhook. Failures are logged, notifications never fail a request.
+func (n *webhookNotifier) notify(ctx context.Context, message webhookMessage) {
+	if n == nil {
+		return
+	}
+	var body any
+	switch n.format {
+	case webhookFormatTeams:
+		body = teamsPayload(message)
+	default:
+		body = slackPayload(message)
+	}
+	resp, err := n.client.R().
+		SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(n.url)
+	if err != nil {
+		log.Printf("failed to post %s notification: %s", n.format, err)
+		return
+	}
+	if !resp.IsSuccess() {
+		log.Printf("failed to post %s notification: unexpected status code %d", n.format, resp.StatusCode())
+	}
+}
+
+// slackPayload renders message as a Slack incoming webhook payload.
+func slackPayload(message webhookMessage) map[string]any {
+	text := message.Text
+	for _, link := range message.Links {
+		text += fmt.Sprintf("\n<%s|%s>", link.URL, link.Name)
+	}
+	return map[string]any{
+		"text": message.Title,
+		"attachments": []map[string]any{{
+			"color":     message.Color,
+			"title":     message.Title,
+			"text":      text,
+			"mrkdwn_in": []string{"text"},
+		}},
+	}
+}
+
+// teamsPayload renders message as a Microsoft Teams incoming webhook MessageCard.
+func teamsPayload(message webhookMessage) map[string]any {
+	actions := []map[string]any{}
+	for _, link := range message.Links {
+		actions = append(actions, map[string]any{
+			"@type":   "OpenUri",
+			"name":    link.Name,
+			"targets": []map[string]string{{"os": "default", "uri": link.URL}},
+		})
+	}
+	return map[string]any{
+		"@type":           "MessageCard",
+		"@context":        "https://schema.org/extensions",
+		"summary":         message.Title,
+		"themeColor":      strings.TrimPrefix(message.Color, "#"),
+		"title":           message.Title,
+		"text":            strings.ReplaceAll(message.Text, "\n", "\n\n"),
+		"potentialAction": actions,
+	}
+}
+
+// buildStartedMessage announces that the installers of a request are being built.
+func buildStartedMessage(installersRequest CreateInstallersRequest) webhookMessage {
+	return webhookMessage{
+		Title: fmt.Sprintf("Building Fleet installers for %s", installersRequest.TeamName),
+		Text:  fmt.Sprintf("Packages: %s", strings.Join(requestLabels(installersRequest), ", ")),
+		Color: webhookColorStarted,
+	}
+}
+
+// buildCompletedMessage reports the outcome of a request's builds and links the download page and installers.
+func buildCompletedMessage(response CreateInstallersResponse, duration time.Duration) webhookMessage {
+	message := webhookMessage{
+		Title: fmt.Sprintf("Fleet installers for %s are ready", response.TeamName),
+		Color: webhookColorSucceeded,
+	}
+	lines := []string{fmt.Sprintf("Duration: %s", duration.Round(time.Second))}
+	if response.DownloadPage != "" {
+		message.Links = append(message.Links, webhookLink{Name: "Download page", URL: response.DownloadPage})
+	}
+	for _, result := range response.Results {
+		if result.Status != packageStatusSucceeded {
+			message.Title = fmt.Sprintf("Fleet installers for %s failed", response.TeamName)
+			message.Color = webhookColorFailed
+			lines = append(lines, fmt.Sprintf("%s: failed: %s", packageLabel(result.Package, result.Architecture), result.Error))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: succeeded", packageLabel(result.Package, result.Architecture)))
+		if result.DownloadURL != "" {
+			message.Links = append(message.Links, webhookLink{Name: fmt.Sprintf("Download %s", packageLabel(result.Package, result.Architecture)), URL: result.DownloadURL})
+		}
+	}
+	message.Text = strings.Join(lines, "\n")
+	return message
+}
+
+// buildFailedMessage reports a request that failed before any installer was built.
+func buildFailedMessage(teamName string, err error, duration time.Duration) webhookMessage {
+	return webhookMessage{
+		Title: fmt.Sprintf("Fleet installers for %s failed", teamName),
+		Text:  fmt.Sprintf("Duration: %s\n%s", duration.Round(time.Second), err),
+		Color: webhookColorFailed,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// buildWorkspaceRoot holds what a request's builds write to disk: the files it supplies, see requestFilesDir, and a
+// workspace per installer, see newBuildWorkspace.
+const buildWorkspaceRoot = "/tmp/build"
+
+// strayInstallers matches the installers the packaging library writes to the working directory, left there when a
+// build didn't get to move them to its workspace.
+const strayInstallers = "fleet-osquery*"
+
+// resetBuildWorkspace removes everything builds wrote to disk. Warm containers run one request at a time, so it's
+// called before and after every request: nothing a request built or was sent outlives it, even when the previous
+// request was cut short by a timeout, and it can't leak into another team's installers.
+func resetBuildWorkspace() {
+	if err := os.RemoveAll(buildWorkspaceRoot); err != nil {
+		log.Printf("failed to clean %s: %s", buildWorkspaceRoot, err)
+	}
+	stray, _ := filepath.Glob(strayInstallers)
+	for _, path := range stray {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("failed to remove %s: %s", path, err)
+		}
+	}
+}
+
+// newBuildWorkspace creates a directory of its own for building an installer, removed once it's uploaded.
+func newBuildWorkspace() (string, error) {
+	if err := os.MkdirAll(buildWorkspaceRoot, 0o700); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(buildWorkspaceRoot, "job-")
+}
+
+// moveToWorkspace moves the installer at path, which the packaging library writes to the working directory, into
+// workspace and returns its new path.
+func moveToWorkspace(path string, workspace string) (string, error) {
+	moved := filepath.Join(workspace, filepath.Base(path))
+	if err := os.Rename(path, moved); err != nil {
+		return "", err
+	}
+	return moved, nil
+}
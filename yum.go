@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rpm header tags read for the repository metadata.
+const (
+	rpmTagName        = 1000
+	rpmTagVersion     = 1001
+	rpmTagRelease     = 1002
+	rpmTagEpoch       = 1003
+	rpmTagSummary     = 1004
+	rpmTagDescription = 1005
+	rpmTagBuildTime   = 1006
+	rpmTagBuildHost   = 1007
+	rpmTagSize        = 1009
+	rpmTagVendor      = 1011
+	rpmTagLicense     = 1014
+	rpmTagPackager    = 1015
+	rpmTagGroup       = 1016
+	rpmTagURL         = 1020
+	rpmTagArch        = 1022
+	rpmTagSourceRPM   = 1044
+)
+
+// yumRepositoryEnabled reports whether rpm installers are published to a YUM repository, set YUM_REPOSITORY to
+// enable it. The repository's metadata is signed with GPG_SIGNING_KEY_SECRET, which has to be set as well.
+func yumRepositoryEnabled() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("YUM_REPOSITORY"))
+	return enabled
+}
+
+// yumRepositoryPrefix returns the key prefix of a team's YUM repository, the repository's base URL.
+func yumRepositoryPrefix(teamName string) string {
+	return fmt.Sprintf("yum/%s/", escapeKeySegment(teamName))
+}
+
+// rpmHeader is an rpm's main header, with the offsets it spans in the package.
+type rpmHeader struct {
+	tags  map[int]rpmTagValue
+	start int
+	end   int
+}
+
+// rpmTagValue is the value of a string or integer header tag.
+type rpmTagValue struct {
+	str string
+	num int64
+}
+
+func (h rpmHeader) string(tag int) string { return h.tags[tag].str }
+func (h rpmHeader) int(tag int) int64     { return h.tags[tag].num }
+
+// yumPackagesFile is the file a YUM repository's packages are recorded in, so an update only replaces the
+// architectures it built.
+const yumPackagesFile = "packages.json"
+
+// updateYumRepository publishes the rpms a request uploaded in the team's YUM repository: the rpms are copied to
+// yum/<team>/Packages/ and yum/<team>/repodata/ is regenerated to list them, with a detached signature of repomd.xml.
+// A repository only ever lists the team's latest rpm of each architecture, the enroll secret baked into older ones
+// may be gone.
+func updateYumRepository(ctx context.Context, teamName string, jobs []buildJob, results []PackageResult) error {
+	prefix := yumRepositoryPrefix(teamName)
+	updated := map[string]yumPackage{}
+	copies := map[string]string{}
+	var published []string
+	for _, result := range results {
+		if result.Package != "rpm" || result.Status != packageStatusSucceeded {
+			continue
+		}
+		buf, err := artifactStore.GetObject(ctx, result.Key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", result.Key, err)
+		}
+		pkg, err := newYumPackage(buf, "Packages/"+path.Base(result.Key))
+		if err != nil {
+			return fmt.Errorf("failed to read header of %s: %w", result.Key, err)
+		}
+		updated[pkg.Arch] = pkg
+		copies[pkg.Location.Href] = result.Key
+		published = append(published, result.Key)
+	}
+	if len(published) == 0 {
+		return nil
+	}
+
+	return withIndexLock(ctx, func() error {
+		existing, err := artifactStore.ListObjects(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		packages := map[string]yumPackage{}
+		buf, err := artifactStore.GetObject(ctx, prefix+yumPackagesFile)
+		if err != nil && !errors.Is(err, errObjectNotFound) {
+			return fmt.Errorf("failed to read YUM packages: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(buf, &packages); err != nil {
+				return fmt.Errorf("failed to parse YUM packages: %w", err)
+			}
+		}
+		for arch, pkg := range updated {
+			packages[arch] = pkg
+		}
+		files, err := yumRepodata(packages)
+		if err != nil {
+			return err
+		}
+		state, err := json.Marshal(packages)
+		if err != nil {
+			return err
+		}
+
+		for location, key := range copies {
+			if err := artifactStore.CopyObject(ctx, key, prefix+location, jobs[0]); err != nil {
+				return err
+			}
+		}
+		// metadata is written before the repomd.xml listing it, so clients never see a repomd.xml without its files
+		for _, href := range sortedKeys(files) {
+			contentType := "application/gzip"
+			switch path.Ext(href) {
+			case ".xml":
+				contentType = "text/xml"
+			case ".asc":
+				contentType = "text/plain"
+			}
+			if err := artifactStore.PutObject(ctx, prefix+href, files[href], contentType, jobs[0]); err != nil {
+				return fmt.Errorf("failed to write YUM metadata %s: %w", href, err)
+			}
+		}
+		if err := artifactStore.PutObject(ctx, prefix+yumPackagesFile, state, "application/json", jobs[0]); err != nil {
+			return fmt.Errorf("failed to write YUM packages: %w", err)
+		}
+
+		// drop the replaced rpms and the previous revision's metadata
+		keep := map[string]bool{prefix + yumPackagesFile: true}
+		for href := range files {
+			keep[prefix+href] = true
+		}
+		for _, pkg := range packages {
+			keep[prefix+pkg.Location.Href] = true
+		}
+		var stale []string
+		for _, object := range existing {
+			if !keep[object.Key] {
+				stale = append(stale, object.Key)
+			}
+		}
+		if err := artifactStore.DeleteObjects(ctx, stale); err != nil {
+			log.Printf("failed to delete previous YUM repository revision: %s", err)
+		}
+		log.Printf("published %s to YUM repository %s", strings.Join(published, ", "), prefix)
+		return nil
+	})
+}
+
+// newYumPackage returns the primary.xml entry of an rpm published at location, relative to the repository.
+func newYumPackage(rpm []byte, location string) (yumPackage, error) {
+	header, err := readRPMHeader(rpm)
+	if err != nil {
+		return yumPackage{}, err
+	}
+	sum := sha256.Sum256(rpm)
+	return yumPackage{
+		Type:        "rpm",
+		Name:        header.string(rpmTagName),
+		Arch:        header.string(rpmTagArch),
+		Version:     yumVersion{Epoch: strconv.FormatInt(header.int(rpmTagEpoch), 10), Ver: header.string(rpmTagVersion), Rel: header.string(rpmTagRelease)},
+		Checksum:    yumChecksum{Type: "sha256", PkgID: "YES", Value: hex.EncodeToString(sum[:])},
+		Summary:     header.string(rpmTagSummary),
+		Description: header.string(rpmTagDescription),
+		Packager:    header.string(rpmTagPackager),
+		URL:         header.string(rpmTagURL),
+		Time:        yumTime{File: time.Now().Unix(), Build: header.int(rpmTagBuildTime)},
+		Size:        yumSize{Package: int64(len(rpm)), Installed: header.int(rpmTagSize)},
+		Location:    yumLocation{Href: location},
+		Format: yumFormat{
+			License:     header.string(rpmTagLicense),
+			Vendor:      header.string(rpmTagVendor),
+			Group:       header.string(rpmTagGroup),
+			BuildHost:   header.string(rpmTagBuildHost),
+			SourceRPM:   header.string(rpmTagSourceRPM),
+			HeaderRange: yumHeaderRange{Start: header.start, End: header.end},
+		},
+	}, nil
+}
+
+// yumRepodata returns the repodata files of a repository listing packages by path relative to the repository:
+// primary, filelists and other metadata, repomd.xml listing them and its detached signature repomd.xml.asc.
+func yumRepodata(packages map[string]yumPackage) (map[string][]byte, error) {
+	primary := yumPrimary{XMLNS: "http://linux.duke.edu/metadata/common", XMLNSRPM: "http://linux.duke.edu/metadata/rpm"}
+	filelists := yumFilelists{XMLNS: "http://linux.duke.edu/metadata/filelists"}
+	other := yumOther{XMLNS: "http://linux.duke.edu/metadata/other"}
+	for _, arch := range sortedKeys(packages) {
+		pkg := packages[arch]
+		listed := yumListedPackage{PkgID: pkg.Checksum.Value, Name: pkg.Name, Arch: pkg.Arch, Version: pkg.Version}
+		primary.Package = append(primary.Package, pkg)
+		filelists.Package = append(filelists.Package, listed)
+		other.Package = append(other.Package, listed)
+	}
+	primary.Packages, filelists.Packages, other.Packages = len(packages), len(packages), len(packages)
+
+	now := time.Now().Unix()
+	repomd := yumRepomd{XMLNS: "http://linux.duke.edu/metadata/repo", XMLNSRPM: "http://linux.duke.edu/metadata/rpm", Revision: now}
+	files := map[string][]byte{}
+	for _, metadata := range []struct {
+		kind string
+		v    any
+	}{{"primary", primary}, {"filelists", filelists}, {"other", other}} {
+		data, err := yumMetadata(metadata.v)
+		if err != nil {
+			return nil, err
+		}
+		// metadata files are named after their checksum, so clients never mix the files of two revisions
+		href := fmt.Sprintf("repodata/%s-%s.xml.gz", data.checksum, metadata.kind)
+		files[href] = data.gz
+		repomd.Data = append(repomd.Data, yumRepomdData{
+			Type:         metadata.kind,
+			Checksum:     yumChecksum{Type: "sha256", Value: data.checksum},
+			OpenChecksum: yumChecksum{Type: "sha256", Value: data.openChecksum},
+			Location:     yumLocation{Href: href},
+			Timestamp:    now,
+			Size:         int64(len(data.gz)),
+			OpenSize:     int64(data.openSize),
+		})
+	}
+	repomdXML, err := xml.MarshalIndent(repomd, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal repomd.xml: %w", err)
+	}
+	repomdXML = append([]byte(xml.Header), repomdXML...)
+	repomdSig, err := packageSigner.detachSign(repomdXML)
+	if err != nil {
+		return nil, err
+	}
+	// repomd.xml sorts after the metadata it lists, and is written after it
+	files["repodata/repomd.xml"] = repomdXML
+	files["repodata/repomd.xml.asc"] = repomdSig
+	return files, nil
+}
+
+// readRPMHeader reads the main header of an rpm package: a 96 byte lead, the signature header padded to 8 bytes and
+// the main header. Headers are a magic, an index of tags and a data store.
+func readRPMHeader(rpm []byte) (rpmHeader, error) {
+	const leadSize = 96
+	if len(rpm) < leadSize || !bytes.Equal(rpm[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		return rpmHeader{}, errors.New("not an rpm package")
+	}
+	_, sigEnd, err := readRPMHeaderStructure(rpm, leadSize)
+	if err != nil {
+		return rpmHeader{}, fmt.Errorf("invalid signature header: %w", err)
+	}
+	start := sigEnd + (8-sigEnd%8)%8
+	tags, end, err := readRPMHeaderStructure(rpm, start)
+	if err != nil {
+		return rpmHeader{}, fmt.Errorf("invalid header: %w", err)
+	}
+	return rpmHeader{tags: tags, start: start, end: end}, nil
+}
+
+// readRPMHeaderStructure reads the header structure at offset and returns its string and integer tags and where it
+// ends.
+func readRPMHeaderStructure(rpm []byte, offset int) (map[int]rpmTagValue, int, error) {
+	if offset+16 > len(rpm) || !bytes.Equal(rpm[offset:offset+3], []byte{0x8e, 0xad, 0xe8}) {
+		return nil, 0, errors.New("bad magic")
+	}
+	count := int(binary.BigEndian.Uint32(rpm[offset+8:]))
+	size := int(binary.BigEndian.Uint32(rpm[offset+12:]))
+	index := offset + 16
+	store := index + count*16
+	end := store + size
+	if count < 0 || size < 0 || end > len(rpm) {
+		return nil, 0, errors.New("truncated header")
+	}
+	tags := map[int]rpmTagValue{}
+	for i := 0; i < count; i++ {
+		entry := rpm[index+i*16:]
+		tag := int(binary.BigEndian.Uint32(entry[0:]))
+		typ := binary.BigEndian.Uint32(entry[4:])
+		data := store + int(binary.BigEndian.Uint32(entry[8:]))
+		if data >= end {
+			continue
+		}
+		switch typ {
+		case 4: // INT32
+			if data+4 <= end {
+				tags[tag] = rpmTagValue{num: int64(binary.BigEndian.Uint32(rpm[data:]))}
+			}
+		case 6, 8, 9: // STRING, STRING_ARRAY and I18NSTRING, the first string is used
+			if n := bytes.IndexByte(rpm[data:end], 0); n >= 0 {
+				tags[tag] = rpmTagValue{str: string(rpm[data : data+n])}
+			}
+		}
+	}
+	return tags, end, nil
+}
+
+// yumCompressed is a gzipped repository metadata file with the checksums repomd.xml lists it with.
+type yumCompressed struct {
+	gz           []byte
+	checksum     string
+	openChecksum string
+	openSize     int
+}
+
+// yumMetadata marshals a repository metadata file and gzips it.
+func yumMetadata(v any) (yumCompressed, error) {
+	buf, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return yumCompressed{}, fmt.Errorf("failed to marshal YUM metadata: %w", err)
+	}
+	buf = append([]byte(xml.Header), buf...)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(buf); err != nil {
+		return yumCompressed{}, err
+	}
+	if err := w.Close(); err != nil {
+		return yumCompressed{}, err
+	}
+	openSum := sha256.Sum256(buf)
+	sum := sha256.Sum256(gz.Bytes())
+	return yumCompressed{gz: gz.Bytes(), checksum: hex.EncodeToString(sum[:]), openChecksum: hex.EncodeToString(openSum[:]), openSize: len(buf)}, nil
+}
+
+type yumPrimary struct {
+	XMLName  xml.Name     `xml:"metadata"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	XMLNSRPM string       `xml:"xmlns:rpm,attr"`
+	Packages int          `xml:"packages,attr"`
+	Package  []yumPackage `xml:"package"`
+}
+
+type yumPackage struct {
+	Type        string      `xml:"type,attr"`
+	Name        string      `xml:"name"`
+	Arch        string      `xml:"arch"`
+	Version     yumVersion  `xml:"version"`
+	Checksum    yumChecksum `xml:"checksum"`
+	Summary     string      `xml:"summary"`
+	Description string      `xml:"description"`
+	Packager    string      `xml:"packager"`
+	URL         string      `xml:"url"`
+	Time        yumTime     `xml:"time"`
+	Size        yumSize     `xml:"size"`
+	Location    yumLocation `xml:"location"`
+	Format      yumFormat   `xml:"format"`
+}
+
+type yumVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+type yumChecksum struct {
+	Type  string `xml:"type,attr"`
+	PkgID string `xml:"pkgid,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type yumTime struct {
+	File  int64 `xml:"file,attr"`
+	Build int64 `xml:"build,attr"`
+}
+
+type yumSize struct {
+	Package   int64 `xml:"package,attr"`
+	Installed int64 `xml:"installed,attr"`
+	Archive   int64 `xml:"archive,attr"`
+}
+
+type yumLocation struct {
+	Href string `xml:"href,attr"`
+}
+
+type yumFormat struct {
+	License     string         `xml:"rpm:license"`
+	Vendor      string         `xml:"rpm:vendor"`
+	Group       string         `xml:"rpm:group"`
+	BuildHost   string         `xml:"rpm:buildhost"`
+	SourceRPM   string         `xml:"rpm:sourcerpm"`
+	HeaderRange yumHeaderRange `xml:"rpm:header-range"`
+}
+
+type yumHeaderRange struct {
+	Start int `xml:"start,attr"`
+	End   int `xml:"end,attr"`
+}
+
+type yumFilelists struct {
+	XMLName  xml.Name           `xml:"filelists"`
+	XMLNS    string             `xml:"xmlns,attr"`
+	Packages int                `xml:"packages,attr"`
+	Package  []yumListedPackage `xml:"package"`
+}
+
+type yumOther struct {
+	XMLName  xml.Name           `xml:"otherdata"`
+	XMLNS    string             `xml:"xmlns,attr"`
+	Packages int                `xml:"packages,attr"`
+	Package  []yumListedPackage `xml:"package"`
+}
+
+// yumListedPackage is a package in filelists.xml and other.xml, which list neither files nor changelogs.
+type yumListedPackage struct {
+	PkgID   string     `xml:"pkgid,attr"`
+	Name    string     `xml:"name,attr"`
+	Arch    string     `xml:"arch,attr"`
+	Version yumVersion `xml:"version"`
+}
+
+type yumRepomd struct {
+	XMLName  xml.Name        `xml:"repomd"`
+	XMLNS    string          `xml:"xmlns,attr"`
+	XMLNSRPM string          `xml:"xmlns:rpm,attr"`
+	Revision int64           `xml:"revision"`
+	Data     []yumRepomdData `xml:"data"`
+}
+
+type yumRepomdData struct {
+	Type         string      `xml:"type,attr"`
+	Checksum     yumChecksum `xml:"checksum"`
+	OpenChecksum yumChecksum `xml:"open-checksum"`
+	Location     yumLocation `xml:"location"`
+	Timestamp    int64       `xml:"timestamp"`
+	Size         int64       `xml:"size"`
+	OpenSize     int64       `xml:"open-size"`
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}